@@ -0,0 +1,218 @@
+package gitspy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrInvalidAdvertisement = errors.New("invalid ref advertisement")
+
+// Capabilities as sent on the wire, in the order they were sent.
+type Capabilities []string
+
+func ParseCapabilities(s string) Capabilities {
+	return Capabilities(strings.Fields(s))
+}
+
+// Has reports whether name is present, with or without a value.
+func (c Capabilities) Has(name string) bool {
+	_, ok := c.Get(name)
+	return ok
+}
+
+// Get returns the value of the first "name=value" capability, or "" for a
+// capability without a value.
+func (c Capabilities) Get(name string) (string, bool) {
+	for _, cap := range c {
+		if cap == name {
+			return "", true
+		} else if strings.HasPrefix(cap, name+"=") {
+			return cap[len(name)+1:], true
+		}
+	}
+
+	return "", false
+}
+
+// All returns the values of every "name=value" capability, such as each
+// symref.
+func (c Capabilities) All(name string) []string {
+	var values []string
+
+	for _, cap := range c {
+		if strings.HasPrefix(cap, name+"=") {
+			values = append(values, cap[len(name)+1:])
+		}
+	}
+
+	return values
+}
+
+// Remove returns the capabilities without any named name.
+func (c Capabilities) Remove(name string) Capabilities {
+	var out Capabilities
+
+	for _, cap := range c {
+		if cap != name && !strings.HasPrefix(cap, name+"=") {
+			out = append(out, cap)
+		}
+	}
+
+	return out
+}
+
+func (c Capabilities) String() string {
+	return strings.Join(c, " ")
+}
+
+// An Advertisement is what a server sends before the client's request: the
+// refs and capabilities of a v0 or v1 server, or just the capabilities of a
+// v2 server.
+// https://www.kernel.org/pub/software/scm/git/docs/technical/pack-protocol.html#_reference_discovery
+type Advertisement struct {
+	// Version is 1 or 2 if the server announced one, else 0
+	Version int
+
+	// Refs in the order advertised. Peeled tags are set on the tag's Ref.
+	Refs         []Ref
+	Capabilities Capabilities
+	Shallow      []string
+}
+
+// Symrefs maps each symbolic ref the server announced to its target.
+func (a *Advertisement) Symrefs() map[string]string {
+	symrefs := map[string]string{}
+
+	for _, s := range a.Capabilities.All("symref") {
+		if i := strings.IndexByte(s, ':'); i > 0 {
+			symrefs[s[:i]] = s[i+1:]
+		}
+	}
+
+	return symrefs
+}
+
+// Ref returns the advertised ref called name.
+func (a *Advertisement) Ref(name string) (Ref, bool) {
+	for _, r := range a.Refs {
+		if r.Name == name {
+			return r, true
+		}
+	}
+
+	return Ref{}, false
+}
+
+// ParseAdvertisement parses the data packets of an advertisement, not
+// including the flush that ends it.
+func ParseAdvertisement(pkts []Packet) (*Advertisement, error) {
+	a := &Advertisement{}
+
+	first := true
+
+	for _, p := range pkts {
+		if p.Type != DataPkt {
+			return nil, fmt.Errorf("Unexpected %v packet in advertisement", p.Type)
+		}
+
+		line := bytes.TrimSuffix(p.Data, []byte("\n"))
+
+		if first && bytes.HasPrefix(line, []byte("version ")) {
+			_, err := fmt.Sscanf(string(line), "version %d", &a.Version)
+			if err != nil {
+				return nil, ErrInvalidAdvertisement
+			}
+
+			continue
+		}
+
+		if a.Version == 2 {
+			a.Capabilities = append(a.Capabilities, string(line))
+			continue
+		}
+
+		if bytes.HasPrefix(line, []byte("shallow ")) {
+			a.Shallow = append(a.Shallow, string(line[len("shallow "):]))
+			continue
+		}
+
+		if first {
+			first = false
+
+			i := bytes.IndexByte(line, 0)
+			if i < 0 {
+				return nil, ErrInvalidAdvertisement
+			}
+
+			a.Capabilities = ParseCapabilities(string(line[i+1:]))
+			line = line[:i]
+		}
+
+		f := strings.Fields(string(line))
+		if len(f) != 2 || len(f[0]) != len(ZeroID) {
+			return nil, ErrInvalidAdvertisement
+		}
+
+		switch {
+		case f[1] == "capabilities^{}":
+			// An empty repository, advertising only capabilities
+		case strings.HasSuffix(f[1], "^{}"):
+			n := len(a.Refs)
+			if n == 0 || a.Refs[n-1].Name != strings.TrimSuffix(f[1], "^{}") {
+				return nil, ErrInvalidAdvertisement
+			}
+
+			a.Refs[n-1].Peeled = f[0]
+		default:
+			a.Refs = append(a.Refs, Ref{ID: f[0], Name: f[1]})
+		}
+	}
+
+	return a, nil
+}
+
+// Packets formats the advertisement as data packets, not including the
+// flush that ends it.
+func (a *Advertisement) Packets() []Packet {
+	var pkts []Packet
+
+	line := func(format string, args ...interface{}) {
+		pkts = append(pkts, DataPacket([]byte(fmt.Sprintf(format, args...))))
+	}
+
+	if a.Version > 0 {
+		line("version %d\n", a.Version)
+	}
+
+	if a.Version == 2 {
+		for _, c := range a.Capabilities {
+			line("%s\n", c)
+		}
+
+		return pkts
+	}
+
+	for i, r := range a.Refs {
+		if i == 0 {
+			line("%s %s\x00%s\n", r.ID, r.Name, a.Capabilities)
+		} else {
+			line("%s %s\n", r.ID, r.Name)
+		}
+
+		if r.Peeled != "" {
+			line("%s %s^{}\n", r.Peeled, r.Name)
+		}
+	}
+
+	if len(a.Refs) == 0 && len(a.Capabilities) > 0 {
+		line("%s capabilities^{}\x00%s\n", ZeroID, a.Capabilities)
+	}
+
+	for _, s := range a.Shallow {
+		line("shallow %s\n", s)
+	}
+
+	return pkts
+}
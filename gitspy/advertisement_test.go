@@ -0,0 +1,120 @@
+package gitspy
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testPackets(lines ...string) []Packet {
+	var pkts []Packet
+	for _, l := range lines {
+		pkts = append(pkts, DataPacket([]byte(l)))
+	}
+
+	return pkts
+}
+
+func testSamePackets(t *testing.T, a, b []Packet) {
+	if len(a) != len(b) {
+		t.Fatalf("Wrong number of packets: %d != %d", len(a), len(b))
+	}
+
+	for i := range a {
+		if a[i].Type != b[i].Type || !bytes.Equal(a[i].Data, b[i].Data) {
+			t.Errorf("Packet %d differs: %q != %q", i, a[i].Data, b[i].Data)
+		}
+	}
+}
+
+func TestParseAdvertisement(t *testing.T) {
+	pkts := testPackets(
+		oldID+" HEAD\x00multi_ack side-band-64k symref=HEAD:refs/heads/master agent=git/2.39.5\n",
+		oldID+" refs/heads/master\n",
+		newID+" refs/tags/v1\n",
+		oldID+" refs/tags/v1^{}\n",
+		"shallow "+newID+"\n",
+	)
+
+	a, err := ParseAdvertisement(pkts)
+	if err != nil {
+		t.Fatalf("Error from parse: %v", err)
+	}
+
+	if len(a.Refs) != 3 || a.Refs[2].Name != "refs/tags/v1" || a.Refs[2].Peeled != oldID {
+		t.Errorf("Bad refs: %#v", a.Refs)
+	}
+
+	if !a.Capabilities.Has("side-band-64k") || a.Capabilities.Has("side-band") {
+		t.Errorf("Bad capabilities: %v", a.Capabilities)
+	}
+
+	if v, _ := a.Capabilities.Get("agent"); v != "git/2.39.5" {
+		t.Errorf("Bad agent: %q", v)
+	}
+
+	if a.Symrefs()["HEAD"] != "refs/heads/master" {
+		t.Errorf("Bad symrefs: %v", a.Symrefs())
+	}
+
+	if len(a.Shallow) != 1 || a.Shallow[0] != newID {
+		t.Errorf("Bad shallow: %v", a.Shallow)
+	}
+
+	testSamePackets(t, a.Packets(), pkts)
+}
+
+func TestParseAdvertisementEmpty(t *testing.T) {
+	pkts := testPackets(
+		"version 1\n",
+		ZeroID+" capabilities^{}\x00report-status delete-refs\n",
+	)
+
+	a, err := ParseAdvertisement(pkts)
+	if err != nil {
+		t.Fatalf("Error from parse: %v", err)
+	}
+
+	if a.Version != 1 || len(a.Refs) != 0 || !a.Capabilities.Has("delete-refs") {
+		t.Errorf("Bad decode: %#v", a)
+	}
+
+	testSamePackets(t, a.Packets(), pkts)
+}
+
+func TestParseAdvertisementV2(t *testing.T) {
+	pkts := testPackets("version 2\n", "agent=git/2.39.5\n", "ls-refs=unborn\n", "fetch=shallow wait-for-done\n")
+
+	a, err := ParseAdvertisement(pkts)
+	if err != nil {
+		t.Fatalf("Error from parse: %v", err)
+	}
+
+	if a.Version != 2 || len(a.Capabilities) != 3 {
+		t.Errorf("Bad decode: %#v", a)
+	}
+
+	if v, _ := a.Capabilities.Get("fetch"); v != "shallow wait-for-done" {
+		t.Errorf("Bad fetch capability: %q", v)
+	}
+
+	testSamePackets(t, a.Packets(), pkts)
+}
+
+func TestParseAdvertisementInvalid(t *testing.T) {
+	_, err := ParseAdvertisement(testPackets(oldID + " refs/heads/master\n"))
+	if err != ErrInvalidAdvertisement {
+		t.Errorf("Should be invalid without capabilities: %v", err)
+	}
+}
+
+func TestCapabilitiesRemove(t *testing.T) {
+	c := ParseCapabilities("multi_ack symref=HEAD:refs/heads/master symref=x:y thin-pack")
+
+	if c.Remove("symref").String() != "multi_ack thin-pack" {
+		t.Errorf("Bad remove: %v", c.Remove("symref"))
+	}
+
+	if len(c.All("symref")) != 2 {
+		t.Errorf("Bad all: %v", c.All("symref"))
+	}
+}
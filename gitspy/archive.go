@@ -0,0 +1,57 @@
+package gitspy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// proxyUploadArchiveRequest forwards the client's argument pkt-lines to
+// git-upload-archive.
+func (gs *GitSpy) proxyUploadArchiveRequest(dst io.Writer, src io.Reader) error {
+	err := gs.proxyPkts(dst, src, ClientToServer, PhaseArguments, false)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// proxyUploadArchiveResponse forwards the ACK or NACK status from
+// git-upload-archive followed by the sideband multiplexed archive.
+func (gs *GitSpy) proxyUploadArchiveResponse(dst io.Writer, src io.Reader) error {
+	b := make([]byte, 65516)
+	nack := false
+
+	for {
+		p, err := readPacket(src, b)
+		if err != nil {
+			return fmt.Errorf("Failed proxying status to client: %v", err)
+		}
+
+		if bytes.HasPrefix(p.Data, []byte("NACK")) {
+			nack = true
+		}
+
+		err = gs.send(dst, gs.context(ServerToClient, PhaseResponse), p)
+		if err != nil {
+			return err
+		}
+
+		if p.Type == FlushPkt {
+			break
+		}
+	}
+
+	if nack {
+		return nil
+	}
+
+	err := gs.proxyPkts(dst, src, ServerToClient, PhaseSideband, false)
+	if err != nil {
+		return fmt.Errorf("Failed proxying archive to client: %v", err)
+	}
+
+	return nil
+}
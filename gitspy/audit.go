@@ -0,0 +1,177 @@
+package gitspy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultAuditMaxSize is how large an audit log grows before it is rotated.
+const DefaultAuditMaxSize = 100 << 20
+
+// DefaultAuditBackups is how many rotated audit logs are kept.
+const DefaultAuditBackups = 5
+
+// An AuditRefUpdate is a ref a push asked to update.
+type AuditRefUpdate struct {
+	Ref string `json:"ref"`
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// An AuditRecord describes a git operation once it is over.
+type AuditRecord struct {
+	Time time.Time `json:"time"`
+
+	Session    string `json:"session"`
+	User       string `json:"user"`
+	RemoteAddr string `json:"remote_addr"`
+	Repo       string `json:"repo"`
+	Service    string `json:"service"`
+	Protocol   string `json:"protocol,omitempty"`
+
+	// Object ids, or ref names, a fetch asked for
+	Wants []string `json:"wants,omitempty"`
+
+	Updates []AuditRefUpdate `json:"updates,omitempty"`
+
+	// Bytes sent by the client and by the upstream
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+
+	Duration   float64 `json:"duration_seconds"`
+	ExitStatus uint32  `json:"exit_status"`
+	Error      string  `json:"error,omitempty"`
+}
+
+func newAuditRecord(req *Request) *AuditRecord {
+	return &AuditRecord{
+		Time:       time.Now().UTC(),
+		Session:    req.ID,
+		User:       req.User,
+		RemoteAddr: req.RemoteAddr,
+		Repo:       req.Repo,
+		Service:    req.Service,
+		Protocol:   req.Protocol,
+	}
+}
+
+// spied fills in what gs saw of the operation.
+func (a *AuditRecord) spied(gs *GitSpy) {
+	a.Wants = gs.Negotiation().Wants()
+
+	for _, u := range gs.Updates() {
+		a.Updates = append(a.Updates, AuditRefUpdate{Ref: u.Name, Old: u.Old, New: u.New})
+	}
+
+	a.BytesIn = gs.Bytes(ClientToServer)
+	a.BytesOut = gs.Bytes(ServerToClient)
+}
+
+// An AuditLog writes audit records as JSON lines to a file at Path. Once
+// the file grows past MaxSize it is renamed to Path.1, older logs moving
+// along to Path.2 and so on, and only Backups of them are kept.
+type AuditLog struct {
+	Path    string
+	MaxSize int64
+	Backups int
+
+	f    *os.File
+	size int64
+	lock sync.Mutex
+}
+
+func NewAuditLog(path string) *AuditLog {
+	return &AuditLog{Path: path, MaxSize: DefaultAuditMaxSize, Backups: DefaultAuditBackups}
+}
+
+func (l *AuditLog) open() error {
+	f, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to open audit log: %v", err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("Failed to open audit log: %v", err)
+	}
+
+	l.f = f
+	l.size = fi.Size()
+
+	return nil
+}
+
+func (l *AuditLog) rotate() error {
+	l.f.Close()
+	l.f = nil
+
+	for i := l.Backups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.Path, i), fmt.Sprintf("%s.%d", l.Path, i+1))
+	}
+
+	var err error
+	if l.Backups > 0 {
+		err = os.Rename(l.Path, l.Path+".1")
+	} else {
+		err = os.Remove(l.Path)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed to rotate audit log: %v", err)
+	}
+
+	return l.open()
+}
+
+func (l *AuditLog) Write(a *AuditRecord) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	b = append(b, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.f == nil {
+		err = l.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	if l.MaxSize > 0 && l.size > 0 && l.size+int64(len(b)) > l.MaxSize {
+		err = l.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+
+	if err != nil {
+		return fmt.Errorf("Failed to write audit log: %v", err)
+	}
+
+	return nil
+}
+
+func (l *AuditLog) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+
+	err := l.f.Close()
+	l.f = nil
+
+	return err
+}
@@ -0,0 +1,52 @@
+package gitspy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditLogRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	l := NewAuditLog(filepath.Join(dir, "audit.log"))
+	l.MaxSize = 300
+	l.Backups = 2
+
+	a := newAuditRecord(&Request{ID: "abc", Service: ReceivePack, Repo: "/test.git", User: "alice", RemoteAddr: "127.0.0.1:1234"})
+	a.Updates = []AuditRefUpdate{{Ref: "refs/heads/master", Old: oldID, New: newID}}
+
+	for i := 0; i < 4; i++ {
+		err := l.Write(a)
+		if err != nil {
+			t.Fatalf("Error from Write: %v", err)
+		}
+	}
+
+	l.Close()
+
+	for _, name := range []string{"audit.log", "audit.log.1", "audit.log.2"} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Missing %s: %v", name, err)
+		}
+
+		var r AuditRecord
+		err = json.Unmarshal([]byte(strings.SplitN(string(b), "\n", 2)[0]), &r)
+		if err != nil || r.Session != "abc" || r.Updates[0].New != newID || r.RemoteAddr != "127.0.0.1:1234" {
+			t.Errorf("Bad record in %s: %v %v", name, r, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "audit.log.3")); err == nil {
+		t.Errorf("Should only keep 2 backups")
+	}
+}
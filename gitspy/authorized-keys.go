@@ -0,0 +1,260 @@
+package gitspy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Permissions extensions set by AuthorizedKeys for an authenticated client
+const (
+	ExtensionUser        = "gitspy-user"
+	ExtensionCommand     = "gitspy-command"
+	ExtensionFingerprint = "pubkey-fp"
+)
+
+var ErrUnauthorized = errors.New("unauthorized key")
+
+type authorizedKey struct {
+	key     ssh.PublicKey
+	user    string
+	from    []string
+	expiry  time.Time
+	command string
+}
+
+// AuthorizedKeys authenticates clients against a file in OpenSSH's
+// authorized_keys format. The identity of a key is taken from an
+// environment="GITSPY_USER=<name>" option, falling back to the key's comment
+// and then its fingerprint. The from=, expiry-time= and command= options
+// are honoured. The file is re-read whenever it changes.
+type AuthorizedKeys struct {
+	Path string
+
+	keys    []authorizedKey
+	modTime time.Time
+	lock    sync.Mutex
+}
+
+func LoadAuthorizedKeys(path string) (*AuthorizedKeys, error) {
+	ak := &AuthorizedKeys{Path: path}
+
+	err := ak.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return ak, nil
+}
+
+func (ak *AuthorizedKeys) reload() error {
+	fi, err := os.Stat(ak.Path)
+	if err != nil {
+		return fmt.Errorf("Failed to read authorized keys: %v", err)
+	}
+
+	if fi.ModTime().Equal(ak.modTime) {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(ak.Path)
+	if err != nil {
+		return fmt.Errorf("Failed to read authorized keys: %v", err)
+	}
+
+	keys, err := parseAuthorizedKeys(b)
+	if err != nil {
+		return fmt.Errorf("Failed to parse %s: %v", ak.Path, err)
+	}
+
+	ak.keys = keys
+	ak.modTime = fi.ModTime()
+
+	log.Printf("Loaded %d authorized keys from %s", len(keys), ak.Path)
+
+	return nil
+}
+
+func parseAuthorizedKeys(b []byte) ([]authorizedKey, error) {
+	var keys []authorizedKey
+
+	for len(bytes.TrimSpace(b)) > 0 {
+		key, comment, options, rest, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			// ParseAuthorizedKey skips lines it can't parse, so this is the end
+			break
+		}
+
+		ak := authorizedKey{key: key, user: comment}
+		if ak.user == "" {
+			ak.user = ssh.FingerprintSHA256(key)
+		}
+
+		for _, o := range options {
+			name, value := parseKeyOption(o)
+
+			switch strings.ToLower(name) {
+			case "from":
+				ak.from = strings.Split(value, ",")
+			case "expiry-time":
+				ak.expiry, err = parseExpiryTime(value)
+				if err != nil {
+					return nil, err
+				}
+			case "command":
+				ak.command = value
+			case "environment":
+				if strings.HasPrefix(value, "GITSPY_USER=") {
+					ak.user = strings.TrimPrefix(value, "GITSPY_USER=")
+				}
+			}
+		}
+
+		keys = append(keys, ak)
+		b = rest
+	}
+
+	return keys, nil
+}
+
+// parseKeyOption splits an option such as from="10.0.0.0/8" into its name
+// and unquoted value.
+func parseKeyOption(o string) (name string, value string) {
+	i := strings.IndexByte(o, '=')
+	if i < 0 {
+		return o, ""
+	}
+
+	name = o[:i]
+	value = o[i+1:]
+
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = strings.Replace(value[1:len(value)-1], `\"`, `"`, -1)
+	}
+
+	return
+}
+
+// parseExpiryTime parses YYYYMMDD[HHMM[SS]] in local time, or UTC with a
+// trailing Z, as sshd does.
+func parseExpiryTime(s string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(s, "Z") || strings.HasSuffix(s, "z") {
+		loc = time.UTC
+		s = s[:len(s)-1]
+	}
+
+	layouts := map[int]string{
+		8:  "20060102",
+		12: "200601021504",
+		14: "20060102150405",
+	}
+
+	layout, ok := layouts[len(s)]
+	if !ok {
+		return time.Time{}, fmt.Errorf("Invalid expiry-time '%s'", s)
+	}
+
+	return time.ParseInLocation(layout, s, loc)
+}
+
+// matchFrom checks a client address against from= patterns, which may be
+// host names or addresses with wildcards, CIDR ranges, or negations of
+// either.
+func matchFrom(patterns []string, addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+
+	ip := net.ParseIP(host)
+
+	match := func(p string) bool {
+		if _, cidr, err := net.ParseCIDR(p); err == nil {
+			return ip != nil && cidr.Contains(ip)
+		}
+
+		return matchWildcard(strings.ToLower(p), strings.ToLower(host))
+	}
+
+	matched := false
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "!") {
+			if match(p[1:]) {
+				return false
+			}
+		} else if match(p) {
+			matched = true
+		}
+	}
+
+	return matched
+}
+
+// PublicKeyCallback can be used as an ssh.ServerConfig's PublicKeyCallback.
+func (ak *AuthorizedKeys) PublicKeyCallback(c ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+	ak.lock.Lock()
+	defer ak.lock.Unlock()
+
+	err := ak.reload()
+	if err != nil {
+		// Keep using the keys we have
+		log.Printf("%v", err)
+	}
+
+	for _, k := range ak.keys {
+		if !keysEqual(k.key, pubKey) {
+			continue
+		}
+
+		if k.from != nil && !matchFrom(k.from, c.RemoteAddr()) {
+			log.Printf("Key for %s not allowed from %v", k.user, c.RemoteAddr())
+			continue
+		}
+
+		if !k.expiry.IsZero() && time.Now().After(k.expiry) {
+			log.Printf("Key for %s expired at %v", k.user, k.expiry)
+			continue
+		}
+
+		p := &ssh.Permissions{Extensions: map[string]string{
+			ExtensionUser:        k.user,
+			ExtensionFingerprint: ssh.FingerprintSHA256(pubKey),
+		}}
+
+		if k.command != "" {
+			p.Extensions[ExtensionCommand] = k.command
+		}
+
+		return p, nil
+	}
+
+	return nil, ErrUnauthorized
+}
+
+// permissionsUser returns the identity AuthorizedKeys attached to a
+// connection.
+func permissionsUser(p *ssh.Permissions) string {
+	if p == nil {
+		return ""
+	}
+
+	return p.Extensions[ExtensionUser]
+}
+
+func permissionsCommand(p *ssh.Permissions) string {
+	if p == nil {
+		return ""
+	}
+
+	return p.Extensions[ExtensionCommand]
+}
@@ -0,0 +1,101 @@
+package gitspy
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type testConnMetadata struct {
+	remote net.Addr
+}
+
+func (c testConnMetadata) User() string          { return "git" }
+func (c testConnMetadata) SessionID() []byte     { return nil }
+func (c testConnMetadata) ClientVersion() []byte { return nil }
+func (c testConnMetadata) ServerVersion() []byte { return nil }
+func (c testConnMetadata) RemoteAddr() net.Addr  { return c.remote }
+func (c testConnMetadata) LocalAddr() net.Addr   { return nil }
+
+func testAuthorizedKeys(t *testing.T, contents string) *AuthorizedKeys {
+	f, err := ioutil.TempFile("", "authorized_keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.WriteString(contents)
+	f.Close()
+
+	ak, err := LoadAuthorizedKeys(f.Name())
+	if err != nil {
+		t.Fatalf("Failed to load: %v", err)
+	}
+
+	return ak
+}
+
+func TestAuthorizedKeysIdentity(t *testing.T) {
+	alice := testSigner(t).PublicKey()
+	bob := testSigner(t).PublicKey()
+	eve := testSigner(t).PublicKey()
+
+	key := func(k ssh.PublicKey) string {
+		return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(k)))
+	}
+
+	ak := testAuthorizedKeys(t, key(alice)+" alice@laptop\n"+
+		`environment="GITSPY_USER=bob",command="git-upload-pack 'docs.git'" `+key(bob)+" deploy key\n")
+	defer os.Remove(ak.Path)
+
+	conn := testConnMetadata{&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 4000}}
+
+	p, err := ak.PublicKeyCallback(conn, alice)
+	if err != nil {
+		t.Fatalf("Alice should be authorized: %v", err)
+	}
+
+	if permissionsUser(p) != "alice@laptop" || permissionsCommand(p) != "" {
+		t.Errorf("Wrong permissions for alice: %v", p.Extensions)
+	}
+
+	p, err = ak.PublicKeyCallback(conn, bob)
+	if err != nil {
+		t.Fatalf("Bob should be authorized: %v", err)
+	}
+
+	if permissionsUser(p) != "bob" || permissionsCommand(p) != "git-upload-pack 'docs.git'" {
+		t.Errorf("Wrong permissions for bob: %v", p.Extensions)
+	}
+
+	_, err = ak.PublicKeyCallback(conn, eve)
+	if err != ErrUnauthorized {
+		t.Errorf("Eve should not be authorized: %v", err)
+	}
+}
+
+func TestAuthorizedKeysRestrictions(t *testing.T) {
+	k := testSigner(t).PublicKey()
+	line := string(ssh.MarshalAuthorizedKey(k))
+
+	ak := testAuthorizedKeys(t, `from="10.0.0.0/8,!10.0.0.1",expiry-time="20990101" `+line+
+		`expiry-time="20000101Z" `+line)
+	defer os.Remove(ak.Path)
+
+	allowed := testConnMetadata{&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 4000}}
+	_, err := ak.PublicKeyCallback(allowed, k)
+	if err != nil {
+		t.Errorf("Should be allowed from %v: %v", allowed.remote, err)
+	}
+
+	for _, ip := range []string{"10.0.0.1", "192.168.1.1"} {
+		denied := testConnMetadata{&net.TCPAddr{IP: net.ParseIP(ip), Port: 4000}}
+		_, err = ak.PublicKeyCallback(denied, k)
+		if err != ErrUnauthorized {
+			t.Errorf("Should not be allowed from %s: %v", ip, err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package gitspy
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+)
+
+// DefaultCommitCacheSize is how many commits a CommitCache remembers.
+const DefaultCommitCacheSize = 100000
+
+// ParseCommitParents returns the parents listed in a commit object's header.
+func ParseCommitParents(b []byte) []string {
+	var parents []string
+
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i <= 0 {
+			break
+		}
+
+		line := string(b[:i])
+		b = b[i+1:]
+
+		if strings.HasPrefix(line, "parent ") {
+			parents = append(parents, line[len("parent "):])
+		}
+	}
+
+	return parents
+}
+
+// A CommitCache remembers the parents of commits seen in packs passing
+// through the proxy, so history can be followed past what a single pack
+// holds. Commit ids name the same commit in every repository, so one cache
+// serves them all.
+type CommitCache struct {
+	Size int
+
+	parents map[string][]string
+	lock    sync.Mutex
+}
+
+func NewCommitCache() *CommitCache {
+	return &CommitCache{Size: DefaultCommitCacheSize, parents: map[string][]string{}}
+}
+
+func (c *CommitCache) Add(id string, parents []string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.parents) >= c.Size {
+		// Forget an arbitrary commit to make room
+		for k := range c.parents {
+			delete(c.parents, k)
+			break
+		}
+	}
+
+	c.parents[id] = parents
+}
+
+func (c *CommitCache) Parents(id string) ([]string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	p, ok := c.parents[id]
+	return p, ok
+}
+
+// isAncestor reports whether ancestor can be reached from id by following
+// parents. Commits parents does not know end the search down that path, so
+// known reports whether all of id's history was followed: if not, the
+// answer may only mean the history was not seen.
+func isAncestor(ancestor, id string, parents func(string) ([]string, bool)) (is, known bool) {
+	seen := map[string]bool{}
+	queue := []string{id}
+	known = true
+
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+
+		if id == ancestor {
+			return true, true
+		}
+
+		if seen[id] {
+			continue
+		}
+
+		seen[id] = true
+
+		p, ok := parents(id)
+		if ok {
+			queue = append(queue, p...)
+		} else {
+			known = false
+		}
+	}
+
+	return false, known
+}
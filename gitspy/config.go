@@ -0,0 +1,419 @@
+package gitspy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+// DefaultListen is where a proxy takes ssh connections unless configured
+// otherwise.
+const DefaultListen = "127.0.0.1:2022"
+
+// DefaultShutdownTimeout is how long sessions are waited for on shutdown
+// unless configured otherwise.
+const DefaultShutdownTimeout = 30 * time.Second
+
+// A Config declares everything about a proxy, as read from a JSON file by
+// LoadConfig. Fields left out take the defaults Validate fills in.
+//
+//	{
+//		"listen": {"ssh": "0.0.0.0:2022", "http": "0.0.0.0:8080"},
+//		"routes": [
+//			{"host": "github.com"},
+//			{"prefix": "gitlab/", "strip_prefix": true, "url": "https://gitlab.internal", "credentials": "gitlab-credentials"}
+//		],
+//		"hide_refs": [{"pattern": "refs/pull/*"}],
+//		"push_policy": {"branches": [{"pattern": "refs/heads/master", "deny_non_fast_forward": true, "deny_delete": true}]},
+//		"scan_secrets": true,
+//		"audit_log": "/var/log/git-spy/audit.log"
+//	}
+type Config struct {
+	Listen Listen `json:"listen"`
+
+	// StateDir holds the host keys, generated if missing
+	StateDir        string `json:"state_dir"`
+	AuthorizedKeys  string `json:"authorized_keys"`
+	KnownHosts      string `json:"known_hosts"`
+	TrustOnFirstUse bool   `json:"trust_on_first_use,omitempty"`
+
+	// HTTPUsers, if set, is the file of HTTPUsers allowed to authenticate
+	// over smart HTTP, and so to push
+	HTTPUsers string `json:"http_users,omitempty"`
+
+	// Routes to upstreams, DefaultRoutes if there are none
+	Routes []RouteConfig `json:"routes,omitempty"`
+
+	// MirrorDir, if set, keeps Mirrors of fetched repositories
+	MirrorDir string `json:"mirror_dir,omitempty"`
+
+	HideRefs   []RefRule         `json:"hide_refs,omitempty"`
+	PushPolicy *PushPolicyConfig `json:"push_policy,omitempty"`
+
+	// ScanSecrets rejects pushes adding credentials found by SecretRules,
+	// DefaultSecretRules if there are none
+	ScanSecrets bool         `json:"scan_secrets,omitempty"`
+	SecretRules []SecretRule `json:"secret_rules,omitempty"`
+
+	RecordDir string `json:"record_dir,omitempty"`
+	AuditLog  string `json:"audit_log,omitempty"`
+
+	ShutdownTimeout Duration `json:"shutdown_timeout,omitempty"`
+}
+
+// Listen holds the addresses a proxy listens on. Those other than SSH are
+// off when empty.
+type Listen struct {
+	SSH     string `json:"ssh"`
+	HTTP    string `json:"http,omitempty"`
+	Daemon  string `json:"daemon,omitempty"`
+	Metrics string `json:"metrics,omitempty"`
+}
+
+// A RouteConfig declares a Route. Credentials is a git-credential-store
+// file for a smart HTTP upstream.
+type RouteConfig struct {
+	Prefix      string `json:"prefix,omitempty"`
+	StripPrefix bool   `json:"strip_prefix,omitempty"`
+
+	Host    string `json:"host,omitempty"`
+	Port    int    `json:"port,omitempty"`
+	User    string `json:"user,omitempty"`
+	KeyFile string `json:"key_file,omitempty"`
+
+	URL         string `json:"url,omitempty"`
+	Credentials string `json:"credentials,omitempty"`
+}
+
+// A PushPolicyConfig declares a PushPolicy.
+type PushPolicyConfig struct {
+	Branches    []BranchRule `json:"branches,omitempty"`
+	TagCreators []string     `json:"tag_creators,omitempty"`
+}
+
+// A Duration is a time.Duration written as a string such as "30s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return fmt.Errorf("Duration should be a string such as \"30s\": %s", b)
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// LoadConfig reads and validates the config file at path. Relative paths
+// in it are taken to be relative to the file.
+func LoadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read config: %v", err)
+	}
+
+	c, err := ParseConfig(b)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config %s: %v", path, err)
+	}
+
+	c.resolve(filepath.Dir(path))
+
+	return c, nil
+}
+
+// ParseConfig parses and validates a JSON config. Unknown fields are
+// errors, so that a misspelt setting isn't silently ignored.
+func ParseConfig(b []byte) (*Config, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+
+	c := &Config{}
+
+	err := d.Decode(c)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Validate fills in defaults and checks the config makes sense. Files it
+// refers to are only checked by Settings.
+func (c *Config) Validate() error {
+	if c.Listen.SSH == "" {
+		c.Listen.SSH = DefaultListen
+	}
+
+	for _, addr := range []string{c.Listen.SSH, c.Listen.HTTP, c.Listen.Daemon, c.Listen.Metrics} {
+		if addr == "" {
+			continue
+		}
+
+		_, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("Bad listen address: %v", err)
+		}
+	}
+
+	if c.StateDir == "" {
+		c.StateDir = "."
+	}
+
+	if c.AuthorizedKeys == "" {
+		c.AuthorizedKeys = "authorized_keys"
+	}
+
+	if c.KnownHosts == "" {
+		c.KnownHosts = DefaultKnownHostsFile()
+	}
+
+	prefixes := map[string]bool{}
+
+	for _, rt := range c.Routes {
+		if prefixes[rt.Prefix] {
+			return fmt.Errorf("More than one route for prefix '%s'", rt.Prefix)
+		}
+
+		prefixes[rt.Prefix] = true
+
+		switch {
+		case rt.Host != "" && rt.URL != "":
+			return fmt.Errorf("Route for prefix '%s' has both a host and a url", rt.Prefix)
+		case rt.Host == "" && rt.URL == "":
+			return fmt.Errorf("Route for prefix '%s' needs a host or a url", rt.Prefix)
+		case rt.Port < 0 || rt.Port > 65535:
+			return fmt.Errorf("Route for prefix '%s' has bad port %d", rt.Prefix, rt.Port)
+		case rt.Credentials != "" && rt.URL == "":
+			return fmt.Errorf("Route for prefix '%s' has credentials without a url", rt.Prefix)
+		}
+
+		if rt.URL != "" {
+			u, err := url.Parse(rt.URL)
+			if err != nil {
+				return fmt.Errorf("Route for prefix '%s' has bad url: %v", rt.Prefix, err)
+			} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("Route for prefix '%s' needs an http or https url", rt.Prefix)
+			}
+		}
+	}
+
+	for _, r := range c.HideRefs {
+		if r.Pattern == "" {
+			return fmt.Errorf("Ref rule without a pattern")
+		}
+	}
+
+	if c.PushPolicy != nil {
+		for _, r := range c.PushPolicy.Branches {
+			if r.Pattern == "" {
+				return fmt.Errorf("Branch rule without a pattern")
+			}
+		}
+	}
+
+	for _, r := range c.SecretRules {
+		if r.Name == "" || r.Pattern == "" {
+			return fmt.Errorf("Secret rules need a name and a pattern")
+		}
+	}
+
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("Negative shutdown timeout")
+	} else if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = Duration(DefaultShutdownTimeout)
+	}
+
+	return nil
+}
+
+// resolve makes the paths in c that are relative relative to dir.
+func (c *Config) resolve(dir string) {
+	abs := func(p *string) {
+		if *p != "" && !filepath.IsAbs(*p) {
+			*p = filepath.Join(dir, *p)
+		}
+	}
+
+	abs(&c.StateDir)
+	abs(&c.AuthorizedKeys)
+	abs(&c.KnownHosts)
+	abs(&c.HTTPUsers)
+	abs(&c.MirrorDir)
+	abs(&c.RecordDir)
+	abs(&c.AuditLog)
+
+	for i := range c.Routes {
+		abs(&c.Routes[i].KeyFile)
+		abs(&c.Routes[i].Credentials)
+	}
+}
+
+// Settings loads what c refers to, such as host keys and credentials, into
+// the Settings a Server runs with.
+func (c *Config) Settings() (Settings, error) {
+	return c.Reload(Settings{})
+}
+
+// Reload is Settings for a Server already running with old. Parts of old
+// that c leaves as they were are kept instead of made anew: the push
+// policy, the open audit log and the mirrors, with any refreshes they are
+// running. What the push policy has learnt about commits is kept even if its
+// rules change.
+func (c *Config) Reload(old Settings) (Settings, error) {
+	authorizedKeys, err := LoadAuthorizedKeys(c.AuthorizedKeys)
+	if err != nil {
+		return Settings{}, fmt.Errorf("Failed to load authorized keys: %v", err)
+	}
+
+	hostKeys, err := LoadHostKeys(c.StateDir)
+	if err != nil {
+		return Settings{}, fmt.Errorf("Failed to load host keys: %v", err)
+	}
+
+	knownHosts, err := LoadKnownHosts(c.KnownHosts)
+	if err != nil {
+		return Settings{}, err
+	}
+
+	knownHosts.TrustOnFirstUse = c.TrustOnFirstUse
+
+	routes := DefaultRoutes
+	if len(c.Routes) > 0 {
+		routes = nil
+
+		for _, rc := range c.Routes {
+			rt := Route{
+				Prefix:      rc.Prefix,
+				StripPrefix: rc.StripPrefix,
+				Host:        rc.Host,
+				Port:        rc.Port,
+				User:        rc.User,
+				KeyFile:     rc.KeyFile,
+				URL:         rc.URL,
+			}
+
+			if rc.Credentials != "" {
+				rt.Credentials, err = LoadCredentials(rc.Credentials)
+				if err != nil {
+					return Settings{}, err
+				}
+			}
+
+			routes = append(routes, rt)
+		}
+	}
+
+	st := Settings{
+		SSH:    NewSSHServerConfig(authorizedKeys, hostKeys),
+		Router: routes.WithHostKeyCallback(knownHosts.HostKeyCallback),
+	}
+
+	filters := Chain{LogFilter}
+
+	if len(c.HideRefs) > 0 {
+		filters = append(filters, &RefFilter{Rules: c.HideRefs})
+	}
+
+	if c.PushPolicy != nil {
+		kept := old.pushPolicy()
+		policy := kept
+
+		if kept == nil || !reflect.DeepEqual(kept.Branches, c.PushPolicy.Branches) || !reflect.DeepEqual(kept.TagCreators, c.PushPolicy.TagCreators) {
+			policy = NewPushPolicy()
+			policy.Branches = c.PushPolicy.Branches
+			policy.TagCreators = c.PushPolicy.TagCreators
+
+			if kept != nil {
+				policy.Commits = kept.Commits
+			}
+		}
+
+		filters = append(filters, policy)
+	}
+
+	if c.ScanSecrets {
+		rules := c.SecretRules
+		if len(rules) == 0 {
+			rules = DefaultSecretRules
+		}
+
+		scanner, err := NewSecretScanner(rules)
+		if err != nil {
+			return Settings{}, err
+		}
+
+		filters = append(filters, scanner)
+	}
+
+	st.Filter = filters
+
+	if c.HTTPUsers != "" {
+		st.HTTPUsers, err = LoadHTTPUsers(c.HTTPUsers)
+		if err != nil {
+			return Settings{}, err
+		}
+	}
+
+	if c.RecordDir != "" {
+		st.Recorder = &Recorder{Dir: c.RecordDir}
+	}
+
+	if c.AuditLog != "" {
+		st.Audit = old.Audit
+		if st.Audit == nil || st.Audit.Path != c.AuditLog {
+			st.Audit = NewAuditLog(c.AuditLog)
+		}
+	}
+
+	// Last, as the mirrors kept are changed in place
+	if c.MirrorDir != "" {
+		m, ok := old.Router.(*Mirrors)
+		if ok && m.Dir == c.MirrorDir {
+			m.setRouter(st.Router)
+		} else {
+			m = NewMirrors(c.MirrorDir, st.Router)
+		}
+
+		st.Router = m
+	}
+
+	return st, nil
+}
+
+// pushPolicy returns the PushPolicy among the filters of st, if there is
+// one.
+func (st Settings) pushPolicy() *PushPolicy {
+	chain, _ := st.Filter.(Chain)
+
+	for _, f := range chain {
+		if pp, ok := f.(*PushPolicy); ok {
+			return pp
+		}
+	}
+
+	return nil
+}
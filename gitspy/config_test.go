@@ -0,0 +1,180 @@
+package gitspy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	c, err := ParseConfig([]byte(`{
+		"listen": {"http": "127.0.0.1:8080"},
+		"routes": [
+			{"host": "github.com"},
+			{"prefix": "gitlab/", "strip_prefix": true, "url": "https://gitlab.internal"}
+		],
+		"hide_refs": [{"pattern": "refs/pull/*"}],
+		"push_policy": {"branches": [{"pattern": "refs/heads/master", "deny_delete": true}]},
+		"shutdown_timeout": "1m"
+	}`))
+	if err != nil {
+		t.Fatalf("Error from parse: %v", err)
+	}
+
+	if c.Listen.SSH != DefaultListen || c.Listen.HTTP != "127.0.0.1:8080" || c.AuthorizedKeys != "authorized_keys" {
+		t.Errorf("Bad defaults: %#v", c)
+	}
+
+	if len(c.Routes) != 2 || !c.Routes[1].StripPrefix || c.PushPolicy.Branches[0].Pattern != "refs/heads/master" || !c.PushPolicy.Branches[0].DenyDelete {
+		t.Errorf("Bad parse: %#v", c)
+	}
+
+	if time.Duration(c.ShutdownTimeout) != time.Minute {
+		t.Errorf("Bad shutdown timeout: %v", c.ShutdownTimeout)
+	}
+}
+
+func TestParseConfigInvalid(t *testing.T) {
+	for b, want := range map[string]string{
+		`{"listen": {"ssh": "2022"}}`:                                         "listen address",
+		`{"routes": [{"host": "a", "url": "https://b"}]}`:                     "both a host and a url",
+		`{"routes": [{"host": "a"}, {"host": "b"}]}`:                          "More than one route",
+		`{"routes": [{"url": "ssh://b"}]}`:                                    "http or https url",
+		`{"routes": [{"host": "a", "credentials": "c"}]}`:                     "credentials without a url",
+		`{"hide_refs": [{"rename": "x"}]}`:                                    "without a pattern",
+		`{"shutdown_timeout": 30}`:                                            "such as",
+		`{"hide_ref": [{"pattern": "refs/pull/*"}]}`:                          "unknown field",
+		`{"secret_rules": [{"pattern": "x"}]}`:                                "name and a pattern",
+		`{"push_policy": {"branches": [{"deny_delete": true}]}}`:              "without a pattern",
+		`{"routes": [{"prefix": "gitlab/", "url": "https://b", "port": -1}]}`: "bad port",
+	} {
+		_, err := ParseConfig([]byte(b))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Parse of %s should fail with '%s': %v", b, want, err)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "git-spy.json")
+
+	err = ioutil.WriteFile(path, []byte(`{"state_dir": "state", "known_hosts": "/nonexistent/known_hosts", "scan_secrets": true}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Error from load: %v", err)
+	}
+
+	if c.StateDir != filepath.Join(dir, "state") || c.AuthorizedKeys != filepath.Join(dir, "authorized_keys") || c.KnownHosts != "/nonexistent/known_hosts" {
+		t.Errorf("Paths not resolved against the config: %#v", c)
+	}
+
+	_, err = c.Settings()
+	if err == nil {
+		t.Errorf("Settings should fail without authorized keys")
+	}
+
+	err = ioutil.WriteFile(c.AuthorizedKeys, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Mkdir(c.StateDir, 0700)
+
+	st, err := c.Settings()
+	if err != nil {
+		t.Fatalf("Error from Settings: %v", err)
+	}
+
+	if _, ok := st.Router.(RouteTable); !ok || st.SSH == nil || st.Recorder != nil || st.Audit != nil {
+		t.Errorf("Bad settings: %#v", st)
+	}
+
+	if chain, ok := st.Filter.(Chain); !ok || len(chain) != 2 {
+		t.Errorf("Expected the log filter and a secret scanner: %#v", st.Filter)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "authorized_keys"), nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	load := func(b string) *Config {
+		path := filepath.Join(dir, "git-spy.json")
+
+		err := ioutil.WriteFile(path, []byte(b), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := LoadConfig(path)
+		if err != nil {
+			t.Fatalf("Error from load: %v", err)
+		}
+
+		c.KnownHosts = filepath.Join(dir, "known_hosts")
+
+		return c
+	}
+
+	c := load(`{"mirror_dir": "mirrors", "audit_log": "audit.log", "push_policy": {"tag_creators": ["admin"]}}`)
+
+	st, err := c.Settings()
+	if err != nil {
+		t.Fatalf("Error from Settings: %v", err)
+	}
+
+	// Changing only the hidden refs keeps everything else
+	c = load(`{"mirror_dir": "mirrors", "audit_log": "audit.log", "push_policy": {"tag_creators": ["admin"]}, "hide_refs": [{"pattern": "refs/pull/*"}]}`)
+
+	next, err := c.Reload(st)
+	if err != nil {
+		t.Fatalf("Error from Reload: %v", err)
+	}
+
+	if next.Router != st.Router || next.Audit != st.Audit || next.pushPolicy() != st.pushPolicy() {
+		t.Errorf("Unchanged parts not kept: %#v", next)
+	}
+
+	if chain := next.Filter.(Chain); len(chain) != 3 {
+		t.Errorf("Hidden refs not added: %#v", chain)
+	}
+
+	// Changed ones are made anew, keeping the commits learnt
+	c = load(`{"mirror_dir": "other", "audit_log": "other.log", "push_policy": {"tag_creators": ["bob"]}}`)
+
+	last, err := c.Reload(next)
+	if err != nil {
+		t.Fatalf("Error from Reload: %v", err)
+	}
+
+	if last.Router == next.Router || last.Audit == next.Audit || last.pushPolicy() == next.pushPolicy() {
+		t.Errorf("Changed parts kept: %#v", last)
+	}
+
+	if last.pushPolicy().Commits != st.pushPolicy().Commits {
+		t.Errorf("Commits learnt not kept")
+	}
+}
@@ -0,0 +1,149 @@
+package gitspy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// daemonRequestTimeout is how long a client of git's daemon protocol has to
+// send its request once connected.
+const daemonRequestTimeout = 30 * time.Second
+
+// ParseDaemonRequest parses the pkt-line a client of git's daemon protocol
+// starts with, such as "git-upload-pack /repo.git\0host=example.com\0".
+// Extra parameters following the host, such as "version=2", become the
+// Protocol of the request.
+// https://www.kernel.org/pub/software/scm/git/docs/technical/pack-protocol.html#_git_transport
+func ParseDaemonRequest(b []byte) (*Request, error) {
+	parts := strings.Split(strings.TrimSuffix(string(b), "\n"), "\x00")
+
+	i := strings.IndexByte(parts[0], ' ')
+	if i < 0 || !isService(parts[0][:i]) {
+		return nil, ErrUnknownService
+	}
+
+	r := &Request{Service: parts[0][:i], Repo: parts[0][i+1:]}
+	if r.Repo == "" {
+		return nil, fmt.Errorf("Missing repository in '%s'", parts[0])
+	}
+
+	parts = parts[1:]
+	if len(parts) > 0 && strings.HasPrefix(parts[0], "host=") {
+		parts = parts[1:]
+	}
+
+	// Extra parameters follow an empty one
+	if len(parts) > 0 && parts[0] == "" {
+		var extra []string
+		for _, p := range parts[1:] {
+			if p != "" {
+				extra = append(extra, p)
+			}
+		}
+
+		r.Protocol = strings.Join(extra, ":")
+	}
+
+	return r, nil
+}
+
+// daemonError refuses a request the way git daemon does, which clients
+// report as a remote error.
+func daemonError(w io.Writer, msg string) {
+	WritePktLine(w, []byte("ERR "+msg))
+}
+
+// HandleDaemonConnection serves a connection speaking git's daemon
+// protocol, as git:// URLs do. Clients are not authenticated, so only
+// fetches and archives are allowed, and sessions have no User.
+func (s *Server) HandleDaemonConnection(c net.Conn) {
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(daemonRequestTimeout))
+
+	b := make([]byte, 65516)
+	n, err := ParsePktLine(c, b)
+	if err != nil {
+		log.Printf("Failed to read request from %v: %v", c.RemoteAddr(), err)
+		return
+	}
+
+	c.SetReadDeadline(time.Time{})
+
+	gr, err := ParseDaemonRequest(b[:n])
+	if err != nil {
+		log.Printf("Unknown request '%s' from %v, failing: %v", b[:n], c.RemoteAddr(), err)
+		daemonError(c, "unknown request")
+		return
+	}
+
+	if gr.Service == ReceivePack {
+		log.Printf("Refusing %s from %v over git://", gr, c.RemoteAddr())
+		daemonError(c, "pushing is not allowed over git://")
+		return
+	}
+
+	gr.ID = newSessionID()
+	gr.RemoteAddr = c.RemoteAddr().String()
+
+	log.Printf("%v requested %s over git:// as session %s", c.RemoteAddr(), gr, gr.ID)
+
+	st := s.settings()
+
+	upstream, err := st.Router.Route(gr)
+	if err != nil {
+		log.Printf("Failed to route '%s': %v", gr.Repo, err)
+		daemonError(c, "no such repository: "+gr.Repo)
+		return
+	}
+
+	s.session(s.ctx, st, &daemonClient{Conn: c}, gr, upstream)
+}
+
+// A daemonClient is a clientConn over a connection of git's daemon
+// protocol, which has no stderr or exit status. A fatal error before
+// anything else was sent is sent as an ERR packet, which clients show the
+// user; anything else for stderr is dropped.
+type daemonClient struct {
+	net.Conn
+
+	wrote bool
+	lock  sync.Mutex
+}
+
+func (c *daemonClient) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.wrote = true
+
+	return c.Conn.Write(b)
+}
+
+func (c *daemonClient) Stderr() io.Writer  { return daemonStderr{c} }
+func (c *daemonClient) Exit(status uint32) {}
+
+type daemonStderr struct {
+	c *daemonClient
+}
+
+func (e daemonStderr) Write(b []byte) (int, error) {
+	e.c.lock.Lock()
+	defer e.c.lock.Unlock()
+
+	msg := strings.TrimSpace(string(b))
+	if e.c.wrote || !strings.HasPrefix(msg, "fatal: ") {
+		return ioutil.Discard.Write(b)
+	}
+
+	e.c.wrote = true
+	daemonError(e.c.Conn, strings.TrimPrefix(msg, "fatal: "))
+
+	return len(b), nil
+}
@@ -0,0 +1,75 @@
+package gitspy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestParseDaemonRequest(t *testing.T) {
+	for b, want := range map[string]Request{
+		"git-upload-pack /repo.git\x00host=example.com\x00":                            {Service: UploadPack, Repo: "/repo.git"},
+		"git-upload-pack /repo.git\x00host=example.com:9418\x00\x00version=2\x00":      {Service: UploadPack, Repo: "/repo.git", Protocol: "version=2"},
+		"git-upload-archive /~bob/repo.git\x00\x00version=1\x00object-format=sha1\x00": {Service: UploadArchive, Repo: "/~bob/repo.git", Protocol: "version=1:object-format=sha1"},
+		"git-receive-pack /repo.git\n":                                                 {Service: ReceivePack, Repo: "/repo.git"},
+	} {
+		r, err := ParseDaemonRequest([]byte(b))
+		if err != nil {
+			t.Errorf("Error from parse of %q: %v", b, err)
+		} else if *r != want {
+			t.Errorf("Bad parse of %q: %#v", b, r)
+		}
+	}
+
+	for _, b := range []string{"git-upload-pack\x00", "rm -rf /\x00", "git-upload-pack \x00"} {
+		_, err := ParseDaemonRequest([]byte(b))
+		if err == nil {
+			t.Errorf("Parse of %q should fail", b)
+		}
+	}
+}
+
+func testDaemon(s *Server, request string, client []byte) []byte {
+	c, sc := net.Pipe()
+	go s.HandleDaemonConnection(sc)
+
+	go func() {
+		WritePktLine(c, []byte(request))
+		c.Write(client)
+	}()
+
+	out, _ := ioutil.ReadAll(c)
+	c.Close()
+
+	return out
+}
+
+func TestHandleDaemonConnection(t *testing.T) {
+	s := NewServer(nil, NewReplayUpstream(testRecording(t)))
+
+	client := &bytes.Buffer{}
+	WritePktLine(client, []byte("want "+oldID+"\n"))
+	WritePktLineFlush(client)
+	WritePktLine(client, []byte("done\n"))
+
+	out := testDaemon(s, "git-upload-pack /test.git\x00host=localhost\x00", client.Bytes())
+
+	if !bytes.Contains(out, []byte("refs/heads/master")) || !bytes.HasSuffix(out, []byte("0008NAK\nPACK")) {
+		t.Errorf("Bad response: %q", out)
+	}
+}
+
+func TestHandleDaemonConnectionRefused(t *testing.T) {
+	s := NewServer(nil, NewReplayUpstream())
+
+	out := testDaemon(s, "git-receive-pack /test.git\x00", nil)
+	if string(out) != "002aERR pushing is not allowed over git://" {
+		t.Errorf("Bad response to push: %q", out)
+	}
+
+	out = testDaemon(s, "git-upload-pack /test.git\x00", nil)
+	if !bytes.Contains(out, []byte("ERR Failed to start git-upload-pack")) {
+		t.Errorf("Bad response to failed session: %q", out)
+	}
+}
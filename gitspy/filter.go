@@ -0,0 +1,241 @@
+package gitspy
+
+import (
+	"bytes"
+	"log"
+	"sync"
+)
+
+// Direction a packet is travelling through the proxy
+type Direction int
+
+const (
+	ClientToServer Direction = iota
+	ServerToClient
+)
+
+func (d Direction) String() string {
+	if d == ServerToClient {
+		return "S"
+	}
+
+	return "C"
+}
+
+// Phase is the part of the protocol a packet belongs to.
+type Phase string
+
+const (
+	// The server's ref or capability advertisement
+	PhaseAdvertisement Phase = "advertisement"
+
+	// want/have lines and ACK/NAK replies of a v0 fetch
+	PhaseNegotiation Phase = "negotiation"
+
+	// A v2 command request or the command list of a push
+	PhaseCommand Phase = "command"
+
+	// Push options following the command list of a push
+	PhasePushOptions Phase = "push-options"
+
+	// The arguments of an archive request
+	PhaseArguments Phase = "arguments"
+
+	// A v2 command response, push report-status or archive status
+	PhaseResponse Phase = "response"
+
+	// Side-band multiplexed pack, archive, progress and error data
+	PhaseSideband Phase = "sideband"
+
+	// A pack sent outside of pkt-lines. Filters see its objects through
+	// PackFilter, never as packets.
+	PhasePack Phase = "pack"
+)
+
+// A Packet is a single pkt-line. Data is only set for a DataPkt.
+type Packet struct {
+	Type PktType
+	Data []byte
+}
+
+func DataPacket(b []byte) Packet {
+	return Packet{Type: DataPkt, Data: b}
+}
+
+// A FilterContext tells a filter about the packet it is looking at.
+type FilterContext struct {
+	*Request
+
+	Direction Direction
+	Phase     Phase
+
+	// Command is the v2 command the packet is part of, if any
+	Command string
+
+	// Updates are the ref updates a push asked for, as the client sent them,
+	// and PushCapabilities what it asked for with them. They are set from
+	// the flush ending the command list on, so filters need not parse the
+	// commands themselves.
+	Updates          []RefUpdate
+	PushCapabilities Capabilities
+
+	// Upstream is what the session runs against, for filters that need to
+	// ask it about the repository. It is nil if not known.
+	Upstream Upstream
+
+	// State is shared by every packet of the session, in both directions,
+	// for filters to keep what they learn. Keys should be unique to a filter.
+	// Values that are io.Closers are closed when the session ends.
+	State *sync.Map
+}
+
+// A Filter sees every pkt-line passing through the proxy. It returns the
+// packets to send on in its place: the packet itself to pass it, a changed
+// packet to rewrite it, nothing to drop it, or more packets to inject them.
+// Returning an error aborts the session and reports the error to the client.
+type Filter interface {
+	Filter(ctx *FilterContext, p Packet) ([]Packet, error)
+}
+
+// A PackFilter is a Filter that also inspects the objects of packs passing
+// through the proxy, whether sent raw or over side-band. Returning an error
+// aborts the session before the rest of the pack is passed on. PackEnd is
+// called once the whole pack is seen. A pack the client pushes is held back
+// until PackEnd returns, so none of a rejected push reaches the upstream.
+type PackFilter interface {
+	Filter
+	PackObject(ctx *FilterContext, o *PackObject) error
+	PackEnd(ctx *FilterContext) error
+}
+
+// A PackDataFilter is a PackFilter that also reads the contents of objects
+// too large for PackObject to be given them, a piece at a time as they are
+// inflated. The object's ID is not known until PackObject is called with it.
+type PackDataFilter interface {
+	PackFilter
+	PackData(ctx *FilterContext, o *PackObject, b []byte) error
+}
+
+// An AdvertisementFilter is a Filter that also works on the server's
+// advertisement as a whole, before its packets are filtered one by one. It
+// may change the advertisement in place.
+type AdvertisementFilter interface {
+	Filter
+	FilterAdvertisement(ctx *FilterContext, a *Advertisement) error
+}
+
+type FilterFunc func(ctx *FilterContext, p Packet) ([]Packet, error)
+
+func (f FilterFunc) Filter(ctx *FilterContext, p Packet) ([]Packet, error) {
+	return f(ctx, p)
+}
+
+// A Chain runs filters in order, each one seeing the output of the last.
+type Chain []Filter
+
+func (c Chain) Filter(ctx *FilterContext, p Packet) ([]Packet, error) {
+	pkts := []Packet{p}
+
+	for _, f := range c {
+		var next []Packet
+
+		for _, p := range pkts {
+			out, err := f.Filter(ctx, p)
+			if err != nil {
+				return nil, err
+			}
+
+			next = append(next, out...)
+		}
+
+		pkts = next
+	}
+
+	return pkts, nil
+}
+
+// PackObject passes o to each filter in the chain that inspects packs.
+func (c Chain) PackObject(ctx *FilterContext, o *PackObject) error {
+	for _, f := range c {
+		if pf, ok := f.(PackFilter); ok {
+			err := pf.PackObject(ctx, o)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// PackData passes a piece of a large object to each filter in the chain that
+// reads them.
+func (c Chain) PackData(ctx *FilterContext, o *PackObject, b []byte) error {
+	for _, f := range c {
+		if pf, ok := f.(PackDataFilter); ok {
+			err := pf.PackData(ctx, o, b)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// PackEnd tells each filter in the chain that inspects packs that a pack is
+// complete.
+func (c Chain) PackEnd(ctx *FilterContext) error {
+	for _, f := range c {
+		if pf, ok := f.(PackFilter); ok {
+			err := pf.PackEnd(ctx)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// FilterAdvertisement passes a to each filter in the chain that works on
+// advertisements.
+func (c Chain) FilterAdvertisement(ctx *FilterContext, a *Advertisement) error {
+	for _, f := range c {
+		if af, ok := f.(AdvertisementFilter); ok {
+			err := af.FilterAdvertisement(ctx, a)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// LogFilter logs every packet and passes it on unchanged.
+var LogFilter Filter = FilterFunc(logPacket)
+
+func logPacket(ctx *FilterContext, p Packet) ([]Packet, error) {
+	prefix := ctx.Direction.String()
+	if ctx.Command != "" {
+		prefix += ": " + ctx.Command
+	}
+
+	switch {
+	case p.Type != DataPkt:
+		log.Printf("%s: %v", prefix, p.Type)
+	case ctx.Phase == PhaseSideband:
+		band, data, _ := ParseSideband(p.Data)
+		if band == BandProgress {
+			log.Printf("%s: remote: %s", prefix, bytes.TrimRight(data, "\r\n"))
+		} else if band == BandError {
+			log.Printf("%s: error: %s", prefix, bytes.TrimRight(data, "\r\n"))
+		}
+	default:
+		line := bytes.Replace(bytes.TrimSuffix(p.Data, []byte("\n")), []byte{0}, []byte(" "), -1)
+		log.Printf("%s: %s", prefix, line)
+	}
+
+	return []Packet{p}, nil
+}
@@ -0,0 +1,128 @@
+package gitspy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func testGitSpy(service string, filter Filter) *GitSpy {
+	req := &Request{Service: service, Repo: "/test.git"}
+	return NewGitSpy(req, nopWriteCloser{ioutil.Discard}, nopWriteCloser{ioutil.Discard}, filter)
+}
+
+func TestChain(t *testing.T) {
+	rewrite := FilterFunc(func(ctx *FilterContext, p Packet) ([]Packet, error) {
+		if bytes.Equal(p.Data, []byte("drop\n")) {
+			return nil, nil
+		}
+
+		if bytes.Equal(p.Data, []byte("inject\n")) {
+			return []Packet{p, DataPacket([]byte("injected\n"))}, nil
+		}
+
+		return []Packet{p}, nil
+	})
+
+	upper := FilterFunc(func(ctx *FilterContext, p Packet) ([]Packet, error) {
+		return []Packet{DataPacket(bytes.ToUpper(p.Data))}, nil
+	})
+
+	src := &bytes.Buffer{}
+	WritePktLine(src, []byte("drop\n"))
+	WritePktLine(src, []byte("inject\n"))
+	WritePktLine(src, []byte("pass\n"))
+
+	expected := &bytes.Buffer{}
+	WritePktLine(expected, []byte("INJECT\n"))
+	WritePktLine(expected, []byte("INJECTED\n"))
+	WritePktLine(expected, []byte("PASS\n"))
+
+	gs := testGitSpy(UploadPack, Chain{rewrite, upper})
+
+	dst := &bytes.Buffer{}
+	err := gs.proxyPkts(dst, src, ClientToServer, PhaseNegotiation, true)
+	if err != nil {
+		t.Fatalf("Error from proxy: %v", err)
+	}
+
+	if !bytes.Equal(dst.Bytes(), expected.Bytes()) {
+		t.Errorf("Wrong output: %q", dst.Bytes())
+	}
+}
+
+func TestFilterAbort(t *testing.T) {
+	denied := errors.New("denied")
+
+	deny := FilterFunc(func(ctx *FilterContext, p Packet) ([]Packet, error) {
+		if ctx.Phase == PhaseCommand {
+			return nil, denied
+		}
+
+		return []Packet{p}, nil
+	})
+
+	src := &bytes.Buffer{}
+	WritePktLine(src, []byte(oldID+" "+newID+" refs/heads/master\x00report-status\n"))
+	WritePktLineFlush(src)
+
+	gs := testGitSpy(ReceivePack, deny)
+
+	dst := &bytes.Buffer{}
+	err := gs.proxyReceivePackRequest(dst, src)
+	if err != denied {
+		t.Errorf("Should be denied: %v", err)
+	}
+
+	select {
+	case <-gs.Aborted():
+	default:
+		t.Errorf("Should be aborted")
+	}
+
+	if gs.Err() != denied {
+		t.Errorf("Wrong error: %v", gs.Err())
+	}
+
+	if dst.Len() != 0 {
+		t.Errorf("Should not have written: %q", dst.Bytes())
+	}
+}
+
+func TestFilterContextV2(t *testing.T) {
+	var phases []Phase
+
+	record := FilterFunc(func(ctx *FilterContext, p Packet) ([]Packet, error) {
+		if ctx.Command != CommandFetch {
+			t.Errorf("Wrong command: %q", ctx.Command)
+		}
+
+		phases = append(phases, ctx.Phase)
+		return []Packet{p}, nil
+	})
+
+	src := &bytes.Buffer{}
+	WritePktLine(src, []byte("packfile\n"))
+	WritePktLine(src, []byte("\x01PACK"))
+	WritePktLineFlush(src)
+
+	gs := testGitSpy(UploadPack, record)
+	gs.pushCommand(&V2Command{Name: CommandFetch})
+
+	err := gs.proxyV2Responses(&bytes.Buffer{}, src)
+	if err != nil {
+		t.Fatalf("Error from proxy: %v", err)
+	}
+
+	if len(phases) != 3 || phases[0] != PhaseResponse || phases[1] != PhaseSideband || phases[2] != PhaseSideband {
+		t.Errorf("Wrong phases: %v", phases)
+	}
+}
@@ -1,47 +1,351 @@
 package gitspy
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net"
-	"os"
-	"strings"
+	"strconv"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/agent"
 )
 
-func sshAgentAuth() ssh.AuthMethod {
-	sshAgent, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+// A Server accepts ssh connections, smart HTTP requests through ServeHTTP
+// and git:// connections through HandleDaemonConnection from git clients,
+// and proxies their commands to the upstream chosen by Router, passing
+// every pkt-line through Filter. Once serving, Router, Filter, Recorder,
+// Audit and HTTPUsers are only to be changed through Reconfigure.
+type Server struct {
+	Router Router
+	Filter Filter
+
+	// Recorder, if set, records a transcript of every session
+	Recorder *Recorder
+
+	// Audit, if set, gets a record of every operation
+	Audit *AuditLog
+
+	// HTTPUsers, if set, authenticates smart HTTP clients. Without it they
+	// are anonymous and may only fetch.
+	HTTPUsers *HTTPUsers
+
+	config *ssh.ServerConfig
+	lock   sync.RWMutex
+
+	// ctx is cancelled to abandon the sessions still running when Shutdown
+	// gives up waiting for them
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// listeners are those being served, active the sessions running. idle
+	// is closed once none are left after Shutdown.
+	listeners map[net.Listener]bool
+	active    int
+	idle      chan struct{}
+	closing   bool
+	state     sync.Mutex
+}
+
+// ErrServerClosed is returned by Serve and ServeDaemon after Shutdown.
+var ErrServerClosed = errors.New("server closed")
+
+func NewServer(config *ssh.ServerConfig, router Router) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Server{
+		config:    config,
+		Router:    router,
+		Filter:    LogFilter,
+		ctx:       ctx,
+		cancel:    cancel,
+		listeners: map[net.Listener]bool{},
+	}
+}
+
+func (s *Server) Config() *ssh.ServerConfig {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.config
+}
+
+// SetConfig replaces the configuration used for new connections, such as
+// after host keys are rotated. Established connections are unaffected.
+func (s *Server) SetConfig(config *ssh.ServerConfig) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.config = config
+}
+
+// Settings are what a Server runs new connections and sessions with.
+type Settings struct {
+	SSH       *ssh.ServerConfig
+	Router    Router
+	Filter    Filter
+	Recorder  *Recorder
+	Audit     *AuditLog
+	HTTPUsers *HTTPUsers
+}
+
+func (s *Server) settings() Settings {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return Settings{s.config, s.Router, s.Filter, s.Recorder, s.Audit, s.HTTPUsers}
+}
+
+// Reconfigure replaces all the settings at once, so each new session sees
+// either the old ones or the new. Sessions already running keep what they
+// started with.
+func (s *Server) Reconfigure(st Settings) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.Audit != nil && s.Audit != st.Audit {
+		// Sessions still writing to it open it again
+		s.Audit.Close()
+	}
+
+	s.config = st.SSH
+	s.Router = st.Router
+	s.Filter = st.Filter
+	s.Recorder = st.Recorder
+	s.Audit = st.Audit
+	s.HTTPUsers = st.HTTPUsers
+}
+
+// Serve accepts ssh connections on l, handling each with HandleConnection,
+// until Shutdown.
+func (s *Server) Serve(l net.Listener) error {
+	return s.serve(l, s.HandleConnection)
+}
+
+// ServeDaemon accepts git:// connections on l, handling each with
+// HandleDaemonConnection, until Shutdown.
+func (s *Server) ServeDaemon(l net.Listener) error {
+	return s.serve(l, s.HandleDaemonConnection)
+}
+
+func (s *Server) serve(l net.Listener, handle func(net.Conn)) error {
+	s.state.Lock()
+	if s.closing {
+		s.state.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+
+	s.listeners[l] = true
+	s.state.Unlock()
+
+	defer func() {
+		s.state.Lock()
+		delete(s.listeners, l)
+		s.state.Unlock()
+	}()
+
+	var delay time.Duration
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			} else if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+
+			// Such as running out of file descriptors, which may pass
+			if delay = 2 * delay; delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay > time.Second {
+				delay = time.Second
+			}
+
+			log.Printf("Failed to accept connection, retrying in %v: %v", delay, err)
+			time.Sleep(delay)
+
+			continue
+		}
+
+		delay = 0
+
+		log.Printf("Accepted %v", c.RemoteAddr())
+		go handle(c)
+	}
+}
+
+func (s *Server) shuttingDown() bool {
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	return s.closing
+}
+
+// Shutdown stops the server accepting connections and starting sessions,
+// then waits for the sessions running to finish. If ctx is done first they
+// are abandoned, hanging up on their clients and upstreams, and the error
+// of ctx is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.state.Lock()
+
+	s.closing = true
+	for l := range s.listeners {
+		l.Close()
+	}
+
+	idle := make(chan struct{})
+	if s.active == 0 {
+		close(idle)
+	} else {
+		s.idle = idle
+	}
+
+	s.state.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		s.cancel()
+		return ctx.Err()
+	}
+}
+
+// startSession counts a session as running, unless the server is shutting
+// down.
+func (s *Server) startSession() bool {
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	if s.closing {
+		return false
+	}
+
+	s.active++
+
+	return true
+}
+
+func (s *Server) endSession() {
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	s.active--
+	if s.active == 0 && s.idle != nil {
+		close(s.idle)
+		s.idle = nil
+	}
+}
+
+// session runs gr against upstream for the client c with st, recording and
+// auditing it, until it ends or ctx is done. Every frontend ends up here
+// once it has routed a request.
+func (s *Server) session(ctx context.Context, st Settings, c clientConn, gr *Request, upstream Upstream) {
+	if !s.startSession() {
+		log.Printf("Refusing '%s' while shutting down", gr)
+		reportError(c, errors.New("Server is shutting down"))
+		c.Exit(128)
+		return
+	}
+
+	defer s.endSession()
+
+	metricSessions.Inc(gr.Service, sessionRepos.value(gr.Repo))
+
+	var t *Transcript
+	if st.Recorder != nil {
+		var err error
+
+		t, err = st.Recorder.Start(gr)
+		if err != nil {
+			log.Printf("Failed to record '%s': %v", gr, err)
+		}
+	}
+
+	a := newAuditRecord(gr)
+
+	err := proxyCommand(ctx, c, gr, upstream, st.Filter, t, a)
 	if err != nil {
-		log.Fatalf("Failed to open ssh agent")
+		log.Printf("Failed to proxy '%s': %v", gr, err)
+		a.Error = err.Error()
+	} else {
+		log.Printf("Wrote reply to client")
 	}
 
-	return ssh.PublicKeysCallback(agent.NewClient(sshAgent).Signers)
+	a.Duration = time.Since(a.Time).Seconds()
+	metricSessionDuration.Observe(a.Duration, gr.Service, strconv.Itoa(int(a.ExitStatus)))
+
+	if st.Audit != nil {
+		err = st.Audit.Write(a)
+		if err != nil {
+			log.Printf("Failed to audit '%s': %v", gr, err)
+		}
+	}
 }
 
-func handleChannel(c ssh.Channel, r <-chan *ssh.Request) {
+func (s *Server) handleChannel(c ssh.Channel, r <-chan *ssh.Request, perms *ssh.Permissions, remote net.Addr) {
+	user := permissionsUser(perms)
+
+	var protocol string
+
 	for req := range r {
 		log.Printf("Channel request: %s", req.Type)
 
-		if req.Type == "exec" {
+		if req.Type == "env" {
+			var env struct {
+				Name  string
+				Value string
+			}
+
+			err := ssh.Unmarshal(req.Payload, &env)
+			if err == nil && env.Name == "GIT_PROTOCOL" {
+				log.Printf("GIT_PROTOCOL=%s", env.Value)
+				protocol = env.Value
+				req.Reply(true, nil)
+			} else {
+				req.Reply(false, nil)
+			}
+		} else if req.Type == "exec" {
 			// Parse out our payload, stripping 3 null bytes and an ENQ
 			p := string(req.Payload[4:])
-			if strings.HasPrefix(p, "git-upload-pack") {
-				req.Reply(true, nil)
 
-				err := proxyUploadPack(c, p)
-				if err != nil {
-					log.Fatalf("Failed to write to channel: %v", err)
-				}
+			if forced := permissionsCommand(perms); forced != "" {
+				log.Printf("Replacing '%s' with forced command '%s' for %s", p, forced, user)
+				p = forced
+			}
 
-				log.Printf("Wrote reply to channel")
+			gr, err := ParseCommand(p)
+			if err != nil {
+				log.Printf("Unknown exec '%s' command, failing: %v", p, err)
+				req.Reply(false, nil)
+				continue
+			}
 
-				// Nothing allowed after exec?
-				break
-			} else {
-				log.Printf("Unknown exec '%s' command, failing", p)
+			gr.ID = newSessionID()
+			gr.Protocol = protocol
+			gr.User = user
+			gr.RemoteAddr = remote.String()
+
+			log.Printf("%s requested %s as session %s", user, gr, gr.ID)
+
+			st := s.settings()
+
+			upstream, err := st.Router.Route(gr)
+			if err != nil {
+				log.Printf("Failed to route '%s': %v", gr.Repo, err)
 				req.Reply(false, nil)
+				continue
 			}
+
+			req.Reply(true, nil)
+
+			s.session(s.ctx, st, sshClient{c}, gr, upstream)
+
+			// Nothing allowed after exec?
+			break
 		} else {
 			req.Reply(false, nil)
 		}
@@ -52,13 +356,18 @@ func handleChannel(c ssh.Channel, r <-chan *ssh.Request) {
 	c.Close()
 }
 
-func HandleConnection(c net.Conn, config *ssh.ServerConfig) {
-	conn, chans, reqs, err := ssh.NewServerConn(c, config)
+func (s *Server) HandleConnection(c net.Conn) {
+	metricConnections.Inc()
+
+	conn, chans, reqs, err := ssh.NewServerConn(c, s.Config())
 	if err != nil {
-		log.Fatal("failed to handshake: ", err)
+		metricHandshakeFailures.Inc()
+		log.Printf("Failed to handshake with %v: %v", c.RemoteAddr(), err)
+		c.Close()
+		return
 	}
 
-	log.Printf("logged in")
+	log.Printf("%s logged in from %v", permissionsUser(conn.Permissions), conn.RemoteAddr())
 
 	go ssh.DiscardRequests(reqs)
 
@@ -67,10 +376,11 @@ func HandleConnection(c net.Conn, config *ssh.ServerConfig) {
 
 		channel, requests, err := newChannel.Accept()
 		if err != nil {
-			log.Fatalf("Could not accept channel: %v", err)
+			log.Printf("Could not accept channel: %v", err)
+			continue
 		}
 
-		go handleChannel(channel, requests)
+		go s.handleChannel(channel, requests, conn.Permissions, conn.RemoteAddr())
 	}
 
 	conn.Close()
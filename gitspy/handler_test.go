@@ -0,0 +1,104 @@
+package gitspy
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testShutdownServer serves git:// for an empty repository, returning a
+// client connection with a session waiting for its wants.
+func testShutdownServer(t *testing.T) (*Server, net.Conn, chan error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "shutdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	testGit(t, "init", "-q", "--bare", filepath.Join(dir, "test.git"))
+
+	s := NewServer(nil, testRouter{&LocalUpstream{Dir: dir}})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- s.ServeDaemon(l) }()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { c.Close() })
+
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	WritePktLine(c, []byte("git-upload-pack /test.git\x00"))
+
+	_, err = readAdvertisement(c)
+	if err != nil {
+		t.Fatalf("Error reading advertisement: %v", err)
+	}
+
+	return s, c, served
+}
+
+func TestServerShutdown(t *testing.T) {
+	s, c, served := testShutdownServer(t)
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve returned %v, not ErrServerClosed", err)
+	}
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v with a session running", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// New sessions are refused meanwhile
+	out := testDaemon(s, "git-upload-pack /test.git\x00", nil)
+	if !bytes.Contains(out, []byte("ERR Server is shutting down")) {
+		t.Errorf("Bad response while shutting down: %q", out)
+	}
+
+	WritePktLineFlush(c)
+
+	if err := <-shutdown; err != nil {
+		t.Errorf("Error from Shutdown: %v", err)
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	s, c, _ := testShutdownServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := s.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Shutdown returned %v, not a timeout", err)
+	}
+
+	// The session is abandoned, hanging up on the client
+	_, err = ioutil.ReadAll(c)
+	if err != nil {
+		t.Errorf("Session was not hung up on: %v", err)
+	}
+}
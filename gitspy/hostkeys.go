@@ -0,0 +1,189 @@
+package gitspy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// Host key files generated in a state directory when missing
+var generatedHostKeys = map[string]func() ([]byte, error){
+	"ssh_host_ed25519_key": generateED25519Key,
+	"ssh_host_ecdsa_key":   generateECDSAKey,
+}
+
+// hostKeyPatterns are the files loaded as host keys from a state directory.
+// id_rsa is the key earlier versions read from the working directory.
+var hostKeyPatterns = []string{"ssh_host_*_key", "id_rsa"}
+
+func generateECDSAKey() ([]byte, error) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalECPrivateKey(k)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+func generateED25519Key() ([]byte, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	pubKey, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	return marshalOpenSSHED25519(pubKey, priv), nil
+}
+
+// marshalOpenSSHED25519 writes an unencrypted key in the openssh-key-v1
+// format, the only one ssh.ParsePrivateKey reads ed25519 keys from.
+// https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.key
+func marshalOpenSSHED25519(pub ssh.PublicKey, priv ed25519.PrivateKey) []byte {
+	check := make([]byte, 4)
+	rand.Read(check)
+
+	block := ssh.Marshal(struct {
+		Check1  uint32
+		Check2  uint32
+		Keytype string
+		Pub     []byte
+		Priv    []byte
+		Comment string
+	}{
+		binary.BigEndian.Uint32(check),
+		binary.BigEndian.Uint32(check),
+		ssh.KeyAlgoED25519,
+		[]byte(priv.Public().(ed25519.PublicKey)),
+		[]byte(priv),
+		"",
+	})
+
+	for i := 1; len(block)%8 != 0; i++ {
+		block = append(block, byte(i))
+	}
+
+	w := struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}{"none", "none", "", 1, pub.Marshal(), block}
+
+	b := append([]byte("openssh-key-v1\x00"), ssh.Marshal(w)...)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: b})
+}
+
+// GenerateHostKeys creates any missing ed25519 and ECDSA host keys in dir.
+func GenerateHostKeys(dir string) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return fmt.Errorf("Failed to create state directory: %v", err)
+	}
+
+	for name, generate := range generatedHostKeys {
+		p := filepath.Join(dir, name)
+
+		_, err := os.Stat(p)
+		if err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		b, err := generate()
+		if err != nil {
+			return fmt.Errorf("Failed to generate %s: %v", name, err)
+		}
+
+		err = ioutil.WriteFile(p, b, 0600)
+		if err != nil {
+			return fmt.Errorf("Failed to write %s: %v", name, err)
+		}
+
+		log.Printf("Generated host key %s", p)
+	}
+
+	return nil
+}
+
+// LoadHostKeys generates missing host keys in dir and loads every host key
+// found there.
+func LoadHostKeys(dir string) ([]ssh.Signer, error) {
+	err := GenerateHostKeys(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, pattern := range hostKeyPatterns {
+		m, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+
+		paths = append(paths, m...)
+	}
+
+	sort.Strings(paths)
+
+	var signers []ssh.Signer
+	for _, p := range paths {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load host key: %v", err)
+		}
+
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse host key %s: %v", p, err)
+		}
+
+		log.Printf("Loaded %s host key %s from %s", signer.PublicKey().Type(), ssh.FingerprintSHA256(signer.PublicKey()), p)
+		signers = append(signers, signer)
+	}
+
+	return signers, nil
+}
+
+// RotateHostKeys moves the generated host keys in dir aside and creates new
+// ones. A running Server picks them up through SetConfig; sessions that are
+// already established keep the keys they were negotiated with.
+func RotateHostKeys(dir string) error {
+	suffix := time.Now().Format(".20060102150405")
+
+	for name := range generatedHostKeys {
+		p := filepath.Join(dir, name)
+
+		err := os.Rename(p, p+suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Failed to retire %s: %v", name, err)
+		}
+	}
+
+	return GenerateHostKeys(dir)
+}
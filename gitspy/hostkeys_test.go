@@ -0,0 +1,58 @@
+package gitspy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLoadHostKeysGenerates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	keys, err := LoadHostKeys(dir)
+	if err != nil {
+		t.Fatalf("Failed to load: %v", err)
+	}
+
+	if len(keys) != 2 {
+		t.Fatalf("Expected two generated keys, got %d", len(keys))
+	}
+
+	types := map[string]bool{}
+	for _, k := range keys {
+		types[k.PublicKey().Type()] = true
+	}
+
+	if !types["ssh-ed25519"] || !types["ecdsa-sha2-nistp256"] {
+		t.Errorf("Wrong key types: %v", types)
+	}
+
+	again, err := LoadHostKeys(dir)
+	if err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+
+	if !bytes.Equal(again[0].PublicKey().Marshal(), keys[0].PublicKey().Marshal()) {
+		t.Errorf("Keys should persist between loads")
+	}
+
+	err = RotateHostKeys(dir)
+	if err != nil {
+		t.Fatalf("Failed to rotate: %v", err)
+	}
+
+	rotated, err := LoadHostKeys(dir)
+	if err != nil {
+		t.Fatalf("Failed to load rotated keys: %v", err)
+	}
+
+	if len(rotated) != 2 || bytes.Equal(rotated[0].PublicKey().Marshal(), keys[0].PublicKey().Marshal()) {
+		t.Errorf("Keys should have been replaced")
+	}
+}
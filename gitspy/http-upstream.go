@@ -0,0 +1,493 @@
+package gitspy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// HTTPUpstream runs git services on a smart HTTP server such as
+// https://github.com, finding repositories under URL. A session is carried
+// over the stateless requests of the protocol: the advertisement comes from
+// info/refs, then each v2 command, each round of a v0 fetch and a whole push
+// is a request of its own.
+// https://git-scm.com/docs/http-protocol
+type HTTPUpstream struct {
+	URL string
+
+	// Credentials, if set, authenticate requests to URL
+	Credentials *Credentials
+
+	// Client makes the requests, http.DefaultClient if nil
+	Client *http.Client
+}
+
+func (u *HTTPUpstream) client() *http.Client {
+	if u.Client == nil {
+		return http.DefaultClient
+	}
+
+	return u.Client
+}
+
+func (u *HTTPUpstream) location(r *Request) string {
+	pu, err := url.Parse(u.URL)
+	if err != nil || pu.Host == "" {
+		return ""
+	}
+
+	return pu.Host + strings.TrimSuffix(pu.Path, "/") + path.Clean("/"+r.Repo)
+}
+
+func (u *HTTPUpstream) Start(r *Request) (UpstreamSession, error) {
+	if r.Service != UploadPack && r.Service != ReceivePack {
+		return nil, fmt.Errorf("%s is not available over smart HTTP", r.Service)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &httpSession{
+		u:      u,
+		req:    r,
+		url:    strings.TrimSuffix(u.URL, "/") + "/" + strings.TrimPrefix(r.Repo, "/"),
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	adv, err := s.advertisement()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	stdin, stdinW := io.Pipe()
+	stdoutR, stdout := io.Pipe()
+	stderrR, stderr := io.Pipe()
+
+	s.stdin, s.stdout, s.stderr = stdinW, stdoutR, stderrR
+
+	go func() {
+		err := s.run(adv, stdin, stdout)
+		if err != nil {
+			s.err = err
+			fmt.Fprintf(stderr, "fatal: %v\n", err)
+		}
+
+		stdin.Close()
+		stdout.Close()
+		stderr.Close()
+		close(s.done)
+	}()
+
+	return s, nil
+}
+
+type httpSession struct {
+	u   *HTTPUpstream
+	req *Request
+	url string
+
+	// ctx is cancelled to abandon requests once the session is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	stdin  *io.PipeWriter
+	stdout *io.PipeReader
+	stderr *io.PipeReader
+
+	done chan struct{}
+	err  error
+}
+
+// do makes a request to the repository, checking the response is of the
+// kind expected: "advertisement" or "result".
+func (s *httpSession) do(method, path string, body io.Reader, kind string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(s.ctx, method, s.url+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	contentType := "application/x-" + s.req.Service + "-" + kind
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-"+s.req.Service+"-request")
+	}
+
+	req.Header.Set("Accept", contentType)
+
+	if s.req.Protocol != "" {
+		req.Header.Set("Git-Protocol", s.req.Protocol)
+	}
+
+	s.u.Credentials.Authorize(req)
+
+	resp, err := s.u.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s", method, req.URL.Redacted(), resp.Status)
+	}
+
+	if ct := resp.Header.Get("Content-Type"); ct != contentType {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: unexpected Content-Type '%s', not a smart HTTP server?", method, req.URL.Redacted(), ct)
+	}
+
+	return resp, nil
+}
+
+// advertisement fetches the upstream's advertisement, without the
+// "# service=" preamble smart HTTP puts in front of it.
+func (s *httpSession) advertisement() ([]byte, error) {
+	resp, err := s.do("GET", "/info/refs?service="+s.req.Service, nil, "advertisement")
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	adv, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read advertisement: %v", err)
+	}
+
+	r := bytes.NewReader(adv)
+	b := make([]byte, 65516)
+
+	t, n, err := ReadPkt(r, b)
+	if err != nil || t != DataPkt || !bytes.HasPrefix(b[:n], []byte("# service=")) {
+		return adv, nil
+	}
+
+	for t != FlushPkt {
+		t, _, err = ReadPkt(r, b)
+		if err != nil {
+			return nil, fmt.Errorf("Failed parsing advertisement: %v", err)
+		}
+	}
+
+	return adv[len(adv)-r.Len():], nil
+}
+
+func (s *httpSession) run(adv []byte, stdin io.Reader, stdout io.Writer) error {
+	_, err := stdout.Write(adv)
+	if err != nil {
+		return err
+	}
+
+	if s.req.Service == ReceivePack {
+		return s.push(stdin, stdout)
+	}
+
+	b := make([]byte, 65516)
+	t, n, err := ReadPkt(bytes.NewReader(adv), b)
+	if err == nil && t == DataPkt && string(b[:n]) == "version 2\n" {
+		return s.commands(stdin, stdout)
+	}
+
+	f := &httpFetch{s: s, stdout: stdout, common: map[string]bool{}}
+
+	return f.run(stdin)
+}
+
+// rpc makes a request of body, passing on the response.
+func (s *httpSession) rpc(body io.Reader, stdout io.Writer) error {
+	resp, err := s.do("POST", "/"+s.req.Service, body, "result")
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	_, err = io.Copy(stdout, resp.Body)
+
+	return err
+}
+
+// httpPostBuffer is how much of a push is buffered to send it with a
+// Content-Length, as git does, before it is streamed in chunks instead.
+const httpPostBuffer = 1 << 20
+
+// push sends everything the client sends as one request, unless it hangs
+// up without sending anything.
+func (s *httpSession) push(stdin io.Reader, stdout io.Writer) error {
+	b := make([]byte, httpPostBuffer)
+
+	n, err := io.ReadFull(stdin, b)
+	if err == io.EOF {
+		return nil
+	} else if err == io.ErrUnexpectedEOF {
+		return s.rpc(bytes.NewReader(b[:n]), stdout)
+	} else if err != nil {
+		return err
+	}
+
+	return s.rpc(io.MultiReader(bytes.NewReader(b), stdin), stdout)
+}
+
+// commands sends each v2 command request on its own, until the client
+// hangs up or sends a bare flush.
+func (s *httpSession) commands(stdin io.Reader, stdout io.Writer) error {
+	b := make([]byte, 65516)
+
+	for {
+		cmd := &bytes.Buffer{}
+
+		for {
+			p, err := readPacket(stdin, b)
+			if err == io.EOF && cmd.Len() == 0 {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("Failed parsing pkt: %v", err)
+			}
+
+			if p.Type == FlushPkt && cmd.Len() == 0 {
+				return nil
+			}
+
+			writePacket(cmd, p)
+
+			if p.Type == FlushPkt {
+				break
+			}
+		}
+
+		err := s.rpc(cmd, stdout)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *httpSession) Stdin() io.WriteCloser { return s.stdin }
+func (s *httpSession) Stdout() io.Reader     { return s.stdout }
+func (s *httpSession) Stderr() io.Reader     { return s.stderr }
+
+func (s *httpSession) Wait() error {
+	<-s.done
+	return s.err
+}
+
+func (s *httpSession) Close() error {
+	s.cancel()
+
+	s.stdout.Close()
+	s.stderr.Close()
+	s.stdin.Close()
+
+	return nil
+}
+
+// An httpFetch carries a v0 fetch, in which the client expects the
+// upstream to remember the negotiation so far, over stateless requests.
+// Like git's own stateless requests, each repeats the wants and the haves
+// the upstream found in common. Acknowledgments the client has already had
+// are left out of the responses, as is the shallow list after the first.
+type httpFetch struct {
+	s      *httpSession
+	stdout io.Writer
+
+	// state starts every request: the wants and the common haves
+	state bytes.Buffer
+
+	common map[string]bool
+
+	// shallow is set if responses start with a shallow list, listed once
+	// it has been passed on
+	shallow bool
+	listed  bool
+}
+
+func (f *httpFetch) run(stdin io.Reader) error {
+	b := make([]byte, 65516)
+	wants := 0
+
+	for {
+		p, err := readPacket(stdin, b)
+		if err == io.EOF && f.state.Len() == 0 {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Failed parsing pkt: %v", err)
+		}
+
+		writePacket(&f.state, p)
+
+		if p.Type == FlushPkt {
+			break
+		}
+
+		wants++
+
+		if bytes.HasPrefix(p.Data, []byte("shallow ")) || bytes.HasPrefix(p.Data, []byte("deepen")) {
+			f.shallow = true
+		}
+	}
+
+	if wants == 0 {
+		// The client only wanted the advertisement
+		return nil
+	}
+
+	if f.shallow {
+		// The client waits for the shallow list before sending haves, so
+		// ask for it with an empty round
+		err := f.request(specialPkts[FlushPkt], true)
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		round := &bytes.Buffer{}
+		done := false
+
+		for {
+			p, err := readPacket(stdin, b)
+			if err == io.EOF && round.Len() == 0 {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("Failed parsing pkt: %v", err)
+			}
+
+			writePacket(round, p)
+
+			done = p.Type == DataPkt && bytes.Equal(p.Data, []byte("done\n"))
+			if done || p.Type == FlushPkt {
+				break
+			}
+		}
+
+		err := f.request(round.Bytes(), false)
+		if err != nil {
+			return err
+		}
+
+		if done {
+			return nil
+		}
+	}
+}
+
+// request sends the state followed by a round of haves, passing on the
+// response.
+func (f *httpFetch) request(round []byte, shallowOnly bool) error {
+	body := append(append([]byte(nil), f.state.Bytes()...), round...)
+
+	resp, err := f.s.do("POST", "/"+UploadPack, bytes.NewReader(body), "result")
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	return f.relay(resp.Body, shallowOnly)
+}
+
+// acknowledged notes an ACK line, adding what it acknowledges to the state.
+// It reports whether the client has already had it.
+func (f *httpFetch) acknowledged(line []byte) bool {
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "ACK" {
+		return false
+	}
+
+	id := fields[1]
+	if !f.common[id] {
+		f.common[id] = true
+		WritePktLine(&f.state, []byte("have "+id+"\n"))
+
+		return false
+	}
+
+	// The final ACK and ready still matter to the client
+	return len(fields) > 2 && (fields[2] == "common" || fields[2] == "continue")
+}
+
+// relay passes on a response up to the pack, which is passed on as is.
+// With shallowOnly only the shallow list is.
+func (f *httpFetch) relay(r io.Reader, shallowOnly bool) error {
+	br := bufio.NewReader(r)
+	b := make([]byte, 65516)
+
+	// Whether the shallow list is being read, and is to be passed on
+	list := f.shallow
+	pass := !f.listed
+
+	for {
+		h, err := br.Peek(4)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Failed reading response: %v", err)
+		}
+
+		if bytes.Equal(h, []byte("PACK")) {
+			_, err = io.Copy(f.stdout, br)
+			return err
+		}
+
+		p, err := readPacket(br, b)
+		if err != nil {
+			return fmt.Errorf("Failed parsing pkt: %v", err)
+		}
+
+		if list {
+			shallow := p.Type == FlushPkt || bytes.HasPrefix(p.Data, []byte("shallow ")) || bytes.HasPrefix(p.Data, []byte("unshallow "))
+
+			if shallow && pass {
+				err = writePacket(f.stdout, p)
+				if err != nil {
+					return err
+				}
+			}
+
+			if !shallow || p.Type == FlushPkt {
+				list = false
+				f.listed = true
+			}
+
+			if shallow {
+				if !list && shallowOnly {
+					return nil
+				}
+
+				continue
+			}
+		}
+
+		if shallowOnly {
+			return nil
+		}
+
+		if isSideband(p) {
+			// The pack has started
+			err = writePacket(f.stdout, p)
+			if err != nil {
+				return err
+			}
+
+			_, err = io.Copy(f.stdout, br)
+			return err
+		}
+
+		if p.Type == DataPkt && f.acknowledged(p.Data) {
+			continue
+		}
+
+		err = writePacket(f.stdout, p)
+		if err != nil {
+			return err
+		}
+	}
+}
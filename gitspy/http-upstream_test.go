@@ -0,0 +1,208 @@
+package gitspy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHTTPUpstreamFetch(t *testing.T) {
+	otherID := strings.Repeat("1", 40)
+
+	var requests []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/test.git/info/refs":
+			w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+			WritePktLine(w, []byte("# service=git-upload-pack\n"))
+			WritePktLineFlush(w)
+			WritePktLine(w, []byte(oldID+" refs/heads/master\x00multi_ack_detailed\n"))
+			WritePktLineFlush(w)
+		case "/test.git/git-upload-pack":
+			b, _ := ioutil.ReadAll(r.Body)
+			requests = append(requests, string(b))
+
+			w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+			WritePktLine(w, []byte("ACK "+newID+" common\n"))
+
+			if len(requests) == 1 {
+				WritePktLine(w, []byte("NAK\n"))
+			} else {
+				WritePktLine(w, []byte("ACK "+newID+"\n"))
+				w.Write([]byte("PACK"))
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	u := &HTTPUpstream{URL: srv.URL}
+
+	s, err := u.Start(&Request{Service: UploadPack, Repo: "/test.git"})
+	if err != nil {
+		t.Fatalf("Error from Start: %v", err)
+	}
+
+	go ioutil.ReadAll(s.Stderr())
+
+	go func() {
+		WritePktLine(s.Stdin(), []byte("want "+oldID+"\n"))
+		WritePktLineFlush(s.Stdin())
+		WritePktLine(s.Stdin(), []byte("have "+newID+"\n"))
+		WritePktLineFlush(s.Stdin())
+		WritePktLine(s.Stdin(), []byte("have "+otherID+"\n"))
+		WritePktLine(s.Stdin(), []byte("done\n"))
+		s.Stdin().Close()
+	}()
+
+	out, _ := ioutil.ReadAll(s.Stdout())
+
+	err = s.Wait()
+	if err != nil {
+		t.Errorf("Error from Wait: %v", err)
+	}
+
+	want := &bytes.Buffer{}
+	WritePktLine(want, []byte(oldID+" refs/heads/master\x00multi_ack_detailed\n"))
+	WritePktLineFlush(want)
+	WritePktLine(want, []byte("ACK "+newID+" common\n"))
+	WritePktLine(want, []byte("NAK\n"))
+	WritePktLine(want, []byte("ACK "+newID+"\n"))
+	want.WriteString("PACK")
+
+	if string(out) != want.String() {
+		t.Errorf("Bad output: %q", out)
+	}
+
+	// The second request repeats the wants and the common have
+	req := &bytes.Buffer{}
+	WritePktLine(req, []byte("want "+oldID+"\n"))
+	WritePktLineFlush(req)
+	WritePktLine(req, []byte("have "+newID+"\n"))
+	WritePktLine(req, []byte("have "+otherID+"\n"))
+	WritePktLine(req, []byte("done\n"))
+
+	if len(requests) != 2 || requests[1] != req.String() {
+		t.Errorf("Bad requests: %q", requests)
+	}
+}
+
+// testHTTPBackend serves a repository with one commit with git http-backend.
+func testHTTPBackend(t *testing.T) (*httptest.Server, string) {
+	git, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "http-backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := filepath.Join(dir, "test.git")
+	for _, args := range [][]string{
+		{"init", "-q", repo},
+		{"-C", repo, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "test"},
+	} {
+		out, err := exec.Command(git, args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("Failed to run git %v: %v: %s", args, err, out)
+		}
+	}
+
+	srv := httptest.NewServer(&cgi.Handler{
+		Path: git,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + dir, "GIT_HTTP_EXPORT_ALL=1"},
+	})
+
+	return srv, dir
+}
+
+func TestHTTPUpstreamHTTPBackend(t *testing.T) {
+	srv, dir := testHTTPBackend(t)
+	defer os.RemoveAll(dir)
+	defer srv.Close()
+
+	u := &HTTPUpstream{URL: srv.URL}
+
+	s, err := u.Start(&Request{Service: UploadPack, Repo: "/test.git"})
+	if err != nil {
+		t.Fatalf("Error from Start: %v", err)
+	}
+
+	go ioutil.ReadAll(s.Stderr())
+
+	b := make([]byte, 65516)
+	n, err := ParsePktLine(s.Stdout(), b)
+	if err != nil || n < 40 {
+		t.Fatalf("Bad advertisement: %q %v", b[:n], err)
+	}
+
+	head := string(b[:40])
+
+	for err != ErrFlushPkt {
+		_, err = ParsePktLine(s.Stdout(), b)
+		if err != nil && err != ErrFlushPkt {
+			t.Fatalf("Error reading advertisement: %v", err)
+		}
+	}
+
+	WritePktLine(s.Stdin(), []byte("want "+head+"\n"))
+	WritePktLineFlush(s.Stdin())
+	WritePktLine(s.Stdin(), []byte("done\n"))
+
+	out, _ := ioutil.ReadAll(s.Stdout())
+	if !bytes.Contains(out, []byte("0008NAK\nPACK")) {
+		t.Errorf("Expected a pack: %q", out)
+	}
+
+	err = s.Wait()
+	if err != nil {
+		t.Errorf("Error from Wait: %v", err)
+	}
+}
+
+func TestHTTPUpstreamHTTPBackendV2(t *testing.T) {
+	srv, dir := testHTTPBackend(t)
+	defer os.RemoveAll(dir)
+	defer srv.Close()
+
+	u := &HTTPUpstream{URL: srv.URL}
+
+	s, err := u.Start(&Request{Service: UploadPack, Repo: "/test.git", Protocol: "version=2"})
+	if err != nil {
+		t.Fatalf("Error from Start: %v", err)
+	}
+
+	go ioutil.ReadAll(s.Stderr())
+
+	go func() {
+		WritePktLine(s.Stdin(), []byte("command=ls-refs\n"))
+		WritePktLineFlush(s.Stdin())
+		WritePktLineFlush(s.Stdin())
+		s.Stdin().Close()
+	}()
+
+	out := &bytes.Buffer{}
+	io.Copy(out, s.Stdout())
+
+	if !bytes.HasPrefix(out.Bytes(), []byte("000eversion 2\n")) || !bytes.Contains(out.Bytes(), []byte(" HEAD\n")) {
+		t.Errorf("Bad output: %q", out)
+	}
+
+	err = s.Wait()
+	if err != nil {
+		t.Errorf("Error from Wait: %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package gitspy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type httpUser struct {
+	name  string
+	token [sha256.Size]byte
+}
+
+// HTTPUsers authenticates smart HTTP clients against a file with a user
+// name and token on each line, such as "alice:s3cr3t". Clients send the
+// token as the password of Basic authentication, as git does with the
+// credentials it is given, or as a bearer token. The name becomes the
+// session's User, as GITSPY_USER does for ssh keys. The file is re-read
+// whenever it changes.
+type HTTPUsers struct {
+	Path string
+
+	users   []httpUser
+	modTime time.Time
+	lock    sync.Mutex
+}
+
+func LoadHTTPUsers(path string) (*HTTPUsers, error) {
+	hu := &HTTPUsers{Path: path}
+
+	err := hu.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return hu, nil
+}
+
+func (hu *HTTPUsers) reload() error {
+	fi, err := os.Stat(hu.Path)
+	if err != nil {
+		return fmt.Errorf("Failed to read http users: %v", err)
+	}
+
+	if fi.ModTime().Equal(hu.modTime) {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(hu.Path)
+	if err != nil {
+		return fmt.Errorf("Failed to read http users: %v", err)
+	}
+
+	users, err := parseHTTPUsers(b)
+	if err != nil {
+		return fmt.Errorf("Failed to parse %s: %v", hu.Path, err)
+	}
+
+	hu.users = users
+	hu.modTime = fi.ModTime()
+
+	log.Printf("Loaded %d http users from %s", len(users), hu.Path)
+
+	return nil
+}
+
+func parseHTTPUsers(b []byte) ([]httpUser, error) {
+	var users []httpUser
+
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid user on line %d", n)
+		}
+
+		users = append(users, httpUser{name: parts[0], token: sha256.Sum256([]byte(parts[1]))})
+	}
+
+	return users, s.Err()
+}
+
+// Authenticate returns the user r authenticates as, if any. A Basic user
+// name must match the token's.
+func (hu *HTTPUsers) Authenticate(r *http.Request) (string, bool) {
+	var name, token string
+
+	if n, p, ok := r.BasicAuth(); ok {
+		name, token = n, p
+	} else if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimSpace(h[len("Bearer "):])
+	}
+
+	if token == "" {
+		return "", false
+	}
+
+	hu.lock.Lock()
+	defer hu.lock.Unlock()
+
+	err := hu.reload()
+	if err != nil {
+		// Keep using the users we have
+		log.Printf("%v", err)
+	}
+
+	sum := sha256.Sum256([]byte(token))
+
+	for _, u := range hu.users {
+		if subtle.ConstantTimeCompare(u.token[:], sum[:]) != 1 {
+			continue
+		}
+
+		if name != "" && name != u.name {
+			continue
+		}
+
+		return u.name, true
+	}
+
+	return "", false
+}
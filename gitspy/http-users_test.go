@@ -0,0 +1,46 @@
+package gitspy
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPUsers(t *testing.T) {
+	users, err := parseHTTPUsers([]byte("# users\nalice:a11ce\n\nbob:b0b\n"))
+	if err != nil {
+		t.Fatalf("Error from parseHTTPUsers: %v", err)
+	}
+
+	hu := &HTTPUsers{users: users}
+
+	for _, c := range []struct {
+		user, password, bearer string
+		want                   string
+	}{
+		{user: "alice", password: "a11ce", want: "alice"},
+		{user: "bob", password: "b0b", want: "bob"},
+		{bearer: "b0b", want: "bob"},
+		{user: "alice", password: "b0b"},
+		{user: "alice", password: "wrong"},
+		{bearer: "wrong"},
+		{},
+	} {
+		r := httptest.NewRequest("GET", "/test.git/info/refs", nil)
+		if c.user != "" {
+			r.SetBasicAuth(c.user, c.password)
+		} else if c.bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+c.bearer)
+		}
+
+		// Path is unset, so stat fails and the parsed users are kept
+		user, ok := hu.Authenticate(r)
+		if user != c.want || ok != (c.want != "") {
+			t.Errorf("Authenticated %+v as %q %v", c, user, ok)
+		}
+	}
+
+	_, err = parseHTTPUsers([]byte("alice:a11ce\nbob\n"))
+	if err == nil || err.Error() != "Invalid user on line 2" {
+		t.Errorf("Bad error for missing token: %v", err)
+	}
+}
@@ -0,0 +1,287 @@
+package gitspy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A HostKeyError explains why an upstream's host key was not accepted. Known
+// is empty when nothing is known about the host.
+type HostKeyError struct {
+	Host    string
+	Key     ssh.PublicKey
+	Known   []ssh.PublicKey
+	Revoked bool
+}
+
+func (e *HostKeyError) Error() string {
+	fp := fmt.Sprintf("%s %s", e.Key.Type(), ssh.FingerprintSHA256(e.Key))
+
+	if e.Revoked {
+		return fmt.Sprintf("Host key verification failed: %s key for %s is revoked", fp, e.Host)
+	} else if len(e.Known) == 0 {
+		return fmt.Sprintf("Host key verification failed: no host key is known for %s (offered %s)", e.Host, fp)
+	}
+
+	return fmt.Sprintf("Host key verification failed: host key for %s has changed (offered %s)", e.Host, fp)
+}
+
+type knownHost struct {
+	marker   string
+	patterns []string
+	key      ssh.PublicKey
+}
+
+// KnownHosts verifies upstream host keys against a file in OpenSSH's
+// known_hosts format, including hashed hostnames, @cert-authority and
+// @revoked lines. With TrustOnFirstUse set the key of a host the file knows
+// nothing about is accepted and appended to the file.
+type KnownHosts struct {
+	Path            string
+	TrustOnFirstUse bool
+
+	// HashHosts hashes hostnames written by TrustOnFirstUse
+	HashHosts bool
+
+	hosts []knownHost
+	lock  sync.Mutex
+}
+
+// DefaultKnownHostsFile is the ssh client's known_hosts for the current user.
+func DefaultKnownHostsFile() string {
+	return filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+}
+
+// LoadKnownHosts reads a known_hosts file. A missing file is treated as
+// empty so that it can be filled by TrustOnFirstUse.
+func LoadKnownHosts(path string) (*KnownHosts, error) {
+	kh := &KnownHosts{Path: path}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return kh, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read known hosts: %v", err)
+	}
+
+	for {
+		marker, hosts, key, _, rest, err := ssh.ParseKnownHosts(b)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Failed to parse %s: %v", path, err)
+		}
+
+		if marker != "" && marker != "cert-authority" && marker != "revoked" {
+			return nil, fmt.Errorf("Unknown marker @%s in %s", marker, path)
+		}
+
+		kh.hosts = append(kh.hosts, knownHost{marker, hosts, key})
+		b = rest
+	}
+
+	return kh, nil
+}
+
+// knownHostName formats an address the way known_hosts names it: the bare
+// host for port 22 and "[host]:port" otherwise.
+func knownHostName(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	if port == "22" {
+		return host
+	}
+
+	return "[" + host + "]:" + port
+}
+
+// hashHostName hashes host as ssh-keygen -H does: "|1|salt|hmac-sha1".
+func hashHostName(host string, salt []byte) string {
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+
+	return "|1|" + base64.StdEncoding.EncodeToString(salt) + "|" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func matchHostPattern(pattern, host string) bool {
+	if strings.HasPrefix(pattern, "|1|") {
+		f := strings.Split(pattern, "|")
+		if len(f) != 4 {
+			return false
+		}
+
+		salt, err := base64.StdEncoding.DecodeString(f[2])
+		if err != nil {
+			return false
+		}
+
+		return hmac.Equal([]byte(hashHostName(host, salt)), []byte(pattern))
+	}
+
+	return matchWildcard(strings.ToLower(pattern), strings.ToLower(host))
+}
+
+// matchWildcard matches s against a pattern where * matches any run of
+// characters and ? any single character.
+func matchWildcard(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := 0; i <= len(s); i++ {
+				if matchWildcard(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+
+	return len(s) == 0
+}
+
+func (h *knownHost) matches(host string) bool {
+	matched := false
+
+	for _, p := range h.patterns {
+		if strings.HasPrefix(p, "!") {
+			if matchHostPattern(p[1:], host) {
+				return false
+			}
+		} else if matchHostPattern(p, host) {
+			matched = true
+		}
+	}
+
+	return matched
+}
+
+func keysEqual(a, b ssh.PublicKey) bool {
+	return bytes.Equal(a.Marshal(), b.Marshal())
+}
+
+// HostKeyCallback can be used as an ssh.ClientConfig's HostKeyCallback.
+func (kh *KnownHosts) HostKeyCallback(addr string, remote net.Addr, key ssh.PublicKey) error {
+	kh.lock.Lock()
+	defer kh.lock.Unlock()
+
+	host := knownHostName(addr)
+
+	revoked := func(k ssh.PublicKey) bool {
+		for _, h := range kh.hosts {
+			if h.marker == "revoked" && keysEqual(h.key, k) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if revoked(key) {
+		return &HostKeyError{Host: host, Key: key, Revoked: true}
+	}
+
+	if cert, ok := key.(*ssh.Certificate); ok {
+		checker := &ssh.CertChecker{
+			IsHostAuthority: func(auth ssh.PublicKey, _ string) bool {
+				for _, h := range kh.hosts {
+					if h.marker == "cert-authority" && h.matches(host) && keysEqual(h.key, auth) {
+						return true
+					}
+				}
+
+				return false
+			},
+			IsRevoked: func(c *ssh.Certificate) bool {
+				return revoked(c.SignatureKey)
+			},
+		}
+
+		err := checker.CheckHostKey(addr, remote, cert)
+		if err == nil {
+			return nil
+		}
+
+		// OpenSSH falls back to the plain key of a certificate it can't verify
+		log.Printf("Host certificate for %s not accepted: %v", host, err)
+		key = cert.Key
+	}
+
+	var known []ssh.PublicKey
+	for _, h := range kh.hosts {
+		if h.marker == "" && h.matches(host) {
+			if keysEqual(h.key, key) {
+				return nil
+			}
+
+			known = append(known, h.key)
+		}
+	}
+
+	if len(known) == 0 && kh.TrustOnFirstUse {
+		return kh.add(host, key)
+	}
+
+	return &HostKeyError{Host: host, Key: key, Known: known}
+}
+
+func (kh *KnownHosts) add(host string, key ssh.PublicKey) error {
+	name := host
+	if kh.HashHosts {
+		salt := make([]byte, sha1.Size)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return err
+		}
+
+		name = hashHostName(host, salt)
+	}
+
+	line := name + " " + string(ssh.MarshalAuthorizedKey(key))
+
+	f, err := os.OpenFile(kh.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to open known hosts: %v", err)
+	}
+
+	defer f.Close()
+
+	_, err = f.WriteString(line)
+	if err != nil {
+		return fmt.Errorf("Failed to write known hosts: %v", err)
+	}
+
+	log.Printf("Trusting %s key %s for %s on first use", key.Type(), ssh.FingerprintSHA256(key), host)
+
+	kh.hosts = append(kh.hosts, knownHost{patterns: []string{name}, key: key})
+
+	return nil
+}
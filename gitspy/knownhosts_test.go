@@ -0,0 +1,150 @@
+package gitspy
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func testSigner(t *testing.T) ssh.Signer {
+	_, k, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	s, err := ssh.NewSignerFromKey(k)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+
+	return s
+}
+
+func testKnownHosts(t *testing.T, contents string) *KnownHosts {
+	dir, err := ioutil.TempDir("", "knownhosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := filepath.Join(dir, "known_hosts")
+	if contents != "" {
+		ioutil.WriteFile(p, []byte(contents), 0600)
+	}
+
+	kh, err := LoadKnownHosts(p)
+	if err != nil {
+		t.Fatalf("Failed to load: %v", err)
+	}
+
+	return kh
+}
+
+func TestKnownHostsMatch(t *testing.T) {
+	key := testSigner(t).PublicKey()
+	line := string(ssh.MarshalAuthorizedKey(key))
+
+	kh := testKnownHosts(t, "*.example.com,!evil.example.com "+line+
+		hashHostName("github.com", []byte("salt"))+" "+line+
+		"[localhost]:2222 "+line)
+	defer os.RemoveAll(filepath.Dir(kh.Path))
+
+	for _, addr := range []string{"git.example.com:22", "github.com:22", "localhost:2222"} {
+		err := kh.HostKeyCallback(addr, nil, key)
+		if err != nil {
+			t.Errorf("%s should be known: %v", addr, err)
+		}
+	}
+
+	for _, addr := range []string{"evil.example.com:22", "localhost:22", "gitlab.com:22"} {
+		err := kh.HostKeyCallback(addr, nil, key)
+		if herr, ok := err.(*HostKeyError); !ok || len(herr.Known) != 0 {
+			t.Errorf("%s should be unknown: %v", addr, err)
+		}
+	}
+}
+
+func TestKnownHostsChanged(t *testing.T) {
+	key := testSigner(t).PublicKey()
+	other := testSigner(t).PublicKey()
+
+	kh := testKnownHosts(t, "github.com "+string(ssh.MarshalAuthorizedKey(key)))
+	defer os.RemoveAll(filepath.Dir(kh.Path))
+	kh.TrustOnFirstUse = true
+
+	err := kh.HostKeyCallback("github.com:22", nil, other)
+	if herr, ok := err.(*HostKeyError); !ok || len(herr.Known) != 1 {
+		t.Errorf("Key should have changed: %v", err)
+	}
+}
+
+func TestKnownHostsRevoked(t *testing.T) {
+	key := testSigner(t).PublicKey()
+	line := string(ssh.MarshalAuthorizedKey(key))
+
+	kh := testKnownHosts(t, "github.com "+line+"@revoked * "+line)
+	defer os.RemoveAll(filepath.Dir(kh.Path))
+
+	err := kh.HostKeyCallback("github.com:22", nil, key)
+	if herr, ok := err.(*HostKeyError); !ok || !herr.Revoked {
+		t.Errorf("Key should be revoked: %v", err)
+	}
+}
+
+func TestKnownHostsTrustOnFirstUse(t *testing.T) {
+	key := testSigner(t).PublicKey()
+
+	kh := testKnownHosts(t, "")
+	defer os.RemoveAll(filepath.Dir(kh.Path))
+	kh.TrustOnFirstUse = true
+	kh.HashHosts = true
+
+	err := kh.HostKeyCallback("gitea.local:2222", nil, key)
+	if err != nil {
+		t.Fatalf("Should trust on first use: %v", err)
+	}
+
+	reloaded, err := LoadKnownHosts(kh.Path)
+	if err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+
+	err = reloaded.HostKeyCallback("gitea.local:2222", nil, key)
+	if err != nil {
+		t.Errorf("Key should have been saved: %v", err)
+	}
+}
+
+func TestKnownHostsCertAuthority(t *testing.T) {
+	ca := testSigner(t)
+	host := testSigner(t)
+
+	cert := &ssh.Certificate{
+		Key:             host.PublicKey(),
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{"git.example.com"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+
+	err := cert.SignCert(rand.Reader, ca)
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+
+	kh := testKnownHosts(t, "@cert-authority *.example.com "+string(ssh.MarshalAuthorizedKey(ca.PublicKey())))
+	defer os.RemoveAll(filepath.Dir(kh.Path))
+
+	err = kh.HostKeyCallback("git.example.com:22", nil, cert)
+	if err != nil {
+		t.Errorf("Certificate should be trusted: %v", err)
+	}
+
+	err = kh.HostKeyCallback("github.com:22", nil, cert)
+	if err == nil {
+		t.Errorf("Certificate should not be trusted for another host")
+	}
+}
@@ -0,0 +1,306 @@
+package gitspy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A Registry holds metrics and writes them out in the Prometheus text
+// exposition format. It is an http.Handler for serving them as /metrics.
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+type Registry struct {
+	metrics []metric
+	lock    sync.Mutex
+}
+
+// DefaultRegistry holds the proxy's own metrics.
+var DefaultRegistry = &Registry{}
+
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+func (r *Registry) register(m metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.metrics = append(r.metrics, m)
+}
+
+// Write writes out every metric.
+func (r *Registry) Write(w io.Writer) error {
+	r.lock.Lock()
+	metrics := r.metrics
+	r.lock.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.writeTo(bw)
+	}
+
+	return bw.Flush()
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.Write(w)
+}
+
+// labelValue escapes a label value for the text format.
+var labelValue = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelPairs formats label names and values as name="value" pairs.
+func labelPairs(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, n := range names {
+		pairs[i] = n + `="` + labelValue.Replace(values[i]) + `"`
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metricVec is what counters and histograms share: a name, help and a
+// series for each combination of label values.
+type metricVec struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	// series by their label pairs
+	series map[string]interface{}
+	lock   sync.Mutex
+}
+
+// get returns the series for values, creating it with create.
+func (v *metricVec) get(values []string, create func() interface{}) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("%s: expected %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+
+	key := labelPairs(v.labels, values)
+
+	s, ok := v.series[key]
+	if !ok {
+		s = create()
+		v.series[key] = s
+	}
+
+	return s
+}
+
+// each calls f with every series in order of their labels.
+func (v *metricVec) each(f func(labels string, s interface{})) {
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		f(k, v.series[k])
+	}
+}
+
+func (v *metricVec) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.typ)
+}
+
+// A CounterVec is a counter with a value for each combination of labels.
+type CounterVec struct {
+	metricVec
+}
+
+func NewCounterVec(r *Registry, name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{metricVec{name: name, help: help, typ: "counter", labels: labels, series: map[string]interface{}{}}}
+	r.register(c)
+
+	return c
+}
+
+// Add adds delta to the counter with the given label values.
+func (c *CounterVec) Add(delta float64, values ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	s := c.get(values, func() interface{} { return new(float64) }).(*float64)
+	*s += delta
+}
+
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *CounterVec) writeTo(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.writeHeader(w)
+
+	if len(c.labels) == 0 && len(c.series) == 0 {
+		// A counter without labels always has a value
+		fmt.Fprintf(w, "%s 0\n", c.name)
+	}
+
+	c.each(func(labels string, s interface{}) {
+		if labels != "" {
+			labels = "{" + labels + "}"
+		}
+
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labels, formatValue(*s.(*float64)))
+	})
+}
+
+// histogram is one series of a HistogramVec.
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// A HistogramVec counts observations in buckets, for each combination of
+// labels.
+type HistogramVec struct {
+	metricVec
+	buckets []float64
+}
+
+// NewHistogramVec creates a histogram with buckets for values up to each of
+// the given upper bounds, in increasing order.
+func NewHistogramVec(r *Registry, name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{metricVec{name: name, help: help, typ: "histogram", labels: labels, series: map[string]interface{}{}}, buckets}
+	r.register(h)
+
+	return h
+}
+
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s := h.get(values, func() interface{} { return &histogram{counts: make([]uint64, len(h.buckets))} }).(*histogram)
+
+	for i, b := range h.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+
+	s.sum += v
+	s.count++
+}
+
+func (h *HistogramVec) writeTo(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.writeHeader(w)
+
+	h.each(func(labels string, s interface{}) {
+		hs := s.(*histogram)
+
+		sep := ""
+		if labels != "" {
+			sep = ","
+		}
+
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", h.name, labels, sep, formatValue(b), hs.counts[i])
+		}
+
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", h.name, labels, sep, hs.count)
+
+		if labels != "" {
+			labels = "{" + labels + "}"
+		}
+
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatValue(hs.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, hs.count)
+	})
+}
+
+// A labelLimit caps how many values a label takes, counting any beyond the
+// first max as "other", so clients can't make a metric grow without bound.
+type labelLimit struct {
+	max    int
+	values map[string]bool
+	lock   sync.Mutex
+}
+
+func (l *labelLimit) value(v string) string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.values == nil {
+		l.values = map[string]bool{}
+	}
+
+	if !l.values[v] {
+		if len(l.values) >= l.max {
+			return "other"
+		}
+
+		l.values[v] = true
+	}
+
+	return v
+}
+
+// maxRepoLabels is how many repositories sessions are counted by
+const maxRepoLabels = 100
+
+var sessionRepos = &labelLimit{max: maxRepoLabels}
+
+// Buckets for durations in seconds and for negotiation rounds
+var (
+	latencyBuckets  = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	durationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800}
+	roundBuckets    = []float64{0, 1, 2, 4, 8, 16, 32, 64}
+)
+
+// The proxy's metrics
+var (
+	metricConnections = NewCounterVec(DefaultRegistry, "gitspy_connections_accepted_total",
+		"SSH connections accepted.")
+
+	metricHandshakeFailures = NewCounterVec(DefaultRegistry, "gitspy_ssh_handshake_failures_total",
+		"SSH connections that failed to complete a handshake.")
+
+	metricSessions = NewCounterVec(DefaultRegistry, "gitspy_sessions_total",
+		"Git sessions started, by service and repository, those beyond the first 100 counted as other.", "service", "repo")
+
+	metricBytes = NewCounterVec(DefaultRegistry, "gitspy_proxied_bytes_total",
+		"Bytes passed through the proxy, by who sent them.", "from")
+
+	metricUpstreamLatency = NewHistogramVec(DefaultRegistry, "gitspy_upstream_start_seconds",
+		"Time taken to connect to the upstream and start a service.", latencyBuckets)
+
+	metricUpstreamFailures = NewCounterVec(DefaultRegistry, "gitspy_upstream_start_failures_total",
+		"Services the upstream could not be made to start.")
+
+	metricNegotiationRounds = NewHistogramVec(DefaultRegistry, "gitspy_negotiation_rounds",
+		"Rounds of haves a fetch took to find common commits.", roundBuckets)
+
+	metricSessionDuration = NewHistogramVec(DefaultRegistry, "gitspy_session_duration_seconds",
+		"Time from a git session starting to it ending, by service and exit status.", durationBuckets, "service", "status")
+
+	metricMirrorFetches = NewCounterVec(DefaultRegistry, "gitspy_mirror_fetches_total",
+		"Fetches through Mirrors, by whether the mirror was current to serve them: hit or miss.", "result")
+)
@@ -0,0 +1,61 @@
+package gitspy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := &Registry{}
+
+	c := NewCounterVec(r, "test_total", "A test counter.", "repo")
+	c.Inc("b")
+	c.Add(2, "a\"\n")
+
+	NewCounterVec(r, "test_unlabelled_total", "Never counted.")
+
+	h := NewHistogramVec(r, "test_seconds", "A test histogram.", []float64{1, 5})
+	h.Observe(0.5)
+	h.Observe(3)
+	h.Observe(10)
+
+	buf := &bytes.Buffer{}
+	r.Write(buf)
+
+	expected := strings.Join([]string{
+		"# HELP test_total A test counter.",
+		"# TYPE test_total counter",
+		`test_total{repo="a\"\n"} 2`,
+		`test_total{repo="b"} 1`,
+		"# HELP test_unlabelled_total Never counted.",
+		"# TYPE test_unlabelled_total counter",
+		"test_unlabelled_total 0",
+		"# HELP test_seconds A test histogram.",
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{le="1"} 1`,
+		`test_seconds_bucket{le="5"} 2`,
+		`test_seconds_bucket{le="+Inf"} 3`,
+		"test_seconds_sum 13.5",
+		"test_seconds_count 3",
+	}, "\n") + "\n"
+
+	if buf.String() != expected {
+		t.Errorf("Bad output:\n%s", buf.String())
+	}
+}
+
+func TestLabelLimit(t *testing.T) {
+	l := &labelLimit{max: 2}
+
+	for _, c := range []struct{ v, want string }{
+		{"/a.git", "/a.git"},
+		{"/b.git", "/b.git"},
+		{"/c.git", "other"},
+		{"/a.git", "/a.git"},
+	} {
+		if got := l.value(c.v); got != c.want {
+			t.Errorf("Label for %s is %s, not %s", c.v, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,464 @@
+package gitspy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mirrors is a Router keeping a local bare mirror, under Dir, of each
+// repository fetched through Router. Mirrors are kept by where the upstream
+// finds the repository, such as github.com/rhettg/git-spy.git, so each
+// repository has one whatever route or name clients reach it by. Fetches
+// from upstreams that can't say where are not mirrored. Before every fetch the upstream's refs
+// are checked against the mirror's: if they match, the fetch is served from
+// the mirror by git upload-pack on this machine. If not, it goes upstream as
+// usual while the mirror is brought up to date in the background, ready for
+// the next.
+type Mirrors struct {
+	// Router is read under lock, so that setRouter can change it while
+	// serving
+	Router Router
+	Dir    string
+
+	// refreshing holds the mirrors being brought up to date
+	refreshing map[string]bool
+	refreshes  sync.WaitGroup
+	lock       sync.Mutex
+}
+
+func NewMirrors(dir string, router Router) *Mirrors {
+	return &Mirrors{Router: router, Dir: dir, refreshing: map[string]bool{}}
+}
+
+// setRouter changes where repositories are fetched from, keeping the
+// mirrors and any refreshes running.
+func (m *Mirrors) setRouter(router Router) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.Router = router
+}
+
+func (m *Mirrors) Route(r *Request) (Upstream, error) {
+	m.lock.Lock()
+	router := m.Router
+	m.lock.Unlock()
+
+	u, err := router.Route(r)
+	if err != nil || r.Service != UploadPack {
+		return u, err
+	}
+
+	lu, ok := u.(locatedUpstream)
+	if !ok {
+		return u, nil
+	}
+
+	loc := lu.location(r)
+	if loc == "" {
+		return u, nil
+	}
+
+	return &mirrorUpstream{m: m, upstream: u, path: m.path(loc)}, nil
+}
+
+// A locatedUpstream can say where it finds a repository.
+type locatedUpstream interface {
+	// location returns the host and path of the repository r asks for
+	location(r *Request) string
+}
+
+// path is where the mirror of the repository at loc is kept.
+func (m *Mirrors) path(loc string) string {
+	return filepath.Join(m.Dir, filepath.Clean("/"+loc))
+}
+
+// refresh brings the mirror at path up to date in the background over s,
+// the upload-pack session adv came from, unless it is already being
+// brought up to date.
+func (m *Mirrors) refresh(path string, s UpstreamSession, adv *Advertisement) {
+	m.lock.Lock()
+	busy := m.refreshing[path]
+	m.refreshing[path] = true
+	m.lock.Unlock()
+
+	if busy {
+		hangUp(s)
+		return
+	}
+
+	m.refreshes.Add(1)
+
+	go func() {
+		defer m.refreshes.Done()
+
+		start := time.Now()
+
+		err := fetchMirror(path, s, adv)
+		s.Close()
+
+		if err != nil {
+			log.Printf("Failed to refresh mirror %s: %v", path, err)
+		} else {
+			log.Printf("Refreshed mirror %s in %v", path, time.Since(start))
+		}
+
+		m.lock.Lock()
+		delete(m.refreshing, path)
+		m.lock.Unlock()
+	}()
+}
+
+type mirrorUpstream struct {
+	m        *Mirrors
+	upstream Upstream
+
+	// path of the mirror
+	path string
+}
+
+func (u *mirrorUpstream) Start(r *Request) (UpstreamSession, error) {
+	path := u.path
+
+	s, adv, err := advertise(u.upstream, r)
+	if err != nil {
+		log.Printf("Failed to check mirror of %s, fetching from upstream: %v", r.Repo, err)
+		metricMirrorFetches.Inc("miss")
+		return u.upstream.Start(r)
+	}
+
+	if mirrorCurrent(path, adv) {
+		hangUp(s)
+
+		log.Printf("Serving %s from mirror %s", r.Repo, path)
+		metricMirrorFetches.Inc("hit")
+
+		return startLocal(path, r)
+	}
+
+	metricMirrorFetches.Inc("miss")
+	u.m.refresh(path, s, adv)
+
+	return u.upstream.Start(r)
+}
+
+// advertise starts a v0 upload-pack on upstream for the repository of r,
+// reading its advertisement of refs. The session is left waiting for wants.
+func advertise(upstream Upstream, r *Request) (UpstreamSession, *Advertisement, error) {
+	v0 := *r
+	v0.Protocol = ""
+
+	s, err := upstream.Start(&v0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	go io.Copy(ioutil.Discard, s.Stderr())
+
+	adv, err := readAdvertisement(s.Stdout())
+	if err != nil {
+		s.Close()
+		return nil, nil, err
+	}
+
+	return s, adv, nil
+}
+
+// readAdvertisement reads and parses an advertisement up to the flush that
+// ends it.
+func readAdvertisement(r io.Reader) (*Advertisement, error) {
+	var pkts []Packet
+	b := make([]byte, 65516)
+
+	for {
+		p, err := readPacket(r, b)
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading advertisement: %v", err)
+		}
+
+		if p.Type == FlushPkt {
+			return ParseAdvertisement(pkts)
+		}
+
+		pkts = append(pkts, p)
+	}
+}
+
+// hangUp ends an upload-pack session still waiting for wants.
+func hangUp(s UpstreamSession) {
+	WritePktLineFlush(s.Stdin())
+	s.Stdin().Close()
+	s.Wait()
+	s.Close()
+}
+
+// mirrorGit runs git in the repository at path, returning its output.
+func mirrorGit(path string, stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"-C", path}, args...)...)
+	cmd.Stdin = stdin
+
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return out, fmt.Errorf("git %s failed: %v: %s", args[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	return out, nil
+}
+
+// mirrorRefs maps each ref of the repository at path, including HEAD, to
+// what it points to.
+func mirrorRefs(path string) (map[string]string, error) {
+	out, err := mirrorGit(path, nil, "for-each-ref", "--format=%(objectname) %(refname)")
+	if err != nil {
+		return nil, err
+	}
+
+	refs := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		f := strings.Fields(line)
+		if len(f) == 2 {
+			refs[f[1]] = f[0]
+		}
+	}
+
+	// HEAD is missing from a repository without commits
+	head, err := mirrorGit(path, nil, "rev-parse", "-q", "--verify", "HEAD")
+	if err == nil {
+		refs["HEAD"] = strings.TrimSpace(string(head))
+	}
+
+	return refs, nil
+}
+
+// mirrorCurrent reports whether the mirror at path has exactly the refs
+// advertised.
+func mirrorCurrent(path string, adv *Advertisement) bool {
+	refs, err := mirrorRefs(path)
+	if err != nil || len(refs) != len(adv.Refs) {
+		return false
+	}
+
+	for _, ref := range adv.Refs {
+		if refs[ref.Name] != ref.ID {
+			return false
+		}
+	}
+
+	return true
+}
+
+// fetchMirror brings the mirror at path up to date with adv over s, the
+// upload-pack session adv came from, creating it if need be: whatever it
+// lacks is fetched, then its refs are made to match.
+func fetchMirror(path string, s UpstreamSession, adv *Advertisement) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		err = os.MkdirAll(path, 0755)
+		if err != nil {
+			hangUp(s)
+			return fmt.Errorf("Failed to create mirror: %v", err)
+		}
+
+		_, err = mirrorGit(path, nil, "init", "--bare", "-q")
+		if err != nil {
+			hangUp(s)
+			return fmt.Errorf("Failed to create mirror: %v", err)
+		}
+	}
+
+	refs, err := mirrorRefs(path)
+	if err != nil {
+		hangUp(s)
+		return err
+	}
+
+	haves := map[string]bool{}
+	for _, id := range refs {
+		haves[id] = true
+	}
+
+	var wants []string
+	wanted := map[string]bool{}
+
+	for _, ref := range adv.Refs {
+		if !haves[ref.ID] && !wanted[ref.ID] {
+			wanted[ref.ID] = true
+			wants = append(wants, ref.ID)
+		}
+	}
+
+	if len(wants) == 0 {
+		hangUp(s)
+	} else {
+		err = fetchPack(path, s, adv, wants, haves)
+		if err != nil {
+			return err
+		}
+	}
+
+	return updateMirrorRefs(path, adv, refs)
+}
+
+// fetchPack asks s for wants, telling it the mirror at path has haves, and
+// indexes the pack it sends into the mirror.
+func fetchPack(path string, s UpstreamSession, adv *Advertisement, wants []string, haves map[string]bool) error {
+	var caps []string
+	for _, c := range []string{"side-band-64k", "ofs-delta", "no-progress"} {
+		if adv.Capabilities.Has(c) {
+			caps = append(caps, c)
+		}
+	}
+
+	go func() {
+		w := bufio.NewWriter(s.Stdin())
+
+		for i, id := range wants {
+			line := "want " + id
+			if i == 0 && len(caps) > 0 {
+				line += " " + strings.Join(caps, " ")
+			}
+
+			WritePktLine(w, []byte(line+"\n"))
+		}
+
+		WritePktLineFlush(w)
+
+		for id := range haves {
+			WritePktLine(w, []byte("have "+id+"\n"))
+		}
+
+		WritePktLine(w, []byte("done\n"))
+		w.Flush()
+		s.Stdin().Close()
+	}()
+
+	cmd := exec.Command("git", "-C", path, "index-pack", "--stdin", "--fix-thin")
+
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	pack, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("Failed to open stdin: %v", err)
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("Failed to start index-pack: %v", err)
+	}
+
+	err = readPack(s.Stdout(), pack, adv.Capabilities.Has("side-band-64k"))
+	pack.Close()
+
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+
+	err = cmd.Wait()
+	if err != nil {
+		return fmt.Errorf("git index-pack failed: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	return s.Wait()
+}
+
+// readPack copies the pack of a fetch response from r to w, taking it out
+// of side-band if that was negotiated.
+func readPack(r io.Reader, w io.Writer, sideband bool) error {
+	br := bufio.NewReader(r)
+	b := make([]byte, 65516)
+
+	for {
+		h, err := br.Peek(4)
+		if err != nil {
+			return fmt.Errorf("Failed reading response: %v", err)
+		}
+
+		if !sideband && bytes.Equal(h, []byte("PACK")) {
+			_, err = io.Copy(w, br)
+			return err
+		}
+
+		p, err := readPacket(br, b)
+		if err != nil {
+			return fmt.Errorf("Failed parsing pkt: %v", err)
+		}
+
+		switch {
+		case p.Type == FlushPkt:
+			// The end of the side-band
+			return nil
+		case p.Type != DataPkt:
+			continue
+		case bytes.HasPrefix(p.Data, []byte("ACK ")) || bytes.Equal(p.Data, []byte("NAK\n")):
+			continue
+		case bytes.HasPrefix(p.Data, []byte("ERR ")):
+			return fmt.Errorf("Upstream refused fetch: %s", bytes.TrimSpace(p.Data[4:]))
+		case !sideband:
+			return fmt.Errorf("Unexpected response '%s'", bytes.TrimSpace(p.Data))
+		}
+
+		band, data, err := ParseSideband(p.Data)
+		if err != nil {
+			return err
+		}
+
+		switch band {
+		case BandData:
+			_, err = w.Write(data)
+			if err != nil {
+				return fmt.Errorf("Failed writing pack: %v", err)
+			}
+		case BandError:
+			return SidebandError(strings.TrimSpace(string(data)))
+		}
+	}
+}
+
+// updateMirrorRefs makes the refs of the mirror at path, currently refs,
+// match adv.
+func updateMirrorRefs(path string, adv *Advertisement, refs map[string]string) error {
+	cmds := &bytes.Buffer{}
+	advertised := map[string]bool{}
+
+	for _, ref := range adv.Refs {
+		advertised[ref.Name] = true
+
+		if ref.Name != "HEAD" && refs[ref.Name] != ref.ID {
+			fmt.Fprintf(cmds, "update %s %s\n", ref.Name, ref.ID)
+		}
+	}
+
+	for name := range refs {
+		if name != "HEAD" && !advertised[name] {
+			fmt.Fprintf(cmds, "delete %s\n", name)
+		}
+	}
+
+	_, err := mirrorGit(path, cmds, "update-ref", "--stdin")
+	if err != nil {
+		return err
+	}
+
+	if target, ok := adv.Symrefs()["HEAD"]; ok {
+		_, err = mirrorGit(path, nil, "symbolic-ref", "HEAD", target)
+	} else if head, ok := adv.Ref("HEAD"); ok {
+		_, err = mirrorGit(path, nil, "update-ref", "--no-deref", "HEAD", head.ID)
+	}
+
+	return err
+}
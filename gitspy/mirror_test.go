@@ -0,0 +1,171 @@
+package gitspy
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type testRouter struct {
+	Upstream
+}
+
+func (r testRouter) Route(*Request) (Upstream, error) { return r.Upstream, nil }
+
+func testGit(t *testing.T, args ...string) {
+	out, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("Failed to run git %v: %v: %s", args, err, out)
+	}
+}
+
+// testMirrorFetch fetches through m, checking the fetch gets a pack from
+// the repository at path.
+func testMirrorFetch(t *testing.T, m *Mirrors, r *Request, path string) {
+	u, err := m.Route(r)
+	if err != nil {
+		t.Fatalf("Error from Route: %v", err)
+	}
+
+	s, err := u.Start(r)
+	if err != nil {
+		t.Fatalf("Error from Start: %v", err)
+	}
+
+	defer s.Close()
+
+	if args := s.(*localSession).cmd.Args; args[len(args)-1] != path {
+		t.Errorf("Fetch served from %s, not %s", args[len(args)-1], path)
+	}
+
+	go ioutil.ReadAll(s.Stderr())
+
+	adv, err := readAdvertisement(s.Stdout())
+	if err != nil {
+		t.Fatalf("Error reading advertisement: %v", err)
+	}
+
+	head, ok := adv.Ref("HEAD")
+	if !ok {
+		t.Fatalf("No HEAD advertised: %v", adv.Refs)
+	}
+
+	WritePktLine(s.Stdin(), []byte("want "+head.ID+"\n"))
+	WritePktLineFlush(s.Stdin())
+	WritePktLine(s.Stdin(), []byte("done\n"))
+
+	out, _ := ioutil.ReadAll(s.Stdout())
+	if string(out[:8]) != "0008NAK\n" || string(out[8:12]) != "PACK" {
+		t.Errorf("Expected a pack: %q", out)
+	}
+
+	err = s.Wait()
+	if err != nil {
+		t.Errorf("Error from Wait: %v", err)
+	}
+}
+
+func TestMirrors(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "mirrors")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	repo := filepath.Join(dir, "upstream", "test.git")
+	commit := func(branch string) {
+		testGit(t, "-C", repo, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "test")
+		testGit(t, "-C", repo, "branch", "-f", branch)
+	}
+
+	testGit(t, "init", "-q", repo)
+	commit("other")
+
+	m := NewMirrors(filepath.Join(dir, "mirrors"), testRouter{&LocalUpstream{Dir: filepath.Join(dir, "upstream")}})
+	r := &Request{Service: UploadPack, Repo: "/test.git"}
+	mirror := filepath.Join(dir, "mirrors", "localhost", repo)
+
+	check := func() {
+		m.refreshes.Wait()
+
+		want, err := mirrorRefs(repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := mirrorRefs(mirror)
+		if err != nil {
+			t.Fatalf("Error listing mirror refs: %v", err)
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Mirror has refs %v, not %v", got, want)
+		}
+	}
+
+	// The first fetch goes upstream while the mirror is made
+	testMirrorFetch(t, m, r, repo)
+	check()
+
+	// A fetch with nothing new is served from the mirror
+	testMirrorFetch(t, m, r, mirror)
+
+	// Changed refs are fetched into the mirror, and gone ones deleted
+	commit("new")
+	testGit(t, "-C", repo, "branch", "-D", "other")
+
+	testMirrorFetch(t, m, r, repo)
+	check()
+
+	testMirrorFetch(t, m, r, mirror)
+
+	if s := m.refreshing; len(s) != 0 {
+		t.Errorf("Refreshes left running: %v", s)
+	}
+
+	// Other services always go upstream
+	u, _ := m.Route(&Request{Service: ReceivePack, Repo: "/test.git"})
+	if _, ok := u.(*LocalUpstream); !ok {
+		t.Errorf("Push should go upstream, not %T", u)
+	}
+}
+
+func TestMirrorsByUpstream(t *testing.T) {
+	m := NewMirrors("/mirrors", RouteTable{
+		{Prefix: "a", StripPrefix: true, Host: "one.example.com"},
+		{Prefix: "b", StripPrefix: true, URL: "https://two.example.com/git/"},
+		{Prefix: "c", StripPrefix: true, Host: "one.example.com"},
+		{Prefix: "d", StripPrefix: true, Host: "one.example.com", Port: 2222},
+	})
+
+	for repo, want := range map[string]string{
+		"/a/team/repo.git": "/mirrors/one.example.com/team/repo.git",
+		"/b/team/repo.git": "/mirrors/two.example.com/git/team/repo.git",
+		"/c/team/repo.git": "/mirrors/one.example.com/team/repo.git",
+		"/d/team/repo.git": "/mirrors/one.example.com:2222/team/repo.git",
+		"/a/../../etc":     "/mirrors/one.example.com/etc",
+	} {
+		u, err := m.Route(&Request{Service: UploadPack, Repo: repo})
+		if err != nil {
+			t.Fatalf("Error from Route: %v", err)
+		}
+
+		if mu, ok := u.(*mirrorUpstream); !ok || mu.path != want {
+			t.Errorf("%s mirrored at %v, not %s", repo, u, want)
+		}
+	}
+
+	// Without a location there is nothing to keep a mirror by
+	u, _ := NewMirrors("/mirrors", testRouter{NewReplayUpstream()}).Route(&Request{Service: UploadPack, Repo: "/test.git"})
+	if _, ok := u.(*mirrorUpstream); ok {
+		t.Errorf("Should not mirror an upstream without a location")
+	}
+}
@@ -0,0 +1,246 @@
+package gitspy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NegotiationState is how far an upload-pack negotiation has got.
+type NegotiationState int
+
+const (
+	// The client is sending wants, shallows and deepen requests
+	StateWants NegotiationState = iota
+
+	// The client is sending haves and the server acknowledging them
+	StateHaves
+
+	// The client sent done, or the server said it was ready
+	StateDone
+
+	// The server is sending the pack
+	StatePack
+)
+
+func (s NegotiationState) String() string {
+	switch s {
+	case StateWants:
+		return "wants"
+	case StateHaves:
+		return "haves"
+	case StateDone:
+		return "done"
+	case StatePack:
+		return "pack"
+	}
+
+	return fmt.Sprintf("NegotiationState(%d)", int(s))
+}
+
+// NegotiationStats summarises a negotiation.
+type NegotiationStats struct {
+	State NegotiationState
+
+	Wants   int
+	Haves   int
+	Rounds  int
+	Common  int
+	Shallow int
+	Deepen  string
+
+	// Lines the server sent to update the client's shallow boundary
+	ShallowUpdates int
+
+	// Time from the first want until the server started sending the pack
+	Duration time.Duration
+}
+
+func (s NegotiationStats) String() string {
+	msg := fmt.Sprintf("%d wants, %d haves in %d rounds, %d common", s.Wants, s.Haves, s.Rounds, s.Common)
+
+	if s.Deepen != "" {
+		msg += ", " + s.Deepen
+	}
+
+	if s.Shallow > 0 || s.ShallowUpdates > 0 {
+		msg += fmt.Sprintf(", %d shallow, %d shallow updates", s.Shallow, s.ShallowUpdates)
+	}
+
+	if s.State == StatePack {
+		msg += fmt.Sprintf(", pack after %v", s.Duration)
+	} else {
+		msg += ", ended in " + s.State.String()
+	}
+
+	return msg
+}
+
+// A Negotiation follows the want/have exchange of a fetch, in either
+// protocol version. Client lines are the v0 negotiation lines or v2 fetch
+// arguments; server lines are ACK/NAK replies and shallow updates.
+// https://www.kernel.org/pub/software/scm/git/docs/technical/pack-protocol.html#_packfile_negotiation
+type Negotiation struct {
+	// Capabilities the client asked for on its first want, in v0
+	Capabilities Capabilities
+
+	stats  NegotiationStats
+	common map[string]bool
+
+	// wants are the object ids, or ref names for want-ref, asked for
+	wants []string
+
+	// haves sent since the last flush
+	pending int
+
+	start time.Time
+	lock  sync.Mutex
+}
+
+func NewNegotiation() *Negotiation {
+	return &Negotiation{common: map[string]bool{}}
+}
+
+// MultiAck returns the acknowledgment mode the client asked for:
+// "multi_ack_detailed", "multi_ack" or "" for a single ACK.
+func (n *Negotiation) MultiAck() string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.Capabilities.Has("multi_ack_detailed") {
+		return "multi_ack_detailed"
+	} else if n.Capabilities.Has("multi_ack") {
+		return "multi_ack"
+	}
+
+	return ""
+}
+
+// NoDone reports whether the server may start the pack once it is ready,
+// without waiting for the client's done.
+func (n *Negotiation) NoDone() bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return n.Capabilities.Has("no-done")
+}
+
+func (n *Negotiation) Stats() NegotiationStats {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return n.stats
+}
+
+// Wants returns the object ids the client asked for, or the ref names of a
+// v2 want-ref.
+func (n *Negotiation) Wants() []string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return append([]string(nil), n.wants...)
+}
+
+// ClientLine notes a line the client sent.
+func (n *Negotiation) ClientLine(line string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	line = strings.TrimSuffix(line, "\n")
+
+	if n.start.IsZero() {
+		n.start = time.Now()
+	}
+
+	f := strings.SplitN(line, " ", 2)
+
+	switch f[0] {
+	case "want", "want-ref":
+		if n.stats.Wants == 0 && f[0] == "want" && len(f) > 1 {
+			if i := strings.IndexByte(f[1], ' '); i > 0 {
+				n.Capabilities = ParseCapabilities(f[1][i+1:])
+			}
+		}
+
+		if len(f) > 1 {
+			if id := strings.Fields(f[1]); len(id) > 0 {
+				n.wants = append(n.wants, id[0])
+			}
+		}
+
+		n.stats.Wants++
+	case "shallow":
+		n.stats.Shallow++
+	case "deepen", "deepen-since", "deepen-not":
+		n.stats.Deepen = line
+	case "have":
+		n.stats.State = StateHaves
+		n.stats.Haves++
+		n.pending++
+	case "done":
+		if n.pending > 0 {
+			n.stats.Rounds++
+		}
+
+		n.pending = 0
+		n.stats.State = StateDone
+	}
+}
+
+// ClientFlush notes the client ending its wants or a round of haves. A v2
+// fetch request counts as a flush.
+func (n *Negotiation) ClientFlush() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.pending > 0 {
+		n.stats.Rounds++
+		n.pending = 0
+	}
+}
+
+// ServerLine notes a line the server sent.
+func (n *Negotiation) ServerLine(line string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	f := strings.Fields(line)
+	if len(f) == 0 {
+		return
+	}
+
+	switch f[0] {
+	case "ACK":
+		if len(f) > 1 && !n.common[f[1]] {
+			n.common[f[1]] = true
+			n.stats.Common++
+		}
+
+		if len(f) > 2 && f[2] == "ready" && n.stats.State < StateDone {
+			n.stats.State = StateDone
+		}
+	case "ready":
+		if n.stats.State < StateDone {
+			n.stats.State = StateDone
+		}
+	case "shallow", "unshallow":
+		n.stats.ShallowUpdates++
+	}
+}
+
+// PackStarted notes the server starting to send the pack.
+func (n *Negotiation) PackStarted() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.stats.State == StatePack {
+		return
+	}
+
+	n.stats.State = StatePack
+
+	if !n.start.IsZero() {
+		n.stats.Duration = time.Since(n.start)
+	}
+}
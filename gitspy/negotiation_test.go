@@ -0,0 +1,71 @@
+package gitspy
+
+import (
+	"testing"
+)
+
+func TestNegotiationV0(t *testing.T) {
+	n := NewNegotiation()
+
+	n.ClientLine("want " + oldID + " multi_ack_detailed no-done side-band-64k\n")
+	n.ClientLine("want " + newID + "\n")
+	n.ClientLine("deepen 1\n")
+	n.ClientFlush()
+	n.ServerLine("shallow " + oldID + "\n")
+
+	n.ClientLine("have " + oldID + "\n")
+	n.ClientLine("have " + newID + "\n")
+	n.ClientFlush()
+	n.ServerLine("ACK " + oldID + " common\n")
+	n.ServerLine("NAK\n")
+
+	if s := n.Stats(); s.State != StateHaves || s.Rounds != 1 {
+		t.Errorf("Wrong state: %v", s)
+	}
+
+	n.ClientLine("have " + ZeroID + "\n")
+	n.ClientFlush()
+	n.ServerLine("ACK " + oldID + " ready\n")
+	n.ClientLine("done\n")
+	n.ServerLine("ACK " + oldID + "\n")
+	n.PackStarted()
+
+	s := n.Stats()
+	if s.Wants != 2 || s.Haves != 3 || s.Rounds != 2 || s.Common != 1 || s.ShallowUpdates != 1 || s.Deepen != "deepen 1" {
+		t.Errorf("Wrong stats: %#v", s)
+	}
+
+	if s.State != StatePack {
+		t.Errorf("Wrong state: %v", s.State)
+	}
+
+	if w := n.Wants(); len(w) != 2 || w[0] != oldID || w[1] != newID {
+		t.Errorf("Wrong wants: %v", w)
+	}
+
+	if n.MultiAck() != "multi_ack_detailed" || !n.NoDone() {
+		t.Errorf("Wrong capabilities: %v", n.Capabilities)
+	}
+}
+
+func TestNegotiationV2(t *testing.T) {
+	n := NewNegotiation()
+
+	// A v2 fetch sends haves and done in one request
+	n.ClientLine("thin-pack")
+	n.ClientLine("want " + oldID)
+	n.ClientLine("have " + newID)
+	n.ClientLine("done")
+	n.ClientFlush()
+	n.ServerLine("acknowledgments\n")
+	n.ServerLine("NAK\n")
+
+	s := n.Stats()
+	if s.Wants != 1 || s.Haves != 1 || s.Rounds != 1 || s.Common != 0 || s.State != StateDone {
+		t.Errorf("Wrong stats: %#v", s)
+	}
+
+	if len(n.Capabilities) != 0 {
+		t.Errorf("Should not have capabilities: %v", n.Capabilities)
+	}
+}
@@ -0,0 +1,59 @@
+package gitspy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+var ErrInvalidTree = errors.New("invalid tree object")
+
+// A TreeEntry is a file or directory listed in a tree object.
+type TreeEntry struct {
+	Mode string
+	Name string
+	ID   string
+}
+
+func (e TreeEntry) IsTree() bool {
+	return e.Mode == "40000"
+}
+
+// ParseTree parses a tree object's entries, each a mode and name followed by
+// the binary object id.
+func ParseTree(b []byte) ([]TreeEntry, error) {
+	var entries []TreeEntry
+
+	for len(b) > 0 {
+		sp := bytes.IndexByte(b, ' ')
+		nul := bytes.IndexByte(b, 0)
+		if sp <= 0 || nul < sp || len(b) < nul+21 {
+			return nil, ErrInvalidTree
+		}
+
+		entries = append(entries, TreeEntry{
+			Mode: string(b[:sp]),
+			Name: string(b[sp+1 : nul]),
+			ID:   hex.EncodeToString(b[nul+1 : nul+21]),
+		})
+
+		b = b[nul+21:]
+	}
+
+	return entries, nil
+}
+
+// ParseCommitTree returns the tree a commit object records.
+func ParseCommitTree(b []byte) string {
+	line := b
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		line = b[:i]
+	}
+
+	if !bytes.HasPrefix(line, []byte("tree ")) {
+		return ""
+	}
+
+	return strings.TrimSpace(string(line[len("tree "):]))
+}
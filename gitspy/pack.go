@@ -0,0 +1,952 @@
+package gitspy
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+)
+
+var ErrInvalidPack = errors.New("invalid pack header")
+
+var ErrInvalidDelta = errors.New("invalid delta")
+
+const packHeaderSize = 12
+
+// PackHeader is the fixed header at the start of a packfile
+// https://www.kernel.org/pub/software/scm/git/docs/technical/pack-format.html
+type PackHeader struct {
+	Version uint32
+	Objects uint32
+}
+
+func (h PackHeader) String() string {
+	return fmt.Sprintf("PACK v%d, %d objects", h.Version, h.Objects)
+}
+
+func ParsePackHeader(b []byte) (h PackHeader, err error) {
+	if len(b) < packHeaderSize || !bytes.Equal(b[0:4], []byte("PACK")) {
+		return h, ErrInvalidPack
+	}
+
+	h.Version = binary.BigEndian.Uint32(b[4:8])
+	h.Objects = binary.BigEndian.Uint32(b[8:12])
+
+	if h.Version != 2 && h.Version != 3 {
+		return h, ErrInvalidPack
+	}
+
+	return
+}
+
+// ObjectType is the type of an entry in a packfile
+type ObjectType int
+
+const (
+	ObjectCommit   ObjectType = 1
+	ObjectTree     ObjectType = 2
+	ObjectBlob     ObjectType = 3
+	ObjectTag      ObjectType = 4
+	ObjectOfsDelta ObjectType = 6
+	ObjectRefDelta ObjectType = 7
+)
+
+func (t ObjectType) String() string {
+	switch t {
+	case ObjectCommit:
+		return "commit"
+	case ObjectTree:
+		return "tree"
+	case ObjectBlob:
+		return "blob"
+	case ObjectTag:
+		return "tag"
+	case ObjectOfsDelta:
+		return "ofs-delta"
+	case ObjectRefDelta:
+		return "ref-delta"
+	}
+
+	return fmt.Sprintf("unknown(%d)", int(t))
+}
+
+// IsDelta reports whether objects of this type are stored as a delta
+// against another object.
+func (t ObjectType) IsDelta() bool {
+	return t == ObjectOfsDelta || t == ObjectRefDelta
+}
+
+// DefaultMaxObjectSize is the largest object a PackDecoder keeps the
+// contents of.
+const DefaultMaxObjectSize = 1 << 20
+
+// A PackObject is a single entry decoded from a packfile.
+type PackObject struct {
+	Type ObjectType
+
+	// Offset of the entry from the start of the pack
+	Offset int64
+
+	// Size of the inflated object, or of the delta for delta entries
+	Size int64
+
+	// ID is the object id, known only for entries that are not deltas
+	ID string
+
+	// The base a delta applies to: an offset for ofs-delta, an object id
+	// for ref-delta
+	BaseOffset int64
+	BaseID     string
+
+	// Data is the inflated entry, nil if it is larger than MaxObjectSize
+	Data []byte
+}
+
+func (o *PackObject) String() string {
+	switch o.Type {
+	case ObjectOfsDelta:
+		return fmt.Sprintf("%v %d bytes against offset %d", o.Type, o.Size, o.BaseOffset)
+	case ObjectRefDelta:
+		return fmt.Sprintf("%v %d bytes against %s", o.Type, o.Size, o.BaseID)
+	}
+
+	return fmt.Sprintf("%v %s %d bytes", o.Type, o.ID, o.Size)
+}
+
+// A PackHandler receives the contents of a pack as a PackDecoder decodes
+// it. Returning an error stops the decoder. PackEnd is called once the
+// checksum is verified, before the Write holding the end of the pack returns.
+type PackHandler interface {
+	PackHeader(h PackHeader) error
+	PackObject(o *PackObject) error
+	PackEnd() error
+}
+
+// A PackDataHandler is a PackHandler that is also given the contents of
+// objects larger than MaxObjectSize, a piece at a time as they are
+// inflated, before PackObject is called with them.
+type PackDataHandler interface {
+	PackHandler
+	PackData(o *PackObject, b []byte) error
+}
+
+// packDataWriter passes what is written to it to a PackDataHandler.
+type packDataWriter struct {
+	h PackDataHandler
+	o *PackObject
+}
+
+func (w packDataWriter) Write(b []byte) (int, error) {
+	err := w.h.PackData(w.o, b)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// A PackDecoder decodes a packfile written to it, a piece at a time, without
+// holding more than one object in memory. Each Write returns once the
+// decoder has consumed the bytes given to it, so any object completed by
+// them has been passed to the handler.
+type PackDecoder struct {
+	MaxObjectSize int64
+
+	handler PackHandler
+	start   sync.Once
+
+	in   chan []byte
+	idle chan struct{}
+	done chan struct{}
+	err  error
+
+	// The chunk being decoded, how far into it decoding and hashing has got
+	chunk   []byte
+	pos     int
+	hashed  int
+	waiting bool
+
+	offset   int64
+	checksum hash.Hash
+}
+
+func NewPackDecoder(handler PackHandler) *PackDecoder {
+	return &PackDecoder{
+		MaxObjectSize: DefaultMaxObjectSize,
+		handler:       handler,
+		in:            make(chan []byte),
+		idle:          make(chan struct{}),
+		done:          make(chan struct{}),
+		checksum:      sha1.New(),
+	}
+}
+
+// Write feeds more of the pack to the decoder. Bytes following a complete
+// pack are ignored.
+func (d *PackDecoder) Write(b []byte) (int, error) {
+	d.start.Do(func() { go d.run() })
+
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	select {
+	case d.in <- b:
+	case <-d.done:
+		if d.err != nil {
+			return 0, d.err
+		}
+
+		return len(b), nil
+	}
+
+	select {
+	case <-d.idle:
+	case <-d.done:
+		if d.err != nil {
+			return 0, d.err
+		}
+	}
+
+	return len(b), nil
+}
+
+// Close marks the end of the pack, returning an error if it was incomplete
+// or invalid.
+func (d *PackDecoder) Close() error {
+	d.start.Do(func() { go d.run() })
+
+	close(d.in)
+	<-d.done
+
+	return d.err
+}
+
+func (d *PackDecoder) run() {
+	defer close(d.done)
+
+	d.err = d.decode()
+}
+
+// fill waits for the next chunk, letting Write return first.
+func (d *PackDecoder) fill() error {
+	for d.pos == len(d.chunk) {
+		d.hash()
+
+		if d.waiting {
+			d.chunk = nil
+			d.waiting = false
+			d.idle <- struct{}{}
+		}
+
+		b, ok := <-d.in
+		if !ok {
+			return io.ErrUnexpectedEOF
+		}
+
+		d.chunk, d.pos, d.hashed = b, 0, 0
+		d.waiting = true
+	}
+
+	return nil
+}
+
+// hash adds the bytes decoded so far to the pack checksum.
+func (d *PackDecoder) hash() {
+	d.checksum.Write(d.chunk[d.hashed:d.pos])
+	d.hashed = d.pos
+}
+
+// Read and ReadByte let compress/zlib read the pack without reading past the
+// end of an object.
+func (d *PackDecoder) Read(b []byte) (int, error) {
+	err := d.fill()
+	if err != nil {
+		return 0, err
+	}
+
+	n := copy(b, d.chunk[d.pos:])
+	d.pos += n
+	d.offset += int64(n)
+
+	return n, nil
+}
+
+func (d *PackDecoder) ReadByte() (byte, error) {
+	err := d.fill()
+	if err != nil {
+		return 0, err
+	}
+
+	c := d.chunk[d.pos]
+	d.pos++
+	d.offset++
+
+	return c, nil
+}
+
+func (d *PackDecoder) decode() error {
+	b := make([]byte, packHeaderSize)
+
+	_, err := io.ReadFull(d, b)
+	if err != nil {
+		return fmt.Errorf("Failed reading pack header: %v", err)
+	}
+
+	h, err := ParsePackHeader(b)
+	if err != nil {
+		return err
+	}
+
+	err = d.handler.PackHeader(h)
+	if err != nil {
+		return err
+	}
+
+	var zr io.ReadCloser
+
+	for i := uint32(0); i < h.Objects; i++ {
+		o, err := d.decodeEntry()
+		if err != nil {
+			return fmt.Errorf("Failed decoding object %d: %v", i, err)
+		}
+
+		if zr == nil {
+			zr, err = zlib.NewReader(d)
+		} else {
+			err = zr.(zlib.Resetter).Reset(d, nil)
+		}
+
+		if err != nil {
+			return fmt.Errorf("Failed decoding object %d: %v", i, err)
+		}
+
+		err = d.inflate(o, zr)
+		if err != nil {
+			return fmt.Errorf("Failed decoding object %d: %v", i, err)
+		}
+
+		err = d.handler.PackObject(o)
+		if err != nil {
+			return err
+		}
+	}
+
+	d.hash()
+	sum := d.checksum.Sum(nil)
+
+	trailer := make([]byte, sha1.Size)
+
+	_, err = io.ReadFull(d, trailer)
+	if err != nil {
+		return fmt.Errorf("Failed reading pack checksum: %v", err)
+	}
+
+	if !bytes.Equal(trailer, sum) {
+		return fmt.Errorf("Pack checksum mismatch")
+	}
+
+	return d.handler.PackEnd()
+}
+
+// decodeEntry reads the type, size and delta base preceding an object's
+// compressed data.
+func (d *PackDecoder) decodeEntry() (*PackObject, error) {
+	o := &PackObject{Offset: d.offset}
+
+	c, err := d.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	o.Type = ObjectType((c >> 4) & 7)
+	o.Size = int64(c & 0x0f)
+
+	for shift := uint(4); c&0x80 != 0; shift += 7 {
+		c, err = d.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		o.Size |= int64(c&0x7f) << shift
+	}
+
+	switch o.Type {
+	case ObjectCommit, ObjectTree, ObjectBlob, ObjectTag:
+	case ObjectOfsDelta:
+		c, err = d.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		ofs := int64(c & 0x7f)
+		for c&0x80 != 0 {
+			c, err = d.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+
+			ofs = ((ofs + 1) << 7) | int64(c&0x7f)
+		}
+
+		o.BaseOffset = o.Offset - ofs
+	case ObjectRefDelta:
+		id := make([]byte, sha1.Size)
+
+		_, err = io.ReadFull(d, id)
+		if err != nil {
+			return nil, err
+		}
+
+		o.BaseID = hex.EncodeToString(id)
+	default:
+		return nil, fmt.Errorf("Invalid object type %d", o.Type)
+	}
+
+	return o, nil
+}
+
+// inflate reads an object's data, keeping it if it is small enough and
+// computing the object id of anything but a delta.
+func (d *PackDecoder) inflate(o *PackObject, zr io.Reader) error {
+	var w []io.Writer
+
+	var data *bytes.Buffer
+	if o.Size <= d.MaxObjectSize {
+		data = bytes.NewBuffer(make([]byte, 0, o.Size))
+		w = append(w, data)
+	} else if h, ok := d.handler.(PackDataHandler); ok {
+		w = append(w, packDataWriter{h, o})
+	}
+
+	var id hash.Hash
+	if !o.Type.IsDelta() {
+		id = sha1.New()
+		fmt.Fprintf(id, "%v %d\x00", o.Type, o.Size)
+		w = append(w, id)
+	}
+
+	n, err := io.Copy(io.MultiWriter(append(w, ioutil.Discard)...), zr)
+	if err != nil {
+		return err
+	}
+
+	if n != o.Size {
+		return fmt.Errorf("Expected %d bytes, inflated %d", o.Size, n)
+	}
+
+	if data != nil {
+		o.Data = data.Bytes()
+	}
+
+	if id != nil {
+		o.ID = hex.EncodeToString(id.Sum(nil))
+	}
+
+	return nil
+}
+
+// deltaSize reads one of the sizes at the start of a delta.
+func deltaSize(b []byte) (size int, rest []byte, err error) {
+	for shift := uint(0); ; shift += 7 {
+		if len(b) == 0 {
+			return 0, nil, ErrInvalidDelta
+		}
+
+		c := b[0]
+		b = b[1:]
+		size |= int(c&0x7f) << shift
+
+		if c&0x80 == 0 {
+			return size, b, nil
+		}
+	}
+}
+
+// ApplyDelta rebuilds an object from the base it was deltified against and
+// the data of its ofs-delta or ref-delta entry.
+func ApplyDelta(base, delta []byte) ([]byte, error) {
+	baseSize, delta, err := deltaSize(delta)
+	if err != nil {
+		return nil, err
+	}
+
+	if baseSize != len(base) {
+		return nil, ErrInvalidDelta
+	}
+
+	size, delta, err := deltaSize(delta)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, size)
+
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+
+		if op&0x80 == 0 {
+			// Insert the next op bytes
+			if op == 0 || int(op) > len(delta) {
+				return nil, ErrInvalidDelta
+			}
+
+			out = append(out, delta[:op]...)
+			delta = delta[op:]
+			continue
+		}
+
+		// Copy from the base, with offset and size bytes present as flagged
+		var offset, n int
+		for i := uint(0); i < 7; i++ {
+			if op&(1<<i) == 0 {
+				continue
+			}
+
+			if len(delta) == 0 {
+				return nil, ErrInvalidDelta
+			}
+
+			if i < 4 {
+				offset |= int(delta[0]) << (8 * i)
+			} else {
+				n |= int(delta[0]) << (8 * (i - 4))
+			}
+
+			delta = delta[1:]
+		}
+
+		if n == 0 {
+			n = 0x10000
+		}
+
+		if offset+n > len(base) {
+			return nil, ErrInvalidDelta
+		}
+
+		out = append(out, base[offset:offset+n]...)
+	}
+
+	if len(out) != size {
+		return nil, ErrInvalidDelta
+	}
+
+	return out, nil
+}
+
+// A ResolvedObject is a pack entry with any delta applied.
+type ResolvedObject struct {
+	Type ObjectType
+	ID   string
+	Data []byte
+}
+
+// maxResolverMemory is how much a PackResolver keeps in memory before the
+// rest goes to a temporary file.
+const maxResolverMemory = 16 * 1024 * 1024
+
+// A PackResolver applies deltas against earlier entries of the same pack,
+// keeping the contents of the types it is asked to. Deltas against objects
+// outside the pack, as in a thin pack, cannot be resolved. Contents beyond
+// maxResolverMemory are kept in a temporary file, removed by Close.
+type PackResolver struct {
+	keep map[ObjectType]bool
+
+	byOffset map[int64]*keptObject
+	byID     map[string]*keptObject
+
+	// data holds the contents of kept objects, size how much of it there is
+	data spool
+	size int64
+
+	// lock lets the session Close the resolver while a pack is decoded
+	lock sync.Mutex
+}
+
+// A keptObject is where a PackResolver keeps an object's contents.
+type keptObject struct {
+	Type ObjectType
+	ID   string
+
+	pos  int64
+	size int
+}
+
+func NewPackResolver(types ...ObjectType) *PackResolver {
+	r := &PackResolver{
+		keep:     map[ObjectType]bool{},
+		byOffset: map[int64]*keptObject{},
+		byID:     map[string]*keptObject{},
+		data:     spool{limit: maxResolverMemory},
+	}
+
+	for _, t := range types {
+		r.keep[t] = true
+	}
+
+	return r
+}
+
+// Resolve returns the object o holds, or false if its contents or those of
+// its base are not known.
+func (r *PackResolver) Resolve(o *PackObject) (*ResolvedObject, bool) {
+	if o.Data == nil {
+		return nil, false
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	ro := &ResolvedObject{Type: o.Type, ID: o.ID, Data: o.Data}
+
+	if o.Type.IsDelta() {
+		base, ok := r.byOffset[o.BaseOffset]
+		if o.Type == ObjectRefDelta {
+			base, ok = r.byID[o.BaseID]
+		}
+
+		if !ok {
+			return nil, false
+		}
+
+		bd, err := r.data.readAt(base.pos, base.size)
+		if err != nil {
+			log.Printf("Failed to read delta base %s: %v", base.ID, err)
+			return nil, false
+		}
+
+		data, err := ApplyDelta(bd, o.Data)
+		if err != nil {
+			return nil, false
+		}
+
+		h := sha1.New()
+		fmt.Fprintf(h, "%v %d\x00", base.Type, len(data))
+		h.Write(data)
+
+		ro = &ResolvedObject{Type: base.Type, ID: hex.EncodeToString(h.Sum(nil)), Data: data}
+	}
+
+	if r.keep[ro.Type] {
+		_, err := r.data.Write(ro.Data)
+		if err != nil {
+			log.Printf("Failed to keep %s: %v", ro.ID, err)
+			return ro, true
+		}
+
+		ko := &keptObject{Type: ro.Type, ID: ro.ID, pos: r.size, size: len(ro.Data)}
+		r.size += int64(len(ro.Data))
+
+		r.byOffset[o.Offset] = ko
+		r.byID[ro.ID] = ko
+	}
+
+	return ro, true
+}
+
+// Object returns a kept object by id.
+func (r *PackResolver) Object(id string) (*ResolvedObject, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	ko, ok := r.byID[id]
+	if !ok {
+		return nil, false
+	}
+
+	data, err := r.data.readAt(ko.pos, ko.size)
+	if err != nil {
+		log.Printf("Failed to read %s: %v", id, err)
+		return nil, false
+	}
+
+	return &ResolvedObject{Type: ko.Type, ID: ko.ID, Data: data}, true
+}
+
+// Close discards the kept objects.
+func (r *PackResolver) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.data.Close()
+	r.byOffset = map[int64]*keptObject{}
+	r.byID = map[string]*keptObject{}
+	r.size = 0
+
+	return nil
+}
+
+// A packInspector decodes a pack passing through the spy, handing its
+// objects to the filter.
+type packInspector struct {
+	gs  *GitSpy
+	ctx *FilterContext
+	dec *PackDecoder
+
+	// failed is set once the pack could not be decoded. A pushed pack is
+	// then rejected, as the filters can't vouch for it; any other is still
+	// passed on, just no longer inspected.
+	failed bool
+
+	// ended is set once the filters have passed the whole pack
+	ended bool
+}
+
+func (gs *GitSpy) newPackInspector(ctx *FilterContext) *packInspector {
+	pi := &packInspector{gs: gs, ctx: ctx}
+	pi.dec = NewPackDecoder(pi)
+
+	return pi
+}
+
+func (pi *packInspector) PackHeader(h PackHeader) error {
+	log.Printf("%v: %s", pi.ctx.Direction, h)
+	return nil
+}
+
+func (pi *packInspector) PackObject(o *PackObject) error {
+	if f, ok := pi.gs.filter.(PackFilter); ok {
+		err := f.PackObject(pi.ctx, o)
+		if err != nil {
+			return pi.gs.abort(err)
+		}
+	}
+
+	return nil
+}
+
+func (pi *packInspector) PackData(o *PackObject, b []byte) error {
+	if f, ok := pi.gs.filter.(PackDataFilter); ok {
+		err := f.PackData(pi.ctx, o, b)
+		if err != nil {
+			return pi.gs.abort(err)
+		}
+	}
+
+	return nil
+}
+
+func (pi *packInspector) PackEnd() error {
+	if f, ok := pi.gs.filter.(PackFilter); ok {
+		err := f.PackEnd(pi.ctx)
+		if err != nil {
+			return pi.gs.abort(err)
+		}
+	}
+
+	pi.ended = true
+
+	return nil
+}
+
+// check turns a decoder error into an error if a filter rejected the pack,
+// or if it is a pushed pack the filters were to inspect.
+func (pi *packInspector) check(err error) error {
+	if err == nil || pi.failed {
+		return nil
+	}
+
+	if ferr := pi.gs.Err(); ferr != nil {
+		return ferr
+	}
+
+	log.Printf("%v: Failed to inspect pack: %v", pi.ctx.Direction, err)
+	pi.failed = true
+
+	if _, ok := pi.gs.filter.(PackFilter); !ok || pi.ctx.Direction != ClientToServer {
+		return nil
+	}
+
+	rej := &PushRejectedError{
+		Updates:      pi.ctx.Updates,
+		Capabilities: pi.ctx.PushCapabilities,
+		Reasons:      map[string]string{},
+		Messages:     []string{fmt.Sprintf("Failed to inspect pack: %v", err)},
+	}
+
+	for _, u := range pi.ctx.Updates {
+		rej.Reasons[u.Name] = "unable to inspect pack"
+	}
+
+	return pi.gs.abort(rej)
+}
+
+func (pi *packInspector) Write(b []byte) error {
+	if pi.failed {
+		return nil
+	}
+
+	_, err := pi.dec.Write(b)
+	return pi.check(err)
+}
+
+func (pi *packInspector) Close() error {
+	if pi.failed {
+		return nil
+	}
+
+	return pi.check(pi.dec.Close())
+}
+
+// sideband inspects the pack data carried by a side-band packet.
+func (pi *packInspector) sideband(p Packet) error {
+	if p.Type != DataPkt {
+		return nil
+	}
+
+	band, data, err := ParseSideband(p.Data)
+	if err != nil || band != BandData {
+		return nil
+	}
+
+	return pi.Write(data)
+}
+
+// maxSpoolMemory is how much of a held back pack is kept in memory before
+// the rest goes to a temporary file.
+const maxSpoolMemory = 32 * 1024 * 1024
+
+// A spool holds back the data written to it, in memory up to limit and in
+// a temporary file beyond that, until it is copied out with WriteTo.
+type spool struct {
+	limit int
+	buf   bytes.Buffer
+	file  *os.File
+}
+
+func (s *spool) Write(b []byte) (int, error) {
+	if s.file == nil && s.buf.Len()+len(b) > s.limit {
+		f, err := ioutil.TempFile("", "git-spy-pack")
+		if err != nil {
+			return 0, fmt.Errorf("Failed to create spool file: %v", err)
+		}
+
+		s.file = f
+	}
+
+	if s.file != nil {
+		return s.file.Write(b)
+	}
+
+	return s.buf.Write(b)
+}
+
+// WriteTo copies out everything held back, emptying the spool.
+func (s *spool) WriteTo(w io.Writer) (int64, error) {
+	n, err := s.buf.WriteTo(w)
+	if err != nil || s.file == nil {
+		return n, err
+	}
+
+	_, err = s.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return n, err
+	}
+
+	m, err := io.Copy(w, s.file)
+	if err != nil {
+		return n + m, err
+	}
+
+	s.Close()
+
+	return n + m, nil
+}
+
+// readAt returns a copy of n bytes from pos on, of a spool never copied out.
+func (s *spool) readAt(pos int64, n int) ([]byte, error) {
+	b := make([]byte, n)
+
+	if pos+int64(n) <= int64(s.buf.Len()) {
+		copy(b, s.buf.Bytes()[pos:])
+		return b, nil
+	}
+
+	if s.file == nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	_, err := s.file.ReadAt(b, pos-int64(s.buf.Len()))
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Close discards anything held back.
+func (s *spool) Close() {
+	s.buf.Reset()
+
+	if s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+		s.file = nil
+	}
+}
+
+// proxyPack copies a pack sent outside of pkt-lines from src to dst,
+// inspecting it on the way. A pack pushed by the client is held back until
+// every PackFilter has seen all of it, so none of a rejected pack reaches
+// the upstream. Packs from the server are passed on as they are inspected.
+func (gs *GitSpy) proxyPack(dst io.Writer, src io.Reader, dir Direction) error {
+	pi := gs.newPackInspector(gs.context(dir, PhasePack))
+	b := make([]byte, 32*1024)
+
+	var held *spool
+	if _, ok := gs.filter.(PackFilter); ok && dir == ClientToServer {
+		held = &spool{limit: maxSpoolMemory}
+		defer held.Close()
+	}
+
+	out := dst
+	if held != nil {
+		out = held
+	}
+
+	for {
+		n, err := src.Read(b)
+		if n > 0 {
+			ierr := pi.Write(b[0:n])
+			if ierr != nil {
+				return ierr
+			}
+
+			_, werr := out.Write(b[0:n])
+			if werr != nil {
+				return fmt.Errorf("Failed writing pack: %v", werr)
+			}
+
+			// Once the filters have passed the pack there is nothing left
+			// to hold it back for
+			if held != nil && pi.ended {
+				_, werr := held.WriteTo(dst)
+				if werr != nil {
+					return fmt.Errorf("Failed writing pack: %v", werr)
+				}
+
+				held, out = nil, dst
+			}
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Failed reading pack: %v", err)
+		}
+	}
+
+	// A pack held back is passed on as it ends, so one still held is
+	// incomplete and rejected here
+	return pi.Close()
+}
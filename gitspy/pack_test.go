@@ -0,0 +1,346 @@
+package gitspy
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+type testPackHandler struct {
+	header  PackHeader
+	objects []*PackObject
+	reject  error
+	ended   bool
+
+	// data is what PackData was given for each offset
+	data map[int64][]byte
+}
+
+func (h *testPackHandler) PackData(o *PackObject, b []byte) error {
+	if h.data == nil {
+		h.data = map[int64][]byte{}
+	}
+
+	h.data[o.Offset] = append(h.data[o.Offset], b...)
+	return nil
+}
+
+func (h *testPackHandler) PackHeader(ph PackHeader) error {
+	h.header = ph
+	return nil
+}
+
+func (h *testPackHandler) PackObject(o *PackObject) error {
+	h.objects = append(h.objects, o)
+	return h.reject
+}
+
+func (h *testPackHandler) PackEnd() error {
+	h.ended = true
+	return nil
+}
+
+// testPackEntry encodes an entry header as git does
+func testPackEntry(t ObjectType, size int) []byte {
+	c := byte(t)<<4 | byte(size&0x0f)
+	size >>= 4
+
+	var b []byte
+	for size > 0 {
+		b = append(b, c|0x80)
+		c = byte(size & 0x7f)
+		size >>= 7
+	}
+
+	return append(b, c)
+}
+
+func testCompress(b []byte) []byte {
+	buf := &bytes.Buffer{}
+	zw := zlib.NewWriter(buf)
+	zw.Write(b)
+	zw.Close()
+
+	return buf.Bytes()
+}
+
+// testPack builds a pack of a blob, an ofs-delta and a ref-delta against it
+func testPack() []byte {
+	blob := []byte("hello\n")
+	delta := []byte{0x06, 0x07, 0x90, 0x06, 0x01, '!'}
+	baseID, _ := hex.DecodeString("ce013625030ba8dba906f756967f9e9ca394464a")
+
+	pack := &bytes.Buffer{}
+	pack.WriteString("PACK")
+	binary.Write(pack, binary.BigEndian, uint32(2))
+	binary.Write(pack, binary.BigEndian, uint32(3))
+
+	pack.Write(testPackEntry(ObjectBlob, len(blob)))
+	pack.Write(testCompress(blob))
+
+	ofs := pack.Len() - 12
+	pack.Write(testPackEntry(ObjectOfsDelta, len(delta)))
+	pack.WriteByte(byte(ofs))
+	pack.Write(testCompress(delta))
+
+	pack.Write(testPackEntry(ObjectRefDelta, len(delta)))
+	pack.Write(baseID)
+	pack.Write(testCompress(delta))
+
+	sum := sha1.Sum(pack.Bytes())
+	pack.Write(sum[:])
+
+	return pack.Bytes()
+}
+
+func TestPackDecoder(t *testing.T) {
+	h := &testPackHandler{}
+	d := NewPackDecoder(h)
+
+	// Feed it a byte at a time, as a slow connection might
+	for _, c := range testPack() {
+		_, err := d.Write([]byte{c})
+		if err != nil {
+			t.Fatalf("Error from write: %v", err)
+		}
+	}
+
+	err := d.Close()
+	if err != nil {
+		t.Fatalf("Error from close: %v", err)
+	}
+
+	if h.header.Objects != 3 || len(h.objects) != 3 || !h.ended {
+		t.Fatalf("Wrong objects: %v %v", h.header, h.objects)
+	}
+
+	blob := h.objects[0]
+	if blob.Type != ObjectBlob || blob.ID != "ce013625030ba8dba906f756967f9e9ca394464a" || string(blob.Data) != "hello\n" {
+		t.Errorf("Bad blob: %v", blob)
+	}
+
+	if o := h.objects[1]; o.Type != ObjectOfsDelta || o.BaseOffset != 12 || o.Size != 6 || o.ID != "" {
+		t.Errorf("Bad ofs-delta: %v", o)
+	}
+
+	if o := h.objects[2]; o.Type != ObjectRefDelta || o.BaseID != blob.ID {
+		t.Errorf("Bad ref-delta: %v", o)
+	}
+
+	b, err := ApplyDelta(blob.Data, h.objects[1].Data)
+	if err != nil || string(b) != "hello\n!" {
+		t.Errorf("Bad delta: %q %v", b, err)
+	}
+}
+
+func TestPackDecoderLargeObject(t *testing.T) {
+	h := &testPackHandler{}
+	d := NewPackDecoder(h)
+	d.MaxObjectSize = 4
+
+	d.Write(testPack())
+
+	err := d.Close()
+	if err != nil {
+		t.Fatalf("Error from close: %v", err)
+	}
+
+	if o := h.objects[0]; o.Data != nil || o.ID != "ce013625030ba8dba906f756967f9e9ca394464a" {
+		t.Errorf("Should not keep data: %v", o)
+	}
+
+	if b := h.data[h.objects[0].Offset]; string(b) != "hello\n" {
+		t.Errorf("Large object should be passed to PackData: %q", b)
+	}
+}
+
+func TestPackDecoderChecksum(t *testing.T) {
+	pack := testPack()
+	pack[len(pack)-1]++
+
+	d := NewPackDecoder(&testPackHandler{})
+	d.Write(pack)
+
+	err := d.Close()
+	if err == nil {
+		t.Errorf("Should fail checksum")
+	}
+}
+
+func TestPackDecoderReject(t *testing.T) {
+	rejected := errors.New("rejected")
+
+	d := NewPackDecoder(&testPackHandler{reject: rejected})
+
+	_, err := d.Write(testPack())
+	if err != rejected {
+		t.Errorf("Should be rejected: %v", err)
+	}
+
+	if d.Close() != rejected {
+		t.Errorf("Should stay rejected")
+	}
+}
+
+func TestPackDecoderTruncated(t *testing.T) {
+	pack := testPack()
+
+	d := NewPackDecoder(&testPackHandler{})
+	d.Write(pack[0:30])
+
+	err := d.Close()
+	if err == nil {
+		t.Errorf("Should fail on truncated pack")
+	}
+}
+
+// testPackFilter passes every packet, ending packs with end.
+type testPackFilter struct {
+	end error
+}
+
+func (f testPackFilter) Filter(ctx *FilterContext, p Packet) ([]Packet, error) {
+	return []Packet{p}, nil
+}
+
+func (f testPackFilter) PackObject(ctx *FilterContext, o *PackObject) error { return nil }
+
+func (f testPackFilter) PackEnd(ctx *FilterContext) error { return f.end }
+
+func TestProxyPackHeld(t *testing.T) {
+	push := func(end error) (*bytes.Buffer, error) {
+		src := &bytes.Buffer{}
+		WritePktLine(src, []byte(oldID+" "+newID+" refs/heads/master\x00report-status\n"))
+		WritePktLineFlush(src)
+		src.Write(testPack())
+
+		dst := &bytes.Buffer{}
+		err := testGitSpy(ReceivePack, testPackFilter{end}).proxyReceivePackRequest(dst, src)
+
+		return dst, err
+	}
+
+	rejected := errors.New("rejected")
+
+	dst, err := push(rejected)
+	if err != rejected {
+		t.Errorf("Push should be rejected: %v", err)
+	}
+
+	if bytes.Contains(dst.Bytes(), []byte("PACK")) {
+		t.Errorf("Rejected pack was passed on: %q", dst.Bytes())
+	}
+
+	dst, err = push(nil)
+	if err != nil {
+		t.Fatalf("Error from proxy: %v", err)
+	}
+
+	if !bytes.HasSuffix(dst.Bytes(), testPack()) {
+		t.Errorf("Pack not passed on: %q", dst.Bytes())
+	}
+}
+
+func TestProxyPackUninspectable(t *testing.T) {
+	pack := testPack()
+	pack[len(pack)-1]++
+
+	src := &bytes.Buffer{}
+	WritePktLine(src, []byte(oldID+" "+newID+" refs/heads/master\x00report-status\n"))
+	WritePktLineFlush(src)
+	src.Write(pack)
+
+	dst := &bytes.Buffer{}
+	err := testGitSpy(ReceivePack, testPackFilter{}).proxyReceivePackRequest(dst, src)
+
+	rej, ok := err.(*PushRejectedError)
+	if !ok || rej.Reasons["refs/heads/master"] != "unable to inspect pack" {
+		t.Errorf("Push should be rejected: %v", err)
+	}
+
+	if bytes.Contains(dst.Bytes(), []byte("PACK")) {
+		t.Errorf("Uninspected pack was passed on: %q", dst.Bytes())
+	}
+}
+
+func TestSpool(t *testing.T) {
+	s := &spool{limit: 4}
+	defer s.Close()
+
+	s.Write([]byte("abc"))
+	s.Write([]byte("defg"))
+
+	if s.file == nil {
+		t.Errorf("Should spill to a file")
+	}
+
+	out := &bytes.Buffer{}
+	_, err := s.WriteTo(out)
+	if err != nil || out.String() != "abcdefg" {
+		t.Errorf("Bad spool contents: %q %v", out, err)
+	}
+}
+
+func TestPackResolver(t *testing.T) {
+	h := &testPackHandler{}
+	d := NewPackDecoder(h)
+	d.Write(testPack())
+	d.Close()
+
+	r := NewPackResolver(ObjectBlob)
+	for _, o := range h.objects {
+		ro, ok := r.Resolve(o)
+		if !ok || ro.Type != ObjectBlob {
+			t.Fatalf("Failed to resolve %v", o)
+		}
+	}
+
+	ro, ok := r.Object("3ad99a16c6e3f94bfe9b7ff08cb90967988e3d88")
+	if !ok || string(ro.Data) != "hello\n!" {
+		t.Errorf("Bad resolved delta: %v", ro)
+	}
+
+	if _, ok := NewPackResolver(ObjectBlob).Resolve(h.objects[2]); ok {
+		t.Errorf("Should not resolve a delta without its base")
+	}
+}
+
+func TestPackResolverSpill(t *testing.T) {
+	h := &testPackHandler{}
+	d := NewPackDecoder(h)
+	d.Write(testPack())
+	d.Close()
+
+	r := NewPackResolver(ObjectBlob)
+	r.data.limit = 4
+
+	for _, o := range h.objects {
+		if _, ok := r.Resolve(o); !ok {
+			t.Fatalf("Failed to resolve %v", o)
+		}
+	}
+
+	if r.data.file == nil {
+		t.Errorf("Should spill to a file")
+	}
+
+	ro, ok := r.Object("ce013625030ba8dba906f756967f9e9ca394464a")
+	if !ok || string(ro.Data) != "hello\n" {
+		t.Errorf("Bad spilled object: %v", ro)
+	}
+
+	ro, ok = r.Object("3ad99a16c6e3f94bfe9b7ff08cb90967988e3d88")
+	if !ok || string(ro.Data) != "hello\n!" {
+		t.Errorf("Bad spilled delta: %v", ro)
+	}
+
+	r.Close()
+
+	if r.data.file != nil {
+		t.Errorf("Spill file not removed")
+	}
+}
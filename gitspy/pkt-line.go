@@ -11,8 +11,44 @@ import (
 
 var ErrFlushPkt = errors.New("flush packet")
 
+var ErrDelimPkt = errors.New("delim packet")
+
+var ErrResponseEndPkt = errors.New("response end packet")
+
 var ErrInvalidSize = errors.New("invalid size")
 
+// PktType distinguishes data packets from the special packets that carry no
+// payload.
+type PktType int
+
+const (
+	DataPkt PktType = iota
+	FlushPkt
+	DelimPkt
+	ResponseEndPkt
+)
+
+var specialPkts = map[PktType][]byte{
+	FlushPkt:       []byte("0000"),
+	DelimPkt:       []byte("0001"),
+	ResponseEndPkt: []byte("0002"),
+}
+
+func (t PktType) String() string {
+	switch t {
+	case DataPkt:
+		return "DATA"
+	case FlushPkt:
+		return "FLUSH"
+	case DelimPkt:
+		return "DELIM"
+	case ResponseEndPkt:
+		return "RESPONSE-END"
+	}
+
+	return fmt.Sprintf("PktType(%d)", int(t))
+}
+
 // Write buffer to the specified writer in pkg-line format
 // https://www.kernel.org/pub/software/scm/git/docs/technical/protocol-common.html
 func WritePktLine(w io.Writer, b []byte) (n int, err error) {
@@ -50,31 +86,46 @@ func WritePktLine(w io.Writer, b []byte) (n int, err error) {
 }
 
 func WritePktLineFlush(w io.Writer) (n int, err error) {
-	return w.Write([]byte("0000"))
+	return WriteSpecialPkt(w, FlushPkt)
 }
 
-func ParsePktLine(r io.Reader, b []byte) (n int, err error) {
-	sb := make([]byte, 4)
-	n, err = r.Read(sb)
-	if err != nil {
-		return
+// WriteSpecialPkt writes a flush, delim or response-end packet.
+func WriteSpecialPkt(w io.Writer, t PktType) (n int, err error) {
+	b, ok := specialPkts[t]
+	if !ok {
+		return 0, fmt.Errorf("Not a special packet: %v", t)
 	}
 
-	if n != 4 {
-		return n, fmt.Errorf("Wrong characters read")
+	return w.Write(b)
+}
+
+// ReadPkt reads one packet. For data packets the payload is read into b and
+// its length returned.
+func ReadPkt(r io.Reader, b []byte) (t PktType, n int, err error) {
+	sb := make([]byte, 4)
+	n, err = io.ReadFull(r, sb)
+	if err == io.ErrUnexpectedEOF {
+		return DataPkt, n, fmt.Errorf("Wrong characters read")
+	} else if err != nil {
+		return
 	}
 
 	db, err := hex.DecodeString(string(sb))
 	if err != nil {
-		return
+		return DataPkt, 0, err
 	}
 
 	hbs := binary.BigEndian.Uint16(db)
 
-	if hbs == 0 {
-		return 0, ErrFlushPkt
-	} else if hbs <= 4 {
-		return 0, ErrInvalidSize
+	switch hbs {
+	case 0:
+		return FlushPkt, 0, nil
+	case 1:
+		return DelimPkt, 0, nil
+	case 2:
+		return ResponseEndPkt, 0, nil
+	case 3:
+		return DataPkt, 0, ErrInvalidSize
 	}
 
 	bs := int(hbs) - 4
@@ -96,5 +147,25 @@ func ParsePktLine(r io.Reader, b []byte) (n int, err error) {
 		err = io.ErrShortBuffer
 	}
 
-	return n, err
+	return DataPkt, n, err
+}
+
+// ParsePktLine reads a data packet into b. Special packets are returned as
+// ErrFlushPkt, ErrDelimPkt or ErrResponseEndPkt.
+func ParsePktLine(r io.Reader, b []byte) (n int, err error) {
+	t, n, err := ReadPkt(r, b)
+	if err != nil {
+		return
+	}
+
+	switch t {
+	case FlushPkt:
+		return 0, ErrFlushPkt
+	case DelimPkt:
+		return 0, ErrDelimPkt
+	case ResponseEndPkt:
+		return 0, ErrResponseEndPkt
+	}
+
+	return n, nil
 }
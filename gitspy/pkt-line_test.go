@@ -104,3 +104,43 @@ func TestParsePktLineSmall(t *testing.T) {
 		t.Errorf("wrong error from parse: %v", err)
 	}
 }
+
+func TestReadPktSpecial(t *testing.T) {
+	r := bytes.NewBufferString("000100020000")
+
+	for _, expected := range []PktType{DelimPkt, ResponseEndPkt, FlushPkt} {
+		pt, n, err := ReadPkt(r, make([]byte, 25))
+		if err != nil {
+			t.Errorf("Error from read: %v", err)
+		}
+
+		if pt != expected || n != 0 {
+			t.Errorf("Wrong packet %v, expected %v", pt, expected)
+		}
+	}
+}
+
+func TestParsePktLineDelim(t *testing.T) {
+	r := bytes.NewBufferString("0001")
+
+	_, err := ParsePktLine(r, make([]byte, 25))
+	if err != ErrDelimPkt {
+		t.Errorf("Should be a delim error: %v", err)
+	}
+}
+
+func TestWriteSpecialPkt(t *testing.T) {
+	w := &bytes.Buffer{}
+
+	WriteSpecialPkt(w, DelimPkt)
+	WriteSpecialPkt(w, ResponseEndPkt)
+
+	if w.String() != "00010002" {
+		t.Errorf("Wrong encoding: %s", w.Bytes())
+	}
+
+	_, err := WriteSpecialPkt(w, DataPkt)
+	if err == nil {
+		t.Errorf("Data is not a special packet")
+	}
+}
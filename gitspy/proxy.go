@@ -2,59 +2,98 @@ package gitspy
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
-func proxyUploadPack(c ssh.Channel, cmd string) (err error) {
-	config := &ssh.ClientConfig{
-		User:            "git",
-		Auth:            []ssh.AuthMethod{sshAgentAuth()},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}
+// A clientConn carries a session to and from the git client, whichever
+// frontend it arrived through.
+type clientConn interface {
+	io.ReadWriteCloser
 
-	client, err := ssh.Dial("tcp", "github.com:22", config)
-	if err != nil {
-		return fmt.Errorf("Failed to connect: %v", err)
-	}
+	// Stderr is for messages to the user, as git's own stderr would be
+	Stderr() io.Writer
 
-	session, err := client.NewSession()
-	if err != nil {
-		return fmt.Errorf("Failed to create new session: %v", err)
-	}
+	// Exit reports the exit status of the service
+	Exit(status uint32)
+}
 
-	defer session.Close()
+// An advertisementSkipper is a clientConn leaving the upstream's
+// advertisement out of what it sends the client, until told the proxy is to
+// answer instead.
+type advertisementSkipper interface {
+	endAdvertisement()
+}
 
-	stdin, err := session.StdinPipe()
-	if err != nil {
-		return fmt.Errorf("Failed to open stdin: %v", err)
-	}
+// sshClient is a clientConn over an ssh session channel.
+type sshClient struct {
+	ssh.Channel
+}
 
-	stdout, err := session.StdoutPipe()
-	if err != nil {
-		return fmt.Errorf("Failed to open stdout: %v", err)
-	}
+func (c sshClient) Stderr() io.Writer  { return c.Channel.Stderr() }
+func (c sshClient) Exit(status uint32) { sendExitStatus(c.Channel, status) }
 
-	stderr, err := session.StderrPipe()
-	if err != nil {
-		return fmt.Errorf("Failed to open stderr: %v", err)
+// proxyCommand runs req against upstream, recording the session in t if it
+// is not nil and what it did in a. Once ctx is done both sides are hung up
+// on.
+func proxyCommand(ctx context.Context, c clientConn, req *Request, upstream Upstream, filter Filter, t *Transcript, a *AuditRecord) error {
+	defer t.Close()
+
+	exit := func(status uint32) {
+		c.Exit(status)
+		t.Exit(status)
+		a.ExitStatus = status
 	}
 
-	err = session.Start(cmd)
+	start := time.Now()
+
+	session, err := upstream.Start(req)
 	if err != nil {
-		return fmt.Errorf("Failed to start command: %v", err)
+		metricUpstreamFailures.Inc()
+		err = fmt.Errorf("Failed to start %s: %v", req.Service, err)
+		reportError(c, err)
+		exit(128)
+		return err
 	}
 
-	gs := NewGitSpy(c, stdin)
+	defer session.Close()
+
+	metricUpstreamLatency.Observe(time.Since(start).Seconds())
+
+	gs := NewGitSpy(req, c, session.Stdin(), filter)
+	gs.upstream = upstream
+	gs.Record(t)
+
+	// Hang up on the upstream as soon as a filter rejects the session, and
+	// on both sides if it is abandoned
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-gs.Aborted():
+			session.Close()
+		case <-ctx.Done():
+			log.Printf("Abandoning %s: %v", req, ctx.Err())
+			session.Close()
+			c.Close()
+		case <-done:
+		}
+	}()
 
 	go func() {
 		cp := gs.ClientPipe()
 		_, err := io.Copy(cp, c)
 		if err != nil && err != io.EOF {
-			log.Fatalf("Failed to Copy to client pipe: %v", err)
+			log.Printf("Failed to Copy to client pipe: %v", err)
+
+			// Keep reading so a client still sending can get our reply
+			io.Copy(ioutil.Discard, c)
 		}
 
 		log.Printf("Client copy complete")
@@ -64,30 +103,108 @@ func proxyUploadPack(c ssh.Channel, cmd string) (err error) {
 		return
 	}()
 
+	stderrDone := make(chan struct{})
 	go func() {
-		sp := gs.ServerPipe()
-		_, err := io.Copy(sp, stdout)
+		proxyStderr(io.MultiWriter(c.Stderr(), t.Stderr()), session.Stderr())
+		close(stderrDone)
+	}()
 
-		if err != nil && err != io.EOF {
-			log.Fatalf("Failed to Copy to server pipe: %v", err)
+	sp := gs.ServerPipe()
+	_, err = io.Copy(sp, session.Stdout())
+	sp.Close()
+
+	// Let the spy finish writing the response before closing the channel
+	gs.Wait()
+	a.spied(gs)
+
+	if ferr := gs.Err(); ferr != nil {
+		// The session may have been rejected before the upstream advertised
+		if as, ok := c.(advertisementSkipper); ok {
+			as.endAdvertisement()
 		}
 
-		log.Printf("Server copy complete")
-		sp.Close()
+		if rej, ok := ferr.(*PushRejectedError); ok {
+			reported, err := rej.Report(c, c.Stderr())
+			if err != nil {
+				log.Printf("Failed to report rejected push: %v", err)
+			}
 
-		return
-	}()
+			if reported {
+				exit(0)
+				gs.Close()
+				return ferr
+			}
+		}
+
+		reportError(c, ferr)
+		exit(128)
+		gs.Close()
+		return ferr
+	}
+
+	if ctx.Err() != nil {
+		exit(128)
+		gs.Close()
+		return fmt.Errorf("Session abandoned: %v", ctx.Err())
+	}
+
+	if err != nil && err != io.EOF {
+		// The upstream can't be heard from any more, so hang up on it and
+		// pass on whatever it had to say first
+		err = fmt.Errorf("Failed to Copy to server pipe: %v", err)
+
+		session.Close()
+		session.Wait()
+		<-stderrDone
+
+		reportError(c, err)
+		exit(128)
+		gs.Close()
+		return err
+	}
+
+	log.Printf("Server copy complete")
 
 	serr := session.Wait()
+	<-stderrDone
+
+	if serr != nil && req.Stateless && gs.Negotiation().Stats().State < StateDone {
+		// A stateless client hangs up after a round of haves, which an
+		// upstream expecting more fails on
+		serr = nil
+	}
+
+	exit(exitStatus(serr))
+
+	if stats := gs.Negotiation().Stats(); stats.Wants > 0 {
+		log.Printf("Negotiated %s: %s", req, stats)
+		metricNegotiationRounds.Observe(float64(stats.Rounds))
+	}
 
 	gs.Close()
 
+	if serr != nil {
+		return fmt.Errorf("Command failed: %v", serr)
+	}
+
+	return nil
+}
+
+// proxyStderr logs each line of the upstream's stderr and passes it on to
+// the client.
+func proxyStderr(dst io.Writer, src io.Reader) {
+	br := bufio.NewReader(src)
+
 	for {
-		br := bufio.NewReader(stderr)
-		line, _, err := br.ReadLine()
+		line, err := br.ReadBytes('\n')
 
 		if len(line) > 0 {
 			log.Printf("Error: %s", line)
+
+			_, werr := dst.Write(line)
+			if werr != nil {
+				log.Printf("Failed to write stderr: %v", werr)
+			}
 		}
 
 		if err != nil {
@@ -97,10 +214,17 @@ func proxyUploadPack(c ssh.Channel, cmd string) (err error) {
 			break
 		}
 	}
+}
 
-	if serr != nil {
-		return fmt.Errorf("Command failed: %v", serr)
+func sendExitStatus(c ssh.Channel, status uint32) {
+	_, err := c.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+	if err != nil {
+		log.Printf("Failed to send exit status: %v", err)
 	}
+}
 
-	return nil
+// reportError tells the git client why its command failed, the same way git
+// itself reports fatal errors.
+func reportError(c clientConn, err error) {
+	fmt.Fprintf(c.Stderr(), "fatal: %v\n", err)
 }
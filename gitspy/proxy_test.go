@@ -0,0 +1,40 @@
+package gitspy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// testBrokenUpstream starts sessions whose stdout fails to read.
+type testBrokenUpstream struct {
+	waited bool
+}
+
+func (u *testBrokenUpstream) Start(r *Request) (UpstreamSession, error) { return u, nil }
+
+func (u *testBrokenUpstream) Stdin() io.WriteCloser { return nopWriteCloser{ioutil.Discard} }
+func (u *testBrokenUpstream) Stdout() io.Reader {
+	return iotest.ErrReader(errors.New("connection reset"))
+}
+func (u *testBrokenUpstream) Stderr() io.Reader { return strings.NewReader("") }
+func (u *testBrokenUpstream) Wait() error       { u.waited = true; return nil }
+func (u *testBrokenUpstream) Close() error      { return nil }
+
+func TestProxyCommandUpstreamFailed(t *testing.T) {
+	u := &testBrokenUpstream{}
+	s := NewServer(nil, testRouter{u})
+
+	out := testDaemon(s, "git-upload-pack /test.git\x00", nil)
+	if !bytes.Contains(out, []byte("ERR Failed to Copy to server pipe: connection reset")) {
+		t.Errorf("Failure not reported: %q", out)
+	}
+
+	if !u.waited {
+		t.Errorf("Session not waited for")
+	}
+}
@@ -0,0 +1,212 @@
+package gitspy
+
+import "strings"
+
+// A BranchRule protects the refs matching Pattern from the users it applies
+// to.
+type BranchRule struct {
+	// Pattern matches ref names, * matching any characters including /
+	Pattern string `json:"pattern"`
+
+	DenyNonFastForward bool `json:"deny_non_fast_forward,omitempty"`
+	DenyDelete         bool `json:"deny_delete,omitempty"`
+
+	// Users the rule applies to, a leading ! excluding a user. Without any
+	// the rule applies to everyone.
+	Users []string `json:"users,omitempty"`
+}
+
+// A PushPolicy is a filter enforcing rules on what pushes may do. A push
+// breaking any rule is rejected as a whole before the upstream applies it,
+// with the client told why for each ref.
+//
+// Rules apply to the refs a push updates by their names upstream. In a Chain
+// after a RefFilter, a push to a renamed ref is checked against the ref it
+// really updates, while the client is told about the name it used.
+//
+// Fast-forwards are checked against the commits in the pushed pack and in
+// Commits, which learns from every pack passing through the proxy. An update
+// whose history cannot be followed back to the old commit, such as one
+// pointing a branch at a commit the upstream already has, is rejected too,
+// with the client told it could not be verified rather than that it is not a
+// fast-forward.
+type PushPolicy struct {
+	Branches []BranchRule
+
+	// Users who may create tags, a leading ! excluding a user. Everyone may
+	// if it is empty.
+	TagCreators []string
+
+	Commits *CommitCache
+}
+
+func NewPushPolicy() *PushPolicy {
+	return &PushPolicy{Commits: NewCommitCache()}
+}
+
+// pushState is what a PushPolicy learns about a session.
+type pushState struct {
+	// Commands held back until the whole list is checked
+	held []Packet
+
+	// Updates to check once the pack has arrived
+	fastForwards []RefUpdate
+
+	// Commits in the pushed pack
+	pushed  *PackResolver
+	parents map[string][]string
+}
+
+func (st *pushState) Close() error {
+	return st.pushed.Close()
+}
+
+func (pp *PushPolicy) state(ctx *FilterContext) *pushState {
+	v, _ := ctx.State.LoadOrStore(pp, &pushState{pushed: NewPackResolver(ObjectCommit), parents: map[string][]string{}})
+	return v.(*pushState)
+}
+
+func rejectPush(ctx *FilterContext, reasons map[string]string) error {
+	return &PushRejectedError{Updates: ctx.Updates, Capabilities: ctx.PushCapabilities, Reasons: reasons}
+}
+
+// check returns why an update is not allowed, or whether it needs to be a
+// fast-forward.
+func (pp *PushPolicy) check(user string, u RefUpdate) (reason string, fastForward bool) {
+	if strings.HasPrefix(u.Name, "refs/tags/") && u.IsCreate() && !matchUsers(pp.TagCreators, user) {
+		return "tag creation prohibited", false
+	}
+
+	for _, r := range pp.Branches {
+		if !matchUsers(r.Users, user) || !matchWildcard(r.Pattern, u.Name) {
+			continue
+		}
+
+		if u.IsDelete() && r.DenyDelete {
+			return "deletion prohibited", false
+		}
+
+		return "", r.DenyNonFastForward && !u.IsCreate() && !u.IsDelete()
+	}
+
+	return "", false
+}
+
+// Filter holds back a push's commands until they have all been checked.
+func (pp *PushPolicy) Filter(ctx *FilterContext, p Packet) ([]Packet, error) {
+	if ctx.Service != ReceivePack || ctx.Direction != ClientToServer || ctx.Phase != PhaseCommand {
+		return []Packet{p}, nil
+	}
+
+	st := pp.state(ctx)
+
+	if p.Type != FlushPkt {
+		st.held = append(st.held, p)
+		return nil, nil
+	}
+
+	// The held commands carry the names filters before this one gave the
+	// refs, the client's updates those to report rejections by
+	var updates []RefUpdate
+	for _, h := range st.held {
+		u, _, err := ParseRefUpdate(h.Data)
+		if err == nil {
+			updates = append(updates, u)
+		}
+	}
+
+	reasons := map[string]string{}
+
+	for i, u := range updates {
+		name := u.Name
+		if len(updates) == len(ctx.Updates) {
+			name = ctx.Updates[i].Name
+		}
+
+		reason, ff := pp.check(ctx.User, u)
+		if reason != "" {
+			reasons[name] = reason
+		} else if ff {
+			u.Name = name
+			st.fastForwards = append(st.fastForwards, u)
+		}
+	}
+
+	if len(reasons) > 0 {
+		return nil, rejectPush(ctx, reasons)
+	}
+
+	pkts := append(st.held, p)
+	st.held = nil
+
+	return pkts, nil
+}
+
+// PackObject remembers the commits of every pack. Only pushed packs are
+// kept whole, for resolving deltas; fetched commits go straight to Commits.
+func (pp *PushPolicy) PackObject(ctx *FilterContext, o *PackObject) error {
+	if ctx.Direction == ServerToClient {
+		if o.Type == ObjectCommit && o.Data != nil && pp.Commits != nil {
+			pp.Commits.Add(o.ID, ParseCommitParents(o.Data))
+		}
+
+		return nil
+	}
+
+	st := pp.state(ctx)
+
+	ro, ok := st.pushed.Resolve(o)
+	if !ok || ro.Type != ObjectCommit {
+		return nil
+	}
+
+	st.parents[ro.ID] = ParseCommitParents(ro.Data)
+	if pp.Commits != nil {
+		pp.Commits.Add(ro.ID, st.parents[ro.ID])
+	}
+
+	return nil
+}
+
+// PackEnd checks the pushed pack holds fast-forwards for the updates that
+// need them.
+func (pp *PushPolicy) PackEnd(ctx *FilterContext) error {
+	if ctx.Service != ReceivePack || ctx.Direction != ClientToServer {
+		return nil
+	}
+
+	st := pp.state(ctx)
+
+	parents := func(id string) ([]string, bool) {
+		if p, ok := st.parents[id]; ok {
+			return p, true
+		}
+
+		if pp.Commits != nil {
+			return pp.Commits.Parents(id)
+		}
+
+		return nil, false
+	}
+
+	reasons := map[string]string{}
+
+	for _, u := range st.fastForwards {
+		ancestor, known := isAncestor(u.Old, u.New, parents)
+		if ancestor {
+			continue
+		}
+
+		if known {
+			reasons[u.Name] = "non-fast-forward"
+		} else {
+			reasons[u.Name] = "cannot verify fast-forward: history unknown to proxy"
+		}
+	}
+
+	if len(reasons) > 0 {
+		return rejectPush(ctx, reasons)
+	}
+
+	return nil
+}
@@ -0,0 +1,188 @@
+package gitspy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func testPushPolicy() *PushPolicy {
+	pp := NewPushPolicy()
+	pp.Branches = []BranchRule{
+		{Pattern: "refs/heads/master", DenyNonFastForward: true, DenyDelete: true, Users: []string{"*", "!admin"}},
+	}
+	pp.TagCreators = []string{"admin"}
+
+	return pp
+}
+
+// testPush sends a push's commands through pp, returning the packets let
+// through. The updates are parsed for ctx at the flush, as the spy does.
+func testPush(pp *PushPolicy, ctx *FilterContext, lines ...string) ([]Packet, error) {
+	for i, line := range lines {
+		if i == 0 {
+			line += "\x00report-status"
+		}
+
+		pkts, err := pp.Filter(ctx, DataPacket([]byte(line+"\n")))
+		if err != nil || len(pkts) != 0 {
+			return pkts, err
+		}
+
+		u, caps, _ := ParseRefUpdate([]byte(line + "\n"))
+		if i == 0 {
+			ctx.PushCapabilities = caps
+		}
+
+		ctx.Updates = append(ctx.Updates, u)
+	}
+
+	return pp.Filter(ctx, Packet{Type: FlushPkt})
+}
+
+func testRejection(t *testing.T, err error, name, reason string) {
+	rerr, ok := err.(*PushRejectedError)
+	if !ok {
+		t.Fatalf("Should be rejected: %v", err)
+	}
+
+	if rerr.Reasons[name] != reason {
+		t.Errorf("Bad reasons: %v", rerr.Reasons)
+	}
+}
+
+func TestPushPolicyDelete(t *testing.T) {
+	pp := testPushPolicy()
+
+	ctx := testRefContext(ReceivePack, "alice", ClientToServer, PhaseCommand)
+	_, err := testPush(pp, ctx, oldID+" "+ZeroID+" refs/heads/master", oldID+" "+ZeroID+" refs/heads/topic")
+	testRejection(t, err, "refs/heads/master", "deletion prohibited")
+
+	ctx = testRefContext(ReceivePack, "admin", ClientToServer, PhaseCommand)
+	pkts, err := testPush(pp, ctx, oldID+" "+ZeroID+" refs/heads/master")
+	if err != nil || len(pkts) != 2 {
+		t.Errorf("Admin should delete master: %v %v", pkts, err)
+	}
+}
+
+func TestPushPolicyTags(t *testing.T) {
+	pp := testPushPolicy()
+
+	ctx := testRefContext(ReceivePack, "alice", ClientToServer, PhaseCommand)
+	_, err := testPush(pp, ctx, ZeroID+" "+newID+" refs/tags/v1")
+	testRejection(t, err, "refs/tags/v1", "tag creation prohibited")
+
+	ctx = testRefContext(ReceivePack, "admin", ClientToServer, PhaseCommand)
+	_, err = testPush(pp, ctx, ZeroID+" "+newID+" refs/tags/v1")
+	if err != nil {
+		t.Errorf("Admin should create tags: %v", err)
+	}
+}
+
+func TestPushPolicyFastForward(t *testing.T) {
+	pp := testPushPolicy()
+
+	// The upstream's history, as learnt from a fetch
+	fetch := testRefContext(UploadPack, "alice", ServerToClient, PhaseSideband)
+	pp.PackObject(fetch, &PackObject{Type: ObjectCommit, ID: oldID, Data: []byte("tree x\n\nbase\n")})
+
+	commit := "tree x\nparent " + oldID + "\n\nnext\n"
+	commitID := "3333333333333333333333333333333333333333"
+
+	ctx := testRefContext(ReceivePack, "alice", ClientToServer, PhaseCommand)
+	_, err := testPush(pp, ctx, oldID+" "+commitID+" refs/heads/master")
+	if err != nil {
+		t.Fatalf("Should wait for the pack: %v", err)
+	}
+
+	ctx.Phase = PhasePack
+	pp.PackObject(ctx, &PackObject{Type: ObjectCommit, ID: commitID, Data: []byte(commit)})
+	if err := pp.PackEnd(ctx); err != nil {
+		t.Errorf("Should be a fast-forward: %v", err)
+	}
+
+	// Rewriting it is not
+	ctx = testRefContext(ReceivePack, "alice", ClientToServer, PhaseCommand)
+	testPush(pp, ctx, commitID+" "+newID+" refs/heads/master")
+
+	ctx.Phase = PhasePack
+	pp.PackObject(ctx, &PackObject{Type: ObjectCommit, ID: newID, Data: []byte("tree x\nparent " + oldID + "\n\nother\n")})
+	testRejection(t, pp.PackEnd(ctx), "refs/heads/master", "non-fast-forward")
+}
+
+func TestPushPolicyFastForwardUnknown(t *testing.T) {
+	pp := testPushPolicy()
+
+	// Pointing master at a commit the upstream already has sends an empty
+	// pack, leaving nothing to follow its history through
+	other := "3333333333333333333333333333333333333333"
+
+	ctx := testRefContext(ReceivePack, "alice", ClientToServer, PhaseCommand)
+	testPush(pp, ctx, oldID+" "+other+" refs/heads/master")
+
+	ctx.Phase = PhasePack
+	testRejection(t, pp.PackEnd(ctx), "refs/heads/master", "cannot verify fast-forward: history unknown to proxy")
+}
+
+func TestParseCommitParents(t *testing.T) {
+	p := ParseCommitParents([]byte("tree x\nparent " + oldID + "\nparent " + newID + "\nauthor a\n\nparent in message\n"))
+	if len(p) != 2 || p[0] != oldID || p[1] != newID {
+		t.Errorf("Bad parents: %v", p)
+	}
+}
+
+func TestPushRejectedErrorReport(t *testing.T) {
+	err := &PushRejectedError{
+		Updates:      []RefUpdate{{Old: oldID, New: newID, Name: "refs/heads/master"}, {Old: oldID, New: newID, Name: "refs/heads/topic"}},
+		Capabilities: ParseCapabilities("report-status side-band-64k"),
+		Reasons:      map[string]string{"refs/heads/master": "non-fast-forward"},
+		Messages:     []string{"master is protected"},
+	}
+
+	buf := &bytes.Buffer{}
+	ok, rerr := err.Report(buf, nil)
+	if !ok || rerr != nil {
+		t.Fatalf("Should report: %v", rerr)
+	}
+
+	progress := &bytes.Buffer{}
+	r := NewSidebandReader(buf)
+	r.Progress = progress
+	report := &bytes.Buffer{}
+	report.ReadFrom(r)
+
+	if progress.String() != "master is protected\n" {
+		t.Errorf("Bad messages: %q", progress.String())
+	}
+
+	s := report.String()
+	if !strings.Contains(s, "unpack ok\n") || !strings.Contains(s, "ng refs/heads/master non-fast-forward\n") || !strings.Contains(s, "ng refs/heads/topic rejected") {
+		t.Errorf("Bad report: %q", s)
+	}
+
+	err.Capabilities = nil
+	if ok, _ := err.Report(buf, buf); ok {
+		t.Errorf("Should not report without report-status")
+	}
+}
+
+func TestPushPolicyRenamedRef(t *testing.T) {
+	pp := NewPushPolicy()
+	pp.Branches = []BranchRule{{Pattern: "refs/heads/internal/master", DenyDelete: true}}
+
+	f := Chain{&RefFilter{Rules: []RefRule{{Pattern: "refs/heads/internal/*", Rename: "refs/heads/*"}}}, pp}
+
+	src := &bytes.Buffer{}
+	WritePktLine(src, []byte(oldID+" "+ZeroID+" refs/heads/master\x00report-status\n"))
+	WritePktLineFlush(src)
+
+	dst := &bytes.Buffer{}
+	err := testGitSpy(ReceivePack, f).proxyReceivePackRequest(dst, src)
+
+	// Rejected for the upstream's name, reported by the client's
+	testRejection(t, err, "refs/heads/master", "deletion prohibited")
+
+	if dst.Len() > 0 {
+		t.Errorf("Rejected commands were passed on: %q", dst.Bytes())
+	}
+}
@@ -0,0 +1,203 @@
+package gitspy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ZeroID is the object id git uses for a ref that does not exist, as in a
+// create or delete command.
+const ZeroID = "0000000000000000000000000000000000000000"
+
+var ErrInvalidCommand = errors.New("invalid ref update command")
+
+// A RefUpdate is a single command sent by the client to git-receive-pack
+// https://www.kernel.org/pub/software/scm/git/docs/technical/pack-protocol.html#_reference_update_request_and_packfile_transfer
+type RefUpdate struct {
+	Old  string
+	New  string
+	Name string
+}
+
+func (u RefUpdate) IsCreate() bool {
+	return u.Old == ZeroID
+}
+
+func (u RefUpdate) IsDelete() bool {
+	return u.New == ZeroID
+}
+
+func (u RefUpdate) String() string {
+	return fmt.Sprintf("%s %s %s", u.Old, u.New, u.Name)
+}
+
+// ParseRefUpdate parses a command pkt-line payload. The first command may
+// carry the client's capabilities after a NUL byte.
+func ParseRefUpdate(b []byte) (u RefUpdate, caps Capabilities, err error) {
+	b = bytes.TrimSuffix(b, []byte("\n"))
+
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		caps = ParseCapabilities(string(b[i+1:]))
+		b = b[:i]
+	}
+
+	f := strings.Fields(string(b))
+	if len(f) != 3 || len(f[0]) != len(ZeroID) || len(f[1]) != len(ZeroID) {
+		return u, nil, ErrInvalidCommand
+	}
+
+	u = RefUpdate{Old: f[0], New: f[1], Name: f[2]}
+	return
+}
+
+// needsPack reports whether a client sending these commands will follow them
+// with a packfile. Pure deletes do not.
+func needsPack(updates []RefUpdate) bool {
+	for _, u := range updates {
+		if !u.IsDelete() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// proxyReceivePackRequest forwards the client half of git-receive-pack: the
+// command list, any push options and the packfile. Commands are parsed as
+// the client sent them, before any filter sees them.
+func (gs *GitSpy) proxyReceivePackRequest(dst io.Writer, src io.Reader) error {
+	b := make([]byte, 65516)
+
+	var updates []RefUpdate
+	var caps Capabilities
+
+	for {
+		p, err := readPacket(src, b)
+		if err == io.EOF && len(updates) == 0 {
+			// Client hung up after the advertisement
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Failed parsing pkt: %v", err)
+		}
+
+		if p.Type == DataPkt && !bytes.HasPrefix(p.Data, []byte("shallow ")) {
+			u, c, err := ParseRefUpdate(p.Data)
+			if err != nil {
+				return fmt.Errorf("Failed parsing command '%s': %v", p.Data, err)
+			}
+
+			if len(updates) == 0 {
+				caps = c
+			}
+
+			updates = append(updates, u)
+		}
+
+		if p.Type == FlushPkt {
+			gs.setUpdates(updates, caps)
+		}
+
+		err = gs.send(dst, gs.context(ClientToServer, PhaseCommand), p)
+		if err != nil {
+			return err
+		}
+
+		if p.Type == FlushPkt {
+			break
+		}
+	}
+
+	if len(updates) > 0 && caps.Has("push-options") {
+		err := gs.proxyPkts(dst, src, ClientToServer, PhasePushOptions, false)
+		if err != nil {
+			return fmt.Errorf("Failed proxying push options: %v", err)
+		}
+	}
+
+	if !needsPack(updates) {
+		return nil
+	}
+
+	return gs.proxyPack(dst, src, ClientToServer)
+}
+
+// A PushRejectedError stops a push before the upstream applies any of it.
+// Reasons holds why refs were rejected; the other refs in the push are
+// rejected along with them.
+type PushRejectedError struct {
+	Updates      []RefUpdate
+	Capabilities Capabilities
+	Reasons      map[string]string
+
+	// Messages explain the rejection in more detail than fits in a reason
+	Messages []string
+}
+
+func (e *PushRejectedError) Error() string {
+	var msgs []string
+	for _, u := range e.Updates {
+		if r, ok := e.Reasons[u.Name]; ok {
+			msgs = append(msgs, u.Name+" "+r)
+		}
+	}
+
+	return "push rejected: " + strings.Join(msgs, ", ")
+}
+
+// Report writes the report-status the client asked for, with an "ng" line
+// for every ref. Messages go to the progress band, or stderr without
+// side-band. It returns false if the client did not ask for a report.
+func (e *PushRejectedError) Report(w, stderr io.Writer) (bool, error) {
+	if !e.Capabilities.Has("report-status") && !e.Capabilities.Has("report-status-v2") {
+		return false, nil
+	}
+
+	b := &bytes.Buffer{}
+	WritePktLine(b, []byte("unpack ok\n"))
+
+	for _, u := range e.Updates {
+		reason, ok := e.Reasons[u.Name]
+		if !ok {
+			reason = "rejected with the rest of the push"
+		}
+
+		WritePktLine(b, []byte(fmt.Sprintf("ng %s %s\n", u.Name, reason)))
+	}
+
+	WritePktLineFlush(b)
+
+	max := 0
+	if e.Capabilities.Has("side-band-64k") {
+		max = Sideband64kMax
+	} else if e.Capabilities.Has("side-band") {
+		max = SidebandMax
+	}
+
+	if max == 0 {
+		for _, m := range e.Messages {
+			fmt.Fprintln(stderr, m)
+		}
+
+		_, err := w.Write(b.Bytes())
+		return true, err
+	}
+
+	sw := NewSidebandWriter(w, max)
+
+	for _, m := range e.Messages {
+		err := sw.Progress(m + "\n")
+		if err != nil {
+			return true, err
+		}
+	}
+
+	_, err := sw.Write(b.Bytes())
+	if err != nil {
+		return true, err
+	}
+
+	return true, sw.Flush()
+}
@@ -0,0 +1,71 @@
+package gitspy
+
+import (
+	"bytes"
+	"testing"
+)
+
+const (
+	oldID = "1111111111111111111111111111111111111111"
+	newID = "2222222222222222222222222222222222222222"
+)
+
+func TestParseRefUpdate(t *testing.T) {
+	u, caps, err := ParseRefUpdate([]byte(oldID + " " + newID + " refs/heads/master\x00report-status side-band-64k\n"))
+	if err != nil {
+		t.Fatalf("Error from parse: %v", err)
+	}
+
+	if u.Old != oldID || u.New != newID || u.Name != "refs/heads/master" {
+		t.Errorf("Bad decode: %v", u)
+	}
+
+	if len(caps) != 2 || caps[0] != "report-status" {
+		t.Errorf("Bad capabilities: %v", caps)
+	}
+}
+
+func TestParseRefUpdateInvalid(t *testing.T) {
+	_, _, err := ParseRefUpdate([]byte("foo bar"))
+	if err != ErrInvalidCommand {
+		t.Errorf("Should be an invalid command: %v", err)
+	}
+}
+
+func TestProxyReceivePackRequest(t *testing.T) {
+	src := &bytes.Buffer{}
+	WritePktLine(src, []byte(oldID+" "+newID+" refs/heads/master\x00report-status\n"))
+	WritePktLine(src, []byte(newID+" "+ZeroID+" refs/heads/old\n"))
+	WritePktLineFlush(src)
+	src.WriteString("PACK\x00\x00\x00\x02\x00\x00\x00\x00checksum")
+
+	expected := append([]byte(nil), src.Bytes()...)
+
+	dst := &bytes.Buffer{}
+	err := testGitSpy(ReceivePack, nil).proxyReceivePackRequest(dst, src)
+	if err != nil {
+		t.Fatalf("Error from proxy: %v", err)
+	}
+
+	if !bytes.Equal(dst.Bytes(), expected) {
+		t.Errorf("Wrong output: %q", dst.Bytes())
+	}
+}
+
+func TestProxyReceivePackRequestDeleteOnly(t *testing.T) {
+	src := &bytes.Buffer{}
+	WritePktLine(src, []byte(oldID+" "+ZeroID+" refs/heads/old\x00report-status\n"))
+	WritePktLineFlush(src)
+
+	expected := append([]byte(nil), src.Bytes()...)
+
+	dst := &bytes.Buffer{}
+	err := testGitSpy(ReceivePack, nil).proxyReceivePackRequest(dst, src)
+	if err != nil {
+		t.Fatalf("Error from proxy: %v", err)
+	}
+
+	if !bytes.Equal(dst.Bytes(), expected) {
+		t.Errorf("Wrong output: %q", dst.Bytes())
+	}
+}
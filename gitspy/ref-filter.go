@@ -0,0 +1,480 @@
+package gitspy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// A RefRule hides the refs matching Pattern from the users it applies to, or
+// shows them under another name.
+type RefRule struct {
+	// Pattern matches ref names, * matching any characters including /
+	Pattern string `json:"pattern"`
+
+	// Rename shows matching refs under this name instead of hiding them. A *
+	// in it stands for whatever the * in Pattern matched.
+	Rename string `json:"rename,omitempty"`
+
+	// Users the rule applies to, a leading ! excluding a user. Without any
+	// the rule applies to everyone.
+	Users []string `json:"users,omitempty"`
+}
+
+// matchUsers reports whether user is in a list of user patterns, where a
+// leading ! excludes a user. An empty list includes everyone.
+func matchUsers(patterns []string, user string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	matched := false
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "!") {
+			if matchWildcard(p[1:], user) {
+				return false
+			}
+		} else if matchWildcard(p, user) {
+			matched = true
+		}
+	}
+
+	return matched
+}
+
+func (r *RefRule) appliesTo(user string) bool {
+	return matchUsers(r.Users, user)
+}
+
+// substituteRef matches name against pattern and returns replacement with
+// its * standing for what the * in pattern matched.
+func substituteRef(pattern, replacement, name string) (string, bool) {
+	i := strings.IndexByte(pattern, '*')
+	if i < 0 {
+		return replacement, pattern == name
+	}
+
+	prefix, suffix := pattern[:i], pattern[i+1:]
+	if len(name) < len(prefix)+len(suffix) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return "", false
+	}
+
+	return strings.Replace(replacement, "*", name[len(prefix):len(name)-len(suffix)], 1), true
+}
+
+// A RefFilter controls which refs each user can see, fetch and push. Refs
+// are hidden from the advertisement and ls-refs, and only wants for the tips
+// of refs the user can see are let through. Renamed refs are translated both
+// ways so clients only ever use the names they were shown.
+//
+// The refs a want is checked against are those the upstream advertised to
+// the session. When it has not listed them all, as with a v2 fetch sent
+// without an ls-refs before it or an ls-refs for only some prefixes, the
+// upstream is asked for the rest before a want it does not know of is
+// refused. As the proxy can't tell which commits a hidden ref reaches, wants
+// for any other commit are refused too, and the capabilities allowing them
+// are left out of the advertisement. Arguments to git archive are not
+// checked.
+type RefFilter struct {
+	Rules []RefRule
+}
+
+// refState is what a RefFilter learns about a session's refs.
+type refState struct {
+	// visible holds the tips, peeled or not, of refs the user can see
+	visible map[string]bool
+
+	// complete is set once every upstream ref is known
+	complete bool
+	lock     sync.Mutex
+
+	list    sync.Once
+	listErr error
+}
+
+func (s *refState) add(r Ref) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.visible[r.ID] = true
+	if r.Peeled != "" {
+		s.visible[r.Peeled] = true
+	}
+}
+
+func (s *refState) setComplete() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.complete = true
+}
+
+// isVisible reports whether id is the tip of a ref the user can see, and
+// whether every ref is known.
+func (s *refState) isVisible(id string) (visible, complete bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.visible[id], s.complete
+}
+
+func (f *RefFilter) state(ctx *FilterContext) *refState {
+	v, _ := ctx.State.LoadOrStore(f, &refState{visible: map[string]bool{}})
+	return v.(*refState)
+}
+
+// VisibleName returns the name user sees for the upstream ref name, or ""
+// if it is hidden from them.
+func (f *RefFilter) VisibleName(user, name string) string {
+	for i := range f.Rules {
+		r := &f.Rules[i]
+		if !r.appliesTo(user) {
+			continue
+		}
+
+		if s, ok := substituteRef(r.Pattern, r.Rename, name); ok {
+			return s
+		}
+	}
+
+	return name
+}
+
+// UpstreamName returns the upstream's name for a ref user named, or "" if
+// they may not use it.
+func (f *RefFilter) UpstreamName(user, name string) string {
+	for i := range f.Rules {
+		r := &f.Rules[i]
+		if !r.appliesTo(user) || r.Rename == "" {
+			continue
+		}
+
+		if s, ok := substituteRef(r.Rename, r.Pattern, name); ok {
+			return s
+		}
+	}
+
+	if f.VisibleName(user, name) != name {
+		return ""
+	}
+
+	return name
+}
+
+// upstreamPrefixes returns the ref-prefixes to ask the upstream for so an
+// ls-refs for prefix also lists renamed refs.
+func (f *RefFilter) upstreamPrefixes(user, prefix string) []string {
+	prefixes := []string{prefix}
+
+	for i := range f.Rules {
+		r := &f.Rules[i]
+		if !r.appliesTo(user) || r.Rename == "" {
+			continue
+		}
+
+		rp, pp := r.Rename, r.Pattern
+		if i := strings.IndexByte(rp, '*'); i >= 0 {
+			rp = rp[:i]
+		}
+
+		if i := strings.IndexByte(pp, '*'); i >= 0 {
+			pp = pp[:i]
+		}
+
+		if strings.HasPrefix(prefix, rp) {
+			prefixes = append(prefixes, pp+prefix[len(rp):])
+		} else if strings.HasPrefix(rp, prefix) {
+			prefixes = append(prefixes, pp)
+		}
+	}
+
+	return prefixes
+}
+
+// listRefs learns every ref from the upstream, for a session that has not
+// been told them all.
+func (f *RefFilter) listRefs(ctx *FilterContext, st *refState) error {
+	if ctx.Upstream == nil {
+		return fmt.Errorf("No upstream to list refs of")
+	}
+
+	s, adv, err := advertise(ctx.Upstream, ctx.Request)
+	if err != nil {
+		return err
+	}
+
+	hangUp(s)
+
+	for _, r := range adv.Refs {
+		if f.VisibleName(ctx.User, r.Name) != "" {
+			st.add(r)
+		}
+	}
+
+	st.setComplete()
+
+	return nil
+}
+
+func (f *RefFilter) FilterAdvertisement(ctx *FilterContext, a *Advertisement) error {
+	st := f.state(ctx)
+
+	// Only a v0 advertisement lists refs, all of them
+	if a.Version != 2 {
+		defer st.setComplete()
+	}
+
+	var refs []Ref
+	for _, r := range a.Refs {
+		name := f.VisibleName(ctx.User, r.Name)
+		if name != "" {
+			st.add(r)
+
+			r.Name = name
+			refs = append(refs, r)
+		}
+	}
+
+	a.Refs = refs
+
+	var caps Capabilities
+	for _, c := range a.Capabilities {
+		if c == "allow-tip-sha1-in-want" || c == "allow-reachable-sha1-in-want" {
+			continue
+		}
+
+		if strings.HasPrefix(c, "symref=") {
+			parts := strings.SplitN(c[len("symref="):], ":", 2)
+			if len(parts) != 2 {
+				continue
+			}
+
+			ref := f.VisibleName(ctx.User, parts[0])
+			target := f.VisibleName(ctx.User, parts[1])
+			if ref == "" || target == "" {
+				continue
+			}
+
+			c = "symref=" + ref + ":" + target
+		}
+
+		caps = append(caps, c)
+	}
+
+	a.Capabilities = caps
+
+	return nil
+}
+
+func (f *RefFilter) Filter(ctx *FilterContext, p Packet) ([]Packet, error) {
+	if p.Type != DataPkt {
+		return []Packet{p}, nil
+	}
+
+	var err error
+
+	switch {
+	case ctx.Direction == ClientToServer && ctx.Service == ReceivePack && ctx.Phase == PhaseCommand:
+		p.Data, err = f.filterRefUpdate(ctx, p.Data)
+	case ctx.Direction == ClientToServer && ctx.Command == CommandLsRefs:
+		return f.filterRefPrefix(ctx, p), nil
+	case ctx.Direction == ClientToServer:
+		p.Data, err = f.filterWant(ctx, p.Data)
+	case ctx.Service == ReceivePack:
+		p.Data = f.filterReport(ctx, p.Data)
+	case ctx.Command == CommandLsRefs:
+		p.Data = f.filterLsRefs(ctx, p.Data)
+		if p.Data == nil {
+			return nil, nil
+		}
+	case ctx.Command == CommandFetch && ctx.Phase == PhaseResponse:
+		p.Data = f.filterWantedRef(ctx, p.Data)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return []Packet{p}, nil
+}
+
+// filterRefPrefix asks the upstream for renamed refs under their own names.
+func (f *RefFilter) filterRefPrefix(ctx *FilterContext, p Packet) []Packet {
+	line := strings.TrimSuffix(string(p.Data), "\n")
+	if !strings.HasPrefix(line, "ref-prefix ") {
+		return []Packet{p}
+	}
+
+	var pkts []Packet
+	for _, prefix := range f.upstreamPrefixes(ctx.User, line[len("ref-prefix "):]) {
+		pkts = append(pkts, DataPacket([]byte("ref-prefix "+prefix+"\n")))
+	}
+
+	return pkts
+}
+
+// filterWant refuses wants for anything but visible tips and translates
+// want-refs.
+func (f *RefFilter) filterWant(ctx *FilterContext, b []byte) ([]byte, error) {
+	line := strings.TrimSuffix(string(b), "\n")
+	fields := strings.SplitN(line, " ", 3)
+
+	if len(fields) < 2 {
+		return b, nil
+	}
+
+	switch fields[0] {
+	case "want":
+		st := f.state(ctx)
+
+		visible, complete := st.isVisible(fields[1])
+		if !visible && !complete {
+			st.list.Do(func() { st.listErr = f.listRefs(ctx, st) })
+			if st.listErr != nil {
+				log.Printf("Failed to list refs of %s: %v", ctx.Repo, st.listErr)
+				return nil, fmt.Errorf("upload-pack: not our ref %s", fields[1])
+			}
+
+			visible, _ = st.isVisible(fields[1])
+		}
+
+		if !visible {
+			return nil, fmt.Errorf("upload-pack: not our ref %s", fields[1])
+		}
+	case "want-ref":
+		name := f.UpstreamName(ctx.User, fields[1])
+		if name == "" {
+			return nil, fmt.Errorf("unknown ref %s", fields[1])
+		}
+
+		return []byte("want-ref " + name + "\n"), nil
+	}
+
+	return b, nil
+}
+
+// filterRefUpdate translates the ref a push updates, refusing hidden ones.
+func (f *RefFilter) filterRefUpdate(ctx *FilterContext, b []byte) ([]byte, error) {
+	u, _, err := ParseRefUpdate(b)
+	if err != nil {
+		// shallow lines
+		return b, nil
+	}
+
+	name := f.UpstreamName(ctx.User, u.Name)
+	if name == "" {
+		return nil, fmt.Errorf("refusing to update hidden ref %s", u.Name)
+	}
+
+	rest := b[len(u.Old)+len(u.New)+len(u.Name)+2:]
+
+	return []byte(u.Old + " " + u.New + " " + name + string(rest)), nil
+}
+
+func (f *RefFilter) filterLsRefs(ctx *FilterContext, b []byte) []byte {
+	r, err := ParseLsRefsLine(b)
+	if err != nil {
+		return b
+	}
+
+	name := f.VisibleName(ctx.User, r.Name)
+	if name != "" && r.ID != "unborn" {
+		f.state(ctx).add(r)
+	}
+
+	if name == "" {
+		return nil
+	}
+
+	r.Name = name
+
+	if r.SymrefTarget != "" {
+		r.SymrefTarget = f.VisibleName(ctx.User, r.SymrefTarget)
+	}
+
+	return r.LsRefsLine()
+}
+
+// filterWantedRef translates the wanted-refs section of a fetch response.
+func (f *RefFilter) filterWantedRef(ctx *FilterContext, b []byte) []byte {
+	fields := strings.Fields(string(b))
+	if len(fields) != 2 || len(fields[0]) != len(ZeroID) {
+		return b
+	}
+
+	if _, err := hex.DecodeString(fields[0]); err != nil {
+		return b
+	}
+
+	name := f.VisibleName(ctx.User, fields[1])
+	if name == "" {
+		return b
+	}
+
+	return []byte(fields[0] + " " + name + "\n")
+}
+
+// filterReport translates the refs in a push's report-status, which is sent
+// as pkt-lines inside side-band data when side-band is in use.
+func (f *RefFilter) filterReport(ctx *FilterContext, b []byte) []byte {
+	if ctx.Phase != PhaseSideband {
+		return f.filterStatus(ctx, b)
+	}
+
+	band, data, err := ParseSideband(b)
+	if err != nil || band != BandData {
+		return b
+	}
+
+	out := &bytes.Buffer{}
+	out.WriteByte(BandData)
+
+	r := bytes.NewReader(data)
+	buf := make([]byte, len(data))
+
+	for r.Len() > 0 {
+		t, n, err := ReadPkt(r, buf)
+		if err != nil {
+			// Not a whole report, pass it on as it is
+			return b
+		}
+
+		if t == DataPkt {
+			WritePktLine(out, f.filterStatus(ctx, buf[0:n]))
+		} else {
+			WriteSpecialPkt(out, t)
+		}
+	}
+
+	return out.Bytes()
+}
+
+// filterStatus translates the ref in an "ok", "ng" or "option refname"
+// report-status line.
+func (f *RefFilter) filterStatus(ctx *FilterContext, b []byte) []byte {
+	line := strings.TrimSuffix(string(b), "\n")
+
+	var prefix string
+	switch {
+	case strings.HasPrefix(line, "ok "), strings.HasPrefix(line, "ng "):
+		prefix = line[:3]
+	case strings.HasPrefix(line, "option refname "):
+		prefix = "option refname "
+	default:
+		return b
+	}
+
+	rest := strings.SplitN(line[len(prefix):], " ", 2)
+
+	name := f.VisibleName(ctx.User, rest[0])
+	if name == "" {
+		return b
+	}
+
+	rest[0] = name
+
+	return []byte(prefix + strings.Join(rest, " ") + "\n")
+}
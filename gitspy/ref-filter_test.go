@@ -0,0 +1,230 @@
+package gitspy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func testRefFilter() *RefFilter {
+	return &RefFilter{Rules: []RefRule{
+		{Pattern: "refs/pull/*"},
+		{Pattern: "refs/heads/team-a/*", Users: []string{"*", "!alice"}},
+		{Pattern: "refs/heads/internal/*", Rename: "refs/heads/*", Users: []string{"bob"}},
+	}}
+}
+
+func testRefContext(service, user string, dir Direction, phase Phase) *FilterContext {
+	return &FilterContext{
+		Request:   &Request{Service: service, User: user},
+		Direction: dir,
+		Phase:     phase,
+		State:     &sync.Map{},
+	}
+}
+
+func TestRefFilterNames(t *testing.T) {
+	f := testRefFilter()
+
+	if f.VisibleName("alice", "refs/pull/1/head") != "" {
+		t.Errorf("Pull refs should be hidden")
+	}
+
+	if f.VisibleName("alice", "refs/heads/team-a/x") != "refs/heads/team-a/x" || f.VisibleName("bob", "refs/heads/team-a/x") != "" {
+		t.Errorf("Team refs should only be visible to alice")
+	}
+
+	if f.VisibleName("bob", "refs/heads/internal/x") != "refs/heads/x" {
+		t.Errorf("Bad rename: %s", f.VisibleName("bob", "refs/heads/internal/x"))
+	}
+
+	if f.UpstreamName("bob", "refs/heads/x") != "refs/heads/internal/x" {
+		t.Errorf("Bad upstream name: %s", f.UpstreamName("bob", "refs/heads/x"))
+	}
+
+	if f.UpstreamName("bob", "refs/pull/1/head") != "" {
+		t.Errorf("Should not use hidden refs")
+	}
+}
+
+func TestRefFilterAdvertisement(t *testing.T) {
+	f := testRefFilter()
+	ctx := testRefContext(UploadPack, "bob", ServerToClient, PhaseAdvertisement)
+
+	a := &Advertisement{
+		Refs: []Ref{
+			{ID: oldID, Name: "HEAD"},
+			{ID: oldID, Name: "refs/heads/internal/master"},
+			{ID: newID, Name: "refs/pull/1/head"},
+		},
+		Capabilities: ParseCapabilities("multi_ack allow-tip-sha1-in-want allow-reachable-sha1-in-want symref=HEAD:refs/heads/internal/master"),
+	}
+
+	err := f.FilterAdvertisement(ctx, a)
+	if err != nil {
+		t.Fatalf("Error from filter: %v", err)
+	}
+
+	if len(a.Refs) != 2 || a.Refs[1].Name != "refs/heads/master" {
+		t.Errorf("Bad refs: %v", a.Refs)
+	}
+
+	if a.Symrefs()["HEAD"] != "refs/heads/master" {
+		t.Errorf("Bad symrefs: %v", a.Capabilities)
+	}
+
+	if a.Capabilities.Has("allow-tip-sha1-in-want") || a.Capabilities.Has("allow-reachable-sha1-in-want") {
+		t.Errorf("Should not allow unadvertised wants: %v", a.Capabilities)
+	}
+
+	ctx.Direction, ctx.Phase = ClientToServer, PhaseNegotiation
+
+	_, err = f.Filter(ctx, DataPacket([]byte("want "+newID+" side-band-64k\n")))
+	if err == nil {
+		t.Errorf("Should refuse hidden want")
+	}
+
+	_, err = f.Filter(ctx, DataPacket([]byte("want 3333333333333333333333333333333333333333\n")))
+	if err == nil {
+		t.Errorf("Should refuse unadvertised want")
+	}
+
+	pkts, err := f.Filter(ctx, DataPacket([]byte("want "+oldID+"\n")))
+	if err != nil || len(pkts) != 1 {
+		t.Errorf("Should allow visible want: %v", err)
+	}
+}
+
+func TestRefFilterLsRefs(t *testing.T) {
+	f := testRefFilter()
+	ctx := testRefContext(UploadPack, "bob", ServerToClient, PhaseResponse)
+	ctx.Command = CommandLsRefs
+
+	pkts, _ := f.Filter(ctx, DataPacket([]byte(newID+" refs/pull/1/head\n")))
+	if len(pkts) != 0 {
+		t.Errorf("Should drop hidden ref: %q", pkts)
+	}
+
+	pkts, _ = f.Filter(ctx, DataPacket([]byte(oldID+" HEAD symref-target:refs/heads/internal/master\n")))
+	if len(pkts) != 1 || string(pkts[0].Data) != oldID+" HEAD symref-target:refs/heads/master\n" {
+		t.Errorf("Bad rename: %q", pkts)
+	}
+}
+
+func TestRefFilterRefPrefix(t *testing.T) {
+	f := testRefFilter()
+	ctx := testRefContext(UploadPack, "bob", ClientToServer, PhaseCommand)
+	ctx.Command = CommandLsRefs
+
+	pkts, _ := f.Filter(ctx, DataPacket([]byte("ref-prefix refs/heads/dev\n")))
+	if len(pkts) != 2 || string(pkts[1].Data) != "ref-prefix refs/heads/internal/dev\n" {
+		t.Errorf("Bad prefixes: %q", pkts)
+	}
+
+	pkts, _ = f.Filter(ctx, DataPacket([]byte("ref-prefix refs/\n")))
+	if len(pkts) != 2 || string(pkts[1].Data) != "ref-prefix refs/heads/internal/\n" {
+		t.Errorf("Bad prefixes: %q", pkts)
+	}
+}
+
+func TestRefFilterPush(t *testing.T) {
+	f := testRefFilter()
+	ctx := testRefContext(ReceivePack, "bob", ClientToServer, PhaseCommand)
+
+	pkts, err := f.Filter(ctx, DataPacket([]byte(oldID+" "+newID+" refs/heads/master\x00report-status\n")))
+	if err != nil {
+		t.Fatalf("Error from filter: %v", err)
+	}
+
+	if string(pkts[0].Data) != oldID+" "+newID+" refs/heads/internal/master\x00report-status\n" {
+		t.Errorf("Bad rename: %q", pkts[0].Data)
+	}
+
+	_, err = f.Filter(ctx, DataPacket([]byte(oldID+" "+newID+" refs/pull/1/head\n")))
+	if err == nil {
+		t.Errorf("Should refuse hidden ref")
+	}
+
+	// report-status inside side-band
+	report := &bytes.Buffer{}
+	WritePktLine(report, []byte("unpack ok\n"))
+	WritePktLine(report, []byte("ok refs/heads/internal/master\n"))
+	WritePktLineFlush(report)
+
+	expected := &bytes.Buffer{}
+	WritePktLine(expected, []byte("unpack ok\n"))
+	WritePktLine(expected, []byte("ok refs/heads/master\n"))
+	WritePktLineFlush(expected)
+
+	ctx.Direction, ctx.Phase = ServerToClient, PhaseSideband
+
+	pkts, _ = f.Filter(ctx, SidebandPacket(BandData, report.Bytes()))
+	if !bytes.Equal(pkts[0].Data[1:], expected.Bytes()) {
+		t.Errorf("Bad report: %q", pkts[0].Data)
+	}
+}
+
+func TestRefFilterFetchWithoutLsRefs(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "ref-filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	repo := filepath.Join(dir, "test.git")
+	commit := func(ref string) string {
+		testGit(t, "-C", repo, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", ref)
+		testGit(t, "-C", repo, "update-ref", ref, "HEAD")
+
+		out, _ := exec.Command("git", "-C", repo, "rev-parse", "HEAD").Output()
+		return strings.TrimSpace(string(out))
+	}
+
+	testGit(t, "init", "-q", repo)
+	visible := commit("refs/heads/master")
+	older := commit("refs/pull/1/head")
+	hidden := commit("refs/pull/1/head")
+	testGit(t, "-C", repo, "update-ref", "refs/heads/master", visible)
+
+	// The proxy refuses what the upstream would serve
+	testGit(t, "-C", repo, "config", "uploadpack.allowAnySHA1InWant", "true")
+
+	s := NewServer(nil, testRouter{&LocalUpstream{Dir: dir}})
+	s.Filter = &RefFilter{Rules: []RefRule{{Pattern: "refs/pull/*"}}}
+
+	fetch := func(id string) []byte {
+		client := &bytes.Buffer{}
+		WritePktLine(client, []byte("command=fetch\n"))
+		WriteSpecialPkt(client, DelimPkt)
+		WritePktLine(client, []byte("want "+id+"\n"))
+		WritePktLine(client, []byte("done\n"))
+		WritePktLineFlush(client)
+
+		// Hang up, as a client does with a flush in place of a command
+		WritePktLineFlush(client)
+
+		return testDaemon(s, "git-upload-pack /test.git\x00\x00version=2\x00", client.Bytes())
+	}
+
+	if out := fetch(hidden); bytes.Contains(out, []byte("PACK")) {
+		t.Errorf("Should refuse the hidden tip: %q", out)
+	}
+
+	if out := fetch(older); bytes.Contains(out, []byte("PACK")) {
+		t.Errorf("Should refuse an older commit of the hidden ref: %q", out)
+	}
+
+	if out := fetch(visible); !bytes.Contains(out, []byte("PACK")) {
+		t.Errorf("Should allow the visible tip: %q", out)
+	}
+}
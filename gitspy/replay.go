@@ -0,0 +1,300 @@
+package gitspy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Divergence is a difference between what a client sent and what was
+// recorded.
+type Divergence struct {
+	// Index of the transcript record the client diverged from
+	Record int
+
+	Expected string
+	Got      string
+}
+
+func (d Divergence) String() string {
+	return fmt.Sprintf("record %d: expected %s, got %s", d.Record, d.Expected, d.Got)
+}
+
+// A DivergenceError is returned by the Wait of a replayed session the
+// client diverged from.
+type DivergenceError struct {
+	Request     *Request
+	Divergences []Divergence
+}
+
+func (e *DivergenceError) Error() string {
+	return fmt.Sprintf("%s diverged from its recording: %s", e.Request, e.Divergences[0])
+}
+
+// replayExitError is returned by the Wait of a replayed session that was
+// recorded exiting with a failure.
+type replayExitError struct {
+	status uint32
+}
+
+func (e *replayExitError) Error() string {
+	return fmt.Sprintf("recorded exit status %d", e.status)
+}
+
+// A ReplayUpstream answers requests from recorded transcripts instead of a
+// real upstream. Each request is answered from the first transcript of the
+// same service, repository and protocol not yet replayed. Recorded server
+// output is sent as the recording goes, waiting at each record of the client
+// for the client to send the same thing.
+//
+// A client that sends something else is noted as diverging, and the replay
+// carries on. Recordings hold what clients sent before any filter, so
+// filters that rewrite requests should match those the recording was made
+// with. A ReplayUpstream is also a Router sending everything to itself.
+type ReplayUpstream struct {
+	transcripts [][]*TranscriptRecord
+	used        []bool
+
+	divergences []Divergence
+	lock        sync.Mutex
+}
+
+func NewReplayUpstream(transcripts ...[]*TranscriptRecord) *ReplayUpstream {
+	return &ReplayUpstream{transcripts: transcripts, used: make([]bool, len(transcripts))}
+}
+
+// LoadReplayUpstream loads every transcript in dir, in the order of their
+// names, which is the order they were recorded in.
+func LoadReplayUpstream(dir string) (*ReplayUpstream, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+
+	var transcripts [][]*TranscriptRecord
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open transcript: %v", err)
+		}
+
+		records, err := ReadTranscript(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load %s: %v", name, err)
+		}
+
+		if len(records) == 0 || records[0].Type != RecordSession {
+			return nil, fmt.Errorf("Failed to load %s: no session record", name)
+		}
+
+		transcripts = append(transcripts, records)
+	}
+
+	return NewReplayUpstream(transcripts...), nil
+}
+
+func (u *ReplayUpstream) Route(r *Request) (Upstream, error) {
+	return u, nil
+}
+
+// Divergences returns every divergence seen so far.
+func (u *ReplayUpstream) Divergences() []Divergence {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	return append([]Divergence(nil), u.divergences...)
+}
+
+func (u *ReplayUpstream) Start(r *Request) (UpstreamSession, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	for i, records := range u.transcripts {
+		s := records[0]
+		if u.used[i] || s.Service != r.Service || s.Repo != r.Repo || s.Protocol != r.Protocol {
+			continue
+		}
+
+		u.used[i] = true
+
+		return newReplaySession(u, r, records[1:]), nil
+	}
+
+	return nil, fmt.Errorf("No recording of %s", r)
+}
+
+func (u *ReplayUpstream) diverged(d Divergence) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.divergences = append(u.divergences, d)
+}
+
+type replaySession struct {
+	u       *ReplayUpstream
+	req     *Request
+	records []*TranscriptRecord
+
+	stdin  *io.PipeWriter
+	stdout *io.PipeReader
+	stderr *io.PipeReader
+
+	divergences []Divergence
+	exit        uint32
+
+	done chan struct{}
+}
+
+func newReplaySession(u *ReplayUpstream, r *Request, records []*TranscriptRecord) *replaySession {
+	s := &replaySession{u: u, req: r, records: records, done: make(chan struct{})}
+
+	stdin, stdinW := io.Pipe()
+	stdoutR, stdout := io.Pipe()
+	stderrR, stderr := io.Pipe()
+
+	s.stdin, s.stdout, s.stderr = stdinW, stdoutR, stderrR
+
+	go func() {
+		s.replay(stdin, stdout, stderr)
+
+		stdin.Close()
+		stdout.Close()
+		stderr.Close()
+		close(s.done)
+	}()
+
+	return s
+}
+
+// describeRecord returns a record as it would appear in a log.
+func describeRecord(typ string, b []byte) string {
+	if typ != RecordData && typ != RecordRaw {
+		return typ
+	}
+
+	if len(b) > 64 {
+		return fmt.Sprintf("%s %q... (%d bytes)", typ, b[:64], len(b))
+	}
+
+	return fmt.Sprintf("%s %q", typ, b)
+}
+
+func (s *replaySession) diverge(i int, expected, got string) {
+	d := Divergence{Record: i + 1, Expected: expected, Got: got}
+	log.Printf("Replay of %s diverged at %s", s.req, d)
+
+	s.divergences = append(s.divergences, d)
+	s.u.diverged(d)
+}
+
+// expect reads what the client sent for record i, returning false once the
+// client has hung up.
+func (s *replaySession) expect(i int, r *TranscriptRecord, stdin io.Reader, b []byte) bool {
+	want := r.Payload()
+
+	if r.Type == RecordRaw {
+		got := make([]byte, len(want))
+
+		n, err := io.ReadFull(stdin, got)
+		if !bytes.Equal(got[:n], want) {
+			s.diverge(i, describeRecord(RecordRaw, want), describeRecord(RecordRaw, got[:n]))
+		}
+
+		return err == nil
+	}
+
+	t, n, err := ReadPkt(stdin, b)
+	if err != nil {
+		s.diverge(i, describeRecord(r.Type, want), fmt.Sprintf("error %v", err))
+		return false
+	}
+
+	// Record types are named for the packet types
+	got := describeRecord(strings.ToLower(t.String()), b[:n])
+
+	if expected := describeRecord(r.Type, want); got != expected {
+		s.diverge(i, expected, got)
+	}
+
+	return true
+}
+
+func (s *replaySession) replay(stdin io.Reader, stdout, stderr io.Writer) {
+	b := make([]byte, 65516)
+	client := true
+
+	for i, r := range s.records {
+		var err error
+
+		switch {
+		case r.Type == RecordExit:
+			s.exit = r.Status
+		case r.Type == RecordStderr:
+			_, err = stderr.Write(r.Payload())
+		case r.Dir == ClientToServer.String():
+			if client {
+				client = s.expect(i, r, stdin, b)
+			}
+		case r.Dir == ServerToClient.String():
+			err = writeRecord(stdout, r)
+		}
+
+		if err != nil {
+			log.Printf("Replay of %s stopped: %v", s.req, err)
+			return
+		}
+	}
+}
+
+// writeRecord writes out a recorded record as it was received.
+func writeRecord(w io.Writer, r *TranscriptRecord) (err error) {
+	switch r.Type {
+	case RecordData:
+		_, err = WritePktLine(w, r.Payload())
+	case RecordFlush:
+		_, err = WriteSpecialPkt(w, FlushPkt)
+	case RecordDelim:
+		_, err = WriteSpecialPkt(w, DelimPkt)
+	case RecordResponseEnd:
+		_, err = WriteSpecialPkt(w, ResponseEndPkt)
+	case RecordRaw:
+		_, err = w.Write(r.Payload())
+	}
+
+	return
+}
+
+func (s *replaySession) Stdin() io.WriteCloser { return s.stdin }
+func (s *replaySession) Stdout() io.Reader     { return s.stdout }
+func (s *replaySession) Stderr() io.Reader     { return s.stderr }
+
+func (s *replaySession) Wait() error {
+	<-s.done
+
+	if len(s.divergences) > 0 {
+		return &DivergenceError{Request: s.req, Divergences: s.divergences}
+	}
+
+	if s.exit != 0 {
+		return &replayExitError{s.exit}
+	}
+
+	return nil
+}
+
+func (s *replaySession) Close() error {
+	s.stdout.Close()
+	s.stderr.Close()
+	s.stdin.Close()
+
+	return nil
+}
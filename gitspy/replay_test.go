@@ -0,0 +1,87 @@
+package gitspy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+// testRecording records a v0 fetch of one object
+func testRecording(t *testing.T) []*TranscriptRecord {
+	buf := &bytes.Buffer{}
+	req := &Request{ID: "abc", Service: UploadPack, Repo: "/test.git"}
+	tr := NewTranscript(nopWriteCloser{buf}, req)
+
+	server := &bytes.Buffer{}
+	WritePktLine(server, []byte(oldID+" refs/heads/master\n"))
+	WritePktLineFlush(server)
+	tr.Tap(ServerToClient).Write(server.Bytes())
+
+	client := &bytes.Buffer{}
+	WritePktLine(client, []byte("want "+oldID+"\n"))
+	WritePktLineFlush(client)
+	WritePktLine(client, []byte("done\n"))
+	tr.Tap(ClientToServer).Write(client.Bytes())
+
+	tr.Tap(ServerToClient).Write([]byte("0008NAK\nPACK"))
+	tr.Exit(0)
+
+	records, err := ReadTranscript(buf)
+	if err != nil {
+		t.Fatalf("Error from ReadTranscript: %v", err)
+	}
+
+	return records
+}
+
+func testReplay(t *testing.T, u *ReplayUpstream, want string) ([]byte, error) {
+	s, err := u.Start(&Request{Service: UploadPack, Repo: "/test.git"})
+	if err != nil {
+		t.Fatalf("Error from Start: %v", err)
+	}
+
+	go func() {
+		WritePktLine(s.Stdin(), []byte(want))
+		WritePktLineFlush(s.Stdin())
+		WritePktLine(s.Stdin(), []byte("done\n"))
+		s.Stdin().Close()
+	}()
+
+	go ioutil.ReadAll(s.Stderr())
+
+	out, _ := ioutil.ReadAll(s.Stdout())
+
+	return out, s.Wait()
+}
+
+func TestReplayUpstream(t *testing.T) {
+	u := NewReplayUpstream(testRecording(t))
+
+	out, err := testReplay(t, u, "want "+oldID+"\n")
+	if err != nil {
+		t.Errorf("Error from Wait: %v", err)
+	}
+
+	if !bytes.HasSuffix(out, []byte("00000008NAK\nPACK")) || !bytes.Contains(out, []byte("refs/heads/master")) {
+		t.Errorf("Bad replay: %q", out)
+	}
+
+	if _, err := u.Start(&Request{Service: UploadPack, Repo: "/test.git"}); err == nil {
+		t.Errorf("Recording should only be replayed once")
+	}
+}
+
+func TestReplayUpstreamDivergence(t *testing.T) {
+	u := NewReplayUpstream(testRecording(t))
+
+	_, err := testReplay(t, u, "want "+newID+"\n")
+
+	derr, ok := err.(*DivergenceError)
+	if !ok || len(derr.Divergences) != 1 || derr.Divergences[0].Record != 3 {
+		t.Fatalf("Should diverge at the want: %v", err)
+	}
+
+	if len(u.Divergences()) != 1 {
+		t.Errorf("Upstream should note divergences: %v", u.Divergences())
+	}
+}
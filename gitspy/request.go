@@ -0,0 +1,141 @@
+package gitspy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrUnknownService = errors.New("unknown service")
+
+var services = []string{UploadPack, ReceivePack, UploadArchive}
+
+// A Request is a git service a client asked the proxy to run against a
+// repository.
+type Request struct {
+	// ID identifies the session in logs, transcripts and audit records
+	ID string
+
+	Service string
+	Repo    string
+
+	// Protocol is the client's GIT_PROTOCOL, such as "version=2"
+	Protocol string
+
+	// User is the authenticated identity of the client
+	User string
+
+	// RemoteAddr is where the client connected from
+	RemoteAddr string
+
+	// Stateless is set when the client sends each request of a session on
+	// its own, as over smart HTTP, hanging up after each reply
+	Stateless bool
+}
+
+// newSessionID returns a random id for a Request.
+func newSessionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// Version returns the protocol version the client asked for.
+func (r *Request) Version() int {
+	v := 0
+
+	for _, p := range strings.Split(r.Protocol, ":") {
+		switch p {
+		case "version=1":
+			v = 1
+		case "version=2":
+			v = 2
+		}
+	}
+
+	return v
+}
+
+// Command returns the request as the command line a git client would send
+// over ssh.
+func (r *Request) Command() string {
+	return fmt.Sprintf("%s %s", r.Service, quoteArg(r.Repo))
+}
+
+func (r *Request) String() string {
+	return r.Command()
+}
+
+// ParseCommand parses an exec command such as "git-upload-pack 'foo/bar.git'"
+func ParseCommand(cmd string) (*Request, error) {
+	i := strings.IndexByte(cmd, ' ')
+	if i < 0 {
+		return nil, ErrUnknownService
+	}
+
+	r := &Request{Service: cmd[:i]}
+	if !isService(r.Service) {
+		return nil, ErrUnknownService
+	}
+
+	repo, err := unquoteArg(strings.TrimSpace(cmd[i+1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	if repo == "" {
+		return nil, fmt.Errorf("Missing repository in '%s'", cmd)
+	}
+
+	r.Repo = repo
+
+	return r, nil
+}
+
+func isService(name string) bool {
+	for _, s := range services {
+		if s == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// quoteArg quotes s for a shell the way git's sq_quote does.
+func quoteArg(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// unquoteArg reverses quoteArg. Unquoted arguments are returned as is.
+func unquoteArg(s string) (string, error) {
+	if !strings.HasPrefix(s, "'") {
+		return s, nil
+	}
+
+	var b strings.Builder
+
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\'':
+			quoted = !quoted
+		case !quoted && s[i] == '\\' && i+1 < len(s):
+			i++
+			b.WriteByte(s[i])
+		case !quoted:
+			return "", fmt.Errorf("Invalid quoting in '%s'", s)
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+
+	if quoted {
+		return "", fmt.Errorf("Unterminated quote in '%s'", s)
+	}
+
+	return b.String(), nil
+}
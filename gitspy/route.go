@@ -0,0 +1,146 @@
+package gitspy
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var ErrNoRoute = errors.New("no route to upstream")
+
+// A Router decides which upstream serves a request.
+type Router interface {
+	Route(r *Request) (Upstream, error)
+}
+
+// A Route sends repositories under Prefix to an upstream ssh server, or to
+// a smart HTTP server when URL is set. Prefix matches whole path segments:
+// "gitlab" and "gitlab/" both match "gitlab/repo.git" but not
+// "gitlab-old/repo.git". When StripPrefix is set the prefix
+// is removed from the repository path before it is sent upstream, so
+// "gitlab/team/repo.git" can become "team/repo.git".
+type Route struct {
+	Prefix      string
+	StripPrefix bool
+
+	Host    string
+	Port    int
+	User    string
+	KeyFile string
+
+	HostKeyCallback ssh.HostKeyCallback
+
+	URL         string
+	Credentials *Credentials
+}
+
+func (rt Route) matches(repo string) bool {
+	prefix := strings.TrimSuffix(rt.Prefix, "/")
+	if prefix == "" {
+		return true
+	}
+
+	return repo == prefix || strings.HasPrefix(repo, prefix+"/")
+}
+
+func (rt Route) Upstream() Upstream {
+	var u Upstream
+
+	if rt.URL != "" {
+		u = &HTTPUpstream{URL: rt.URL, Credentials: rt.Credentials}
+	} else {
+		u = rt.sshUpstream()
+	}
+
+	if rt.StripPrefix && rt.Prefix != "" {
+		u = &prefixUpstream{u, rt.Prefix}
+	}
+
+	return u
+}
+
+func (rt Route) sshUpstream() Upstream {
+	port := rt.Port
+	if port == 0 {
+		port = 22
+	}
+
+	user := rt.User
+	if user == "" {
+		user = "git"
+	}
+
+	return &SSHUpstream{
+		Host:            rt.Host,
+		Port:            port,
+		User:            user,
+		KeyFile:         rt.KeyFile,
+		HostKeyCallback: rt.HostKeyCallback,
+	}
+}
+
+// A RouteTable is a Router choosing the route with the longest matching
+// prefix.
+type RouteTable []Route
+
+// WithHostKeyCallback returns a copy of t checking host keys with f on
+// routes that don't have their own callback.
+func (t RouteTable) WithHostKeyCallback(f ssh.HostKeyCallback) RouteTable {
+	nt := make(RouteTable, len(t))
+	copy(nt, t)
+
+	for i := range nt {
+		if nt[i].HostKeyCallback == nil {
+			nt[i].HostKeyCallback = f
+		}
+	}
+
+	return nt
+}
+
+// DefaultRoutes sends everything to GitHub.
+var DefaultRoutes = RouteTable{{Host: "github.com", Port: 22, User: "git"}}
+
+func (t RouteTable) Route(r *Request) (Upstream, error) {
+	repo := strings.TrimPrefix(r.Repo, "/")
+
+	var best *Route
+	for i := range t {
+		if t[i].matches(repo) && (best == nil || len(t[i].Prefix) > len(best.Prefix)) {
+			best = &t[i]
+		}
+	}
+
+	if best == nil {
+		return nil, ErrNoRoute
+	}
+
+	return best.Upstream(), nil
+}
+
+// prefixUpstream removes a routing prefix from the repository path.
+type prefixUpstream struct {
+	Upstream
+	prefix string
+}
+
+func (p *prefixUpstream) strip(r *Request) *Request {
+	nr := *r
+	nr.Repo = strings.TrimPrefix(strings.TrimPrefix(r.Repo, "/"), p.prefix)
+
+	return &nr
+}
+
+func (p *prefixUpstream) Start(r *Request) (UpstreamSession, error) {
+	return p.Upstream.Start(p.strip(r))
+}
+
+func (p *prefixUpstream) location(r *Request) string {
+	lu, ok := p.Upstream.(locatedUpstream)
+	if !ok {
+		return ""
+	}
+
+	return lu.location(p.strip(r))
+}
@@ -0,0 +1,89 @@
+package gitspy
+
+import (
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	r, err := ParseCommand("git-upload-pack '/rhettg/it'\\''s.git'")
+	if err != nil {
+		t.Fatalf("Error from parse: %v", err)
+	}
+
+	if r.Service != UploadPack || r.Repo != "/rhettg/it's.git" {
+		t.Errorf("Bad decode: %#v", r)
+	}
+
+	rt, err := ParseCommand(r.Command())
+	if err != nil || rt.Repo != r.Repo {
+		t.Errorf("Command did not round trip: %s", r.Command())
+	}
+}
+
+func TestParseCommandUnknown(t *testing.T) {
+	_, err := ParseCommand("rm -rf /")
+	if err != ErrUnknownService {
+		t.Errorf("Should be an unknown service: %v", err)
+	}
+}
+
+func TestRouteTable(t *testing.T) {
+	table := RouteTable{
+		{Host: "github.com"},
+		{Prefix: "gitlab/", StripPrefix: true, Host: "gitlab.internal", Port: 2222, User: "deploy"},
+	}
+
+	u, err := table.Route(&Request{Service: UploadPack, Repo: "/gitlab/team/repo.git"})
+	if err != nil {
+		t.Fatalf("Error from route: %v", err)
+	}
+
+	p, ok := u.(*prefixUpstream)
+	if !ok {
+		t.Fatalf("Expected prefix stripping upstream: %#v", u)
+	}
+
+	su := p.Upstream.(*SSHUpstream)
+	if su.Host != "gitlab.internal" || su.Port != 2222 || su.User != "deploy" {
+		t.Errorf("Wrong upstream: %#v", su)
+	}
+
+	u, err = table.Route(&Request{Service: UploadPack, Repo: "rhettg/git-spy.git"})
+	if err != nil {
+		t.Fatalf("Error from route: %v", err)
+	}
+
+	su = u.(*SSHUpstream)
+	if su.Host != "github.com" || su.Port != 22 || su.User != "git" {
+		t.Errorf("Wrong default upstream: %#v", su)
+	}
+}
+
+func TestRouteTableNoRoute(t *testing.T) {
+	table := RouteTable{{Prefix: "gitlab/", Host: "gitlab.internal"}}
+
+	_, err := table.Route(&Request{Service: UploadPack, Repo: "rhettg/git-spy.git"})
+	if err != ErrNoRoute {
+		t.Errorf("Should be no route: %v", err)
+	}
+}
+
+func TestRouteMatches(t *testing.T) {
+	for _, c := range []struct {
+		prefix, repo string
+		want         bool
+	}{
+		{"gitlab/", "gitlab/repo.git", true},
+		{"gitlab", "gitlab/repo.git", true},
+		{"gitlab", "gitlab", true},
+		{"gitlab/team", "gitlab/team/repo.git", true},
+		{"gitlab/", "gitlab-old/repo.git", false},
+		{"gitlab", "gitlab-old/repo.git", false},
+		{"gitlab/team", "gitlab/teams/repo.git", false},
+		{"", "anything.git", true},
+	} {
+		if got := (Route{Prefix: c.prefix}).matches(c.repo); got != c.want {
+			t.Errorf("Prefix %q matching %q: %v", c.prefix, c.repo, got)
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package gitspy
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+)
+
+// A SecretRule describes text that should never be pushed.
+type SecretRule struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+
+	// MinEntropy is the Shannon entropy, in bits per character, the match
+	// must have to count, or its first group if the pattern has one. It
+	// tells random keys from placeholders like "changeme".
+	MinEntropy float64 `json:"min_entropy,omitempty"`
+}
+
+// DefaultSecretRules catch the most common credentials.
+var DefaultSecretRules = []SecretRule{
+	{Name: "AWS access key", Pattern: `\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`},
+	{Name: "AWS secret key", Pattern: `(?i)aws.{0,20}?(?:secret|key).{0,20}?['"=:\s]([A-Za-z0-9/+]{40})\b`, MinEntropy: 4},
+	{Name: "private key", Pattern: `-----BEGIN (?:RSA |DSA |EC |OPENSSH |PGP |ENCRYPTED )?PRIVATE KEY(?: BLOCK)?-----`},
+	{Name: "GitHub token", Pattern: `\bgh[pousr]_[A-Za-z0-9]{36,}\b`},
+	{Name: "Slack token", Pattern: `\bxox[abposr]-[A-Za-z0-9-]{10,}`},
+	{Name: "Google API key", Pattern: `\bAIza[0-9A-Za-z_-]{35}\b`},
+	{Name: "Stripe key", Pattern: `\b[rs]k_live_[0-9A-Za-z]{24,}\b`},
+	{Name: "high entropy secret", Pattern: `(?i)(?:secret|password|passwd|token|api_?key|access_?key)\w*['"]?\s*[:=]\s*['"]?([A-Za-z0-9+/=_.-]{20,})`, MinEntropy: 4},
+}
+
+// maxSecretMessages limits how many findings are listed to the client.
+const maxSecretMessages = 20
+
+// binaryCheckSize is how much of the start of a blob is looked at to decide
+// whether it is binary, as git does.
+const binaryCheckSize = 8000
+
+// secretOverlap is how much of the end of each piece of a large blob is
+// scanned again with the next, so matches spanning pieces are found.
+const secretOverlap = 4096
+
+var newline = []byte("\n")
+
+type secretRule struct {
+	SecretRule
+	re *regexp.Regexp
+}
+
+// entropy returns the Shannon entropy of b in bits per character.
+func entropy(b []byte) float64 {
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+
+	var e float64
+	for _, n := range counts {
+		if n == 0 {
+			continue
+		}
+
+		p := float64(n) / float64(len(b))
+		e -= p * math.Log2(p)
+	}
+
+	return e
+}
+
+// A SecretFinding is a match of a SecretRule in a pushed object.
+type SecretFinding struct {
+	Rule string
+
+	// Blob holding the match, "" for a delta against an object the pack
+	// does not hold
+	Blob string
+	Line int
+
+	// Path and Commit, once found in the pushed trees
+	Path   string
+	Commit string
+}
+
+func (f SecretFinding) String() string {
+	where := "a delta against an unknown object"
+	if f.Path != "" {
+		where = fmt.Sprintf("%s:%d", f.Path, f.Line)
+	} else if f.Blob != "" {
+		where = fmt.Sprintf("blob %s:%d", f.Blob, f.Line)
+	}
+
+	if f.Commit != "" {
+		where += " in commit " + f.Commit
+	}
+
+	return f.Rule + " found in " + where
+}
+
+// A SecretScanner is a filter rejecting pushes that add blobs matching any
+// of its rules, telling the client which file and commit each match was in.
+// Like every PackFilter it sees pushed packs before any of them is passed
+// on to the upstream.
+//
+// Clients are asked not to send thin packs, so every delta can be resolved
+// and every file located. Deltas a client sends against objects the upstream
+// already has anyway are scanned as they are, which finds secrets in the text
+// they add, as are deltas too large to resolve. Blobs larger than the pack
+// decoder keeps are scanned a piece at a time as they are inflated. Binary
+// blobs are not scanned.
+type SecretScanner struct {
+	rules []secretRule
+}
+
+func NewSecretScanner(rules []SecretRule) (*SecretScanner, error) {
+	s := &SecretScanner{}
+
+	for _, r := range rules {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to compile secret rule %s: %v", r.Name, err)
+		}
+
+		s.rules = append(s.rules, secretRule{r, re})
+	}
+
+	return s, nil
+}
+
+// isBinary reports whether a blob starting with b is binary, as git
+// decides it.
+func isBinary(b []byte) bool {
+	if len(b) > binaryCheckSize {
+		b = b[:binaryCheckSize]
+	}
+
+	return bytes.IndexByte(b, 0) >= 0
+}
+
+// find calls found with the rule and start of every match in b.
+func (s *SecretScanner) find(b []byte, found func(rule string, start int)) {
+	for _, r := range s.rules {
+		for _, m := range r.re.FindAllSubmatchIndex(b, -1) {
+			match := b[m[0]:m[1]]
+			if len(m) > 2 && m[2] >= 0 {
+				match = b[m[2]:m[3]]
+			}
+
+			if r.MinEntropy > 0 && entropy(match) < r.MinEntropy {
+				continue
+			}
+
+			found(r.Name, m[0])
+		}
+	}
+}
+
+// Scan returns the matches in b, a blob's contents.
+func (s *SecretScanner) Scan(b []byte) []SecretFinding {
+	if isBinary(b) {
+		return nil
+	}
+
+	var found []SecretFinding
+
+	s.find(b, func(rule string, start int) {
+		found = append(found, SecretFinding{Rule: rule, Line: bytes.Count(b[:start], newline) + 1})
+	})
+
+	return found
+}
+
+// A secretStream scans an object too large to be kept, a piece at a time.
+type secretStream struct {
+	// offset of the object in the pack, read how much of it has been seen
+	offset int64
+	read   int64
+
+	// pending is what is still to be scanned with the next piece: the
+	// overlap, or the start of the blob until it is known to be text.
+	// lines counts the lines before it.
+	pending []byte
+	lines   int
+
+	started  bool
+	binary   bool
+	findings []SecretFinding
+}
+
+// scan adds the next piece of an object of size bytes. Matches starting in
+// the overlap are left for the next piece, which sees them whole.
+func (ss *secretStream) scan(s *SecretScanner, b []byte, size int64) {
+	ss.read += int64(len(b))
+	last := ss.read >= size
+
+	ss.pending = append(ss.pending, b...)
+
+	if !ss.started {
+		if len(ss.pending) < binaryCheckSize && !last {
+			return
+		}
+
+		ss.started = true
+		ss.binary = isBinary(ss.pending)
+	}
+
+	if ss.binary {
+		ss.pending = nil
+		return
+	}
+
+	end := len(ss.pending) - secretOverlap
+	if last {
+		end = len(ss.pending)
+	}
+
+	if end <= 0 {
+		return
+	}
+
+	w := ss.pending
+
+	s.find(w, func(rule string, start int) {
+		if start < end {
+			ss.findings = append(ss.findings, SecretFinding{Rule: rule, Line: ss.lines + bytes.Count(w[:start], newline) + 1})
+		}
+	})
+
+	ss.lines += bytes.Count(w[:end], newline)
+	ss.pending = append([]byte(nil), w[end:]...)
+}
+
+// secretState is what a SecretScanner learns about a push. Blobs are
+// scanned as they arrive and only kept by objects as delta bases.
+type secretState struct {
+	objects  *PackResolver
+	stream   *secretStream
+	commits  []string
+	findings []SecretFinding
+}
+
+func (st *secretState) Close() error {
+	return st.objects.Close()
+}
+
+func (s *SecretScanner) state(ctx *FilterContext) *secretState {
+	v, _ := ctx.State.LoadOrStore(s, &secretState{objects: NewPackResolver(ObjectCommit, ObjectTree, ObjectBlob)})
+	return v.(*secretState)
+}
+
+// FilterAdvertisement asks pushing clients for packs without deltas against
+// objects outside them.
+func (s *SecretScanner) FilterAdvertisement(ctx *FilterContext, a *Advertisement) error {
+	if ctx.Service == ReceivePack && !a.Capabilities.Has("no-thin") {
+		a.Capabilities = append(a.Capabilities, "no-thin")
+	}
+
+	return nil
+}
+
+// Filter passes every packet; a SecretScanner only looks at packs.
+func (s *SecretScanner) Filter(ctx *FilterContext, p Packet) ([]Packet, error) {
+	return []Packet{p}, nil
+}
+
+// PackData scans large blobs, and deltas that can't be resolved for being
+// too large, as they arrive.
+func (s *SecretScanner) PackData(ctx *FilterContext, o *PackObject, b []byte) error {
+	if ctx.Service != ReceivePack || ctx.Direction != ClientToServer {
+		return nil
+	}
+
+	if o.Type != ObjectBlob && !o.Type.IsDelta() {
+		return nil
+	}
+
+	st := s.state(ctx)
+	if st.stream == nil || st.stream.offset != o.Offset {
+		st.stream = &secretStream{offset: o.Offset}
+	}
+
+	st.stream.scan(s, b, o.Size)
+
+	return nil
+}
+
+func (s *SecretScanner) PackObject(ctx *FilterContext, o *PackObject) error {
+	if ctx.Service != ReceivePack || ctx.Direction != ClientToServer {
+		return nil
+	}
+
+	st := s.state(ctx)
+
+	if o.Data == nil {
+		// Scanned by PackData, now the blob's id is known
+		if ss := st.stream; ss != nil && ss.offset == o.Offset {
+			for _, f := range ss.findings {
+				f.Blob = o.ID
+				st.findings = append(st.findings, f)
+			}
+
+			st.stream = nil
+		}
+
+		return nil
+	}
+
+	ro, ok := st.objects.Resolve(o)
+	if !ok {
+		// Scan what the delta adds to its base
+		st.findings = append(st.findings, s.Scan(o.Data)...)
+		return nil
+	}
+
+	switch ro.Type {
+	case ObjectBlob:
+		for _, f := range s.Scan(ro.Data) {
+			f.Blob = ro.ID
+			st.findings = append(st.findings, f)
+		}
+	case ObjectCommit:
+		st.commits = append(st.commits, ro.ID)
+	}
+
+	return nil
+}
+
+// PackEnd rejects the push if anything was found, once it has worked out
+// where.
+func (s *SecretScanner) PackEnd(ctx *FilterContext) error {
+	if ctx.Service != ReceivePack || ctx.Direction != ClientToServer {
+		return nil
+	}
+
+	st := s.state(ctx)
+	if len(st.findings) == 0 {
+		return nil
+	}
+
+	s.locate(st)
+
+	err := &PushRejectedError{Updates: ctx.Updates, Capabilities: ctx.PushCapabilities, Reasons: map[string]string{}}
+
+	for _, u := range ctx.Updates {
+		if !u.IsDelete() {
+			err.Reasons[u.Name] = "secrets found"
+		}
+	}
+
+	for i, f := range st.findings {
+		if i == maxSecretMessages {
+			err.Messages = append(err.Messages, fmt.Sprintf("... and %d more", len(st.findings)-i))
+			break
+		}
+
+		err.Messages = append(err.Messages, f.String())
+	}
+
+	return err
+}
+
+// locate fills in the path and commit of each finding from the pushed
+// trees. Packs list newer commits first, so commits are walked oldest first
+// to name the commit that added a file.
+func (s *SecretScanner) locate(st *secretState) {
+	type location struct{ path, commit string }
+
+	wanted := map[string]bool{}
+	for _, f := range st.findings {
+		wanted[f.Blob] = true
+	}
+
+	found := map[string]location{}
+	seen := map[string]bool{}
+
+	var walk func(tree, prefix, commit string)
+	walk = func(tree, prefix, commit string) {
+		if seen[tree] {
+			return
+		}
+
+		seen[tree] = true
+
+		o, ok := st.objects.Object(tree)
+		if !ok {
+			return
+		}
+
+		entries, err := ParseTree(o.Data)
+		if err != nil {
+			return
+		}
+
+		for _, e := range entries {
+			if e.IsTree() {
+				walk(e.ID, prefix+e.Name+"/", commit)
+			} else if _, ok := found[e.ID]; wanted[e.ID] && !ok {
+				found[e.ID] = location{prefix + e.Name, commit}
+			}
+		}
+	}
+
+	for i := len(st.commits) - 1; i >= 0; i-- {
+		o, _ := st.objects.Object(st.commits[i])
+		walk(ParseCommitTree(o.Data), "", st.commits[i])
+	}
+
+	for i := range st.findings {
+		if l, ok := found[st.findings[i].Blob]; ok {
+			st.findings[i].Path = l.path
+			st.findings[i].Commit = l.commit
+		}
+	}
+}
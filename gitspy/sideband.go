@@ -0,0 +1,196 @@
+package gitspy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Side-band channels used by git-upload-archive, and by upload-pack and
+// receive-pack when side-band or side-band-64k is negotiated.
+// https://www.kernel.org/pub/software/scm/git/docs/technical/protocol-capabilities.html#_side_band_side_band_64k
+const (
+	BandData     byte = 1
+	BandProgress byte = 2
+	BandError    byte = 3
+)
+
+// Largest pkt-line, including its length, allowed with side-band and
+// side-band-64k.
+const (
+	SidebandMax    = 1000
+	Sideband64kMax = 65520
+)
+
+var ErrInvalidBand = errors.New("invalid side-band channel")
+
+// A SidebandError is a message the remote sent on the error channel.
+type SidebandError string
+
+func (e SidebandError) Error() string {
+	return "remote error: " + string(e)
+}
+
+// ParseSideband splits a side-band pkt-line payload into its channel and
+// data.
+func ParseSideband(b []byte) (band byte, data []byte, err error) {
+	if len(b) == 0 || b[0] < BandData || b[0] > BandError {
+		return 0, nil, ErrInvalidBand
+	}
+
+	return b[0], b[1:], nil
+}
+
+// isSideband reports whether p looks like side-band multiplexed data.
+func isSideband(p Packet) bool {
+	if p.Type != DataPkt {
+		return false
+	}
+
+	_, _, err := ParseSideband(p.Data)
+	return err == nil
+}
+
+// SidebandPacket builds a packet carrying b on band. b must fit in a single
+// pkt-line of the negotiated size.
+func SidebandPacket(band byte, b []byte) Packet {
+	return DataPacket(append([]byte{band}, b...))
+}
+
+// ProgressPacket builds a packet the client shows as "remote: msg". Filters
+// may return it from any packet in PhaseSideband to talk to the user.
+func ProgressPacket(msg string) Packet {
+	if !strings.HasSuffix(msg, "\n") {
+		msg += "\n"
+	}
+
+	return SidebandPacket(BandProgress, []byte(msg))
+}
+
+// ErrorPacket builds a packet the client reports as a fatal remote error.
+func ErrorPacket(msg string) Packet {
+	if !strings.HasSuffix(msg, "\n") {
+		msg += "\n"
+	}
+
+	return SidebandPacket(BandError, []byte(msg))
+}
+
+// A SidebandReader demultiplexes a side-band stream. Read returns the data
+// channel up to the flush packet that ends it, progress messages are copied
+// to Progress and an error message ends the stream with a SidebandError.
+type SidebandReader struct {
+	// Progress receives progress messages. They are dropped if it is nil.
+	Progress io.Writer
+
+	r   io.Reader
+	b   []byte
+	buf []byte
+	err error
+}
+
+func NewSidebandReader(r io.Reader) *SidebandReader {
+	return &SidebandReader{r: r, b: make([]byte, Sideband64kMax)}
+}
+
+func (s *SidebandReader) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+
+		n, err := ParsePktLine(s.r, s.b)
+		if err == ErrFlushPkt {
+			s.err = io.EOF
+			continue
+		} else if err == io.EOF {
+			s.err = io.ErrUnexpectedEOF
+			continue
+		} else if err != nil {
+			s.err = err
+			continue
+		}
+
+		band, data, err := ParseSideband(s.b[0:n])
+		if err != nil {
+			s.err = err
+			continue
+		}
+
+		switch band {
+		case BandData:
+			s.buf = data
+		case BandProgress:
+			if s.Progress != nil {
+				s.Progress.Write(data)
+			}
+		case BandError:
+			s.err = SidebandError(bytes.TrimRight(data, "\n"))
+		}
+	}
+
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+
+	return n, nil
+}
+
+// A SidebandWriter multiplexes data, progress and error messages onto w in
+// pkt-lines no larger than max.
+type SidebandWriter struct {
+	w   io.Writer
+	max int
+}
+
+// NewSidebandWriter creates a writer for pkt-lines of at most max bytes,
+// SidebandMax or Sideband64kMax depending on what was negotiated.
+func NewSidebandWriter(w io.Writer, max int) *SidebandWriter {
+	return &SidebandWriter{w: w, max: max}
+}
+
+// Write sends p on the data channel.
+func (s *SidebandWriter) Write(p []byte) (int, error) {
+	return s.WriteBand(BandData, p)
+}
+
+// WriteBand sends p on band, split over as many pkt-lines as it needs.
+func (s *SidebandWriter) WriteBand(band byte, p []byte) (int, error) {
+	chunk := s.max - 5
+	n := 0
+
+	for len(p) > 0 {
+		c := p
+		if len(c) > chunk {
+			c = c[0:chunk]
+		}
+
+		_, err := WritePktLine(s.w, append([]byte{band}, c...))
+		if err != nil {
+			return n, err
+		}
+
+		n += len(c)
+		p = p[len(c):]
+	}
+
+	return n, nil
+}
+
+// Progress sends a message the client shows as "remote: msg".
+func (s *SidebandWriter) Progress(msg string) error {
+	_, err := s.WriteBand(BandProgress, ProgressPacket(msg).Data[1:])
+	return err
+}
+
+// Error sends a message the client reports as a fatal remote error.
+func (s *SidebandWriter) Error(msg string) error {
+	_, err := s.WriteBand(BandError, ErrorPacket(msg).Data[1:])
+	return err
+}
+
+// Flush ends the side-band stream.
+func (s *SidebandWriter) Flush() error {
+	_, err := WritePktLineFlush(s.w)
+	return err
+}
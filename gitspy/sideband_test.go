@@ -0,0 +1,88 @@
+package gitspy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestParseSideband(t *testing.T) {
+	band, data, err := ParseSideband([]byte("\x02Counting objects\n"))
+	if err != nil {
+		t.Fatalf("Error from parse: %v", err)
+	}
+
+	if band != BandProgress || string(data) != "Counting objects\n" {
+		t.Errorf("Bad decode: %d %q", band, data)
+	}
+
+	_, _, err = ParseSideband([]byte("NAK\n"))
+	if err != ErrInvalidBand {
+		t.Errorf("Should be an invalid band: %v", err)
+	}
+}
+
+func TestSidebandRoundTrip(t *testing.T) {
+	pack := bytes.Repeat([]byte("0123456789"), 250)
+
+	b := &bytes.Buffer{}
+	w := NewSidebandWriter(b, SidebandMax)
+	w.Progress("Counting objects")
+	w.Write(pack)
+	w.Flush()
+
+	progress := &bytes.Buffer{}
+	r := NewSidebandReader(b)
+	r.Progress = progress
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Error from read: %v", err)
+	}
+
+	if !bytes.Equal(data, pack) {
+		t.Errorf("Wrong data: %d bytes", len(data))
+	}
+
+	if progress.String() != "Counting objects\n" {
+		t.Errorf("Wrong progress: %q", progress.String())
+	}
+}
+
+func TestSidebandWriterChunks(t *testing.T) {
+	b := &bytes.Buffer{}
+	w := NewSidebandWriter(b, SidebandMax)
+	w.Write(make([]byte, 2000))
+
+	buf := make([]byte, Sideband64kMax)
+	count := 0
+
+	for b.Len() > 0 {
+		n, err := ParsePktLine(b, buf)
+		if err != nil {
+			t.Fatalf("Error from parse: %v", err)
+		}
+
+		if n+4 > SidebandMax {
+			t.Errorf("Packet too big: %d", n+4)
+		}
+
+		count++
+	}
+
+	if count != 3 {
+		t.Errorf("Wrong number of packets: %d", count)
+	}
+}
+
+func TestSidebandReaderError(t *testing.T) {
+	b := &bytes.Buffer{}
+	w := NewSidebandWriter(b, Sideband64kMax)
+	w.Write([]byte("PACK"))
+	w.Error("upload-pack: not our ref")
+
+	_, err := ioutil.ReadAll(NewSidebandReader(b))
+	if err != SidebandError("upload-pack: not our ref") {
+		t.Errorf("Wrong error: %v", err)
+	}
+}
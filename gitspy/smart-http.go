@@ -0,0 +1,326 @@
+package gitspy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ServeHTTP serves git's smart HTTP protocol. Each request is a session of
+// its own, routed and filtered like one arriving over ssh. Clients are
+// authenticated by HTTPUsers, whose user names become the sessions' User.
+// Without HTTPUsers clients are anonymous and, as over git://, only fetches
+// are allowed: a push would reach the upstream with the proxy's own
+// credentials and no User for policies to go by.
+// https://git-scm.com/docs/http-protocol
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var gr *Request
+	var body io.Reader
+
+	path := r.URL.Path
+
+	switch {
+	case r.Method == "GET" && strings.HasSuffix(path, "/info/refs"):
+		service := r.URL.Query().Get("service")
+		if service != UploadPack && service != ReceivePack {
+			http.Error(w, "Only smart HTTP is supported", http.StatusForbidden)
+			return
+		}
+
+		gr = &Request{Service: service, Repo: strings.TrimSuffix(path, "/info/refs")}
+
+		// Hang up once the upstream has advertised its refs, as a client
+		// with nothing to fetch or push would
+		body = bytes.NewReader(specialPkts[FlushPkt])
+	case r.Method == "POST" && (strings.HasSuffix(path, "/"+UploadPack) || strings.HasSuffix(path, "/"+ReceivePack)):
+		i := strings.LastIndexByte(path, '/')
+		gr = &Request{Service: path[i+1:], Repo: path[:i]}
+
+		if r.Header.Get("Content-Type") != "application/x-"+gr.Service+"-request" {
+			http.Error(w, "Unexpected Content-Type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		body = r.Body
+
+		if e := r.Header.Get("Content-Encoding"); e == "gzip" || e == "x-gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to decompress request: %v", err), http.StatusBadRequest)
+				return
+			}
+
+			defer zr.Close()
+			body = zr
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if gr.Repo == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	st := s.settings()
+
+	if st.HTTPUsers != nil {
+		user, ok := st.HTTPUsers.Authenticate(r)
+		if !ok {
+			log.Printf("Unauthorized %s from %s over HTTP", gr, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Basic realm="git-spy"`)
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		gr.User = user
+	} else if gr.Service == ReceivePack {
+		log.Printf("Refusing %s from %s over HTTP", gr, r.RemoteAddr)
+		http.Error(w, "Pushing is not allowed over HTTP without authentication", http.StatusForbidden)
+		return
+	}
+
+	gr.ID = newSessionID()
+	gr.Protocol = r.Header.Get("Git-Protocol")
+	gr.RemoteAddr = r.RemoteAddr
+	gr.Stateless = true
+
+	log.Printf("%s requested %s over HTTP as session %s", r.RemoteAddr, gr, gr.ID)
+
+	upstream, err := st.Router.Route(gr)
+	if err != nil {
+		log.Printf("Failed to route '%s': %v", gr.Repo, err)
+		http.NotFound(w, r)
+		return
+	}
+
+	var c *httpClient
+	if r.Method == "GET" {
+		c = newHTTPClient(body, w, "application/x-"+gr.Service+"-advertisement", false)
+
+		// The preamble is sent whatever protocol version was asked for, as
+		// the upstream may not answer in it. Clients accept it either way.
+		WritePktLine(&c.preamble, []byte("# service="+gr.Service+"\n"))
+		WritePktLineFlush(&c.preamble)
+	} else {
+		c = newHTTPClient(body, w, "application/x-"+gr.Service+"-result", true)
+	}
+
+	// Give up on the session if the client goes away, as well as when the
+	// server does
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	s.session(ctx, st, c, gr, upstream)
+	c.finish()
+}
+
+// An httpClient is the client's side of a smart HTTP request. The request
+// body is read as what the client sent and what is written becomes the
+// response.
+//
+// Each request starts a new session upstream, which advertises its refs
+// again. When skipAdvertisement is set that advertisement is passed through
+// the filters as usual but left out of the response, as the client has
+// already had it from info/refs. A session answered by the proxy instead,
+// such as a rejected push, ends the skipping with endAdvertisement.
+type httpClient struct {
+	body io.Reader
+	w    http.ResponseWriter
+
+	contentType string
+	preamble    bytes.Buffer
+
+	// skipped holds the part of the advertisement being skipped that is
+	// not yet a whole pkt-line
+	skipAdvertisement bool
+	skipped           []byte
+	lock              sync.Mutex
+
+	// out passes what is written to the response, done is closed once it
+	// has all been sent
+	out  *io.PipeWriter
+	done chan struct{}
+
+	// wrote is set once the response has started
+	wrote bool
+
+	status uint32
+	stderr httpStderr
+}
+
+func newHTTPClient(body io.Reader, w http.ResponseWriter, contentType string, skipAdvertisement bool) *httpClient {
+	c := &httpClient{body: body, w: w, contentType: contentType, skipAdvertisement: skipAdvertisement, done: make(chan struct{})}
+
+	var r *io.PipeReader
+	r, c.out = io.Pipe()
+
+	go c.respond(r)
+
+	return c
+}
+
+func (c *httpClient) Read(b []byte) (int, error) { return c.body.Read(b) }
+func (c *httpClient) Close() error               { return c.out.Close() }
+func (c *httpClient) Stderr() io.Writer          { return &c.stderr }
+func (c *httpClient) Exit(status uint32)         { c.status = status }
+
+// Write passes b on to the response, once any advertisement being skipped
+// has ended with its flush.
+func (c *httpClient) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.skipAdvertisement {
+		return c.out.Write(b)
+	}
+
+	c.skipped = append(c.skipped, b...)
+
+	for len(c.skipped) >= 4 {
+		db, err := hex.DecodeString(string(c.skipped[:4]))
+		if err != nil {
+			return 0, fmt.Errorf("Failed parsing advertisement: %v", err)
+		}
+
+		size := int(binary.BigEndian.Uint16(db))
+		if size == 0 {
+			rest := c.skipped[4:]
+			c.skipAdvertisement = false
+			c.skipped = nil
+
+			if len(rest) > 0 {
+				_, err = c.out.Write(rest)
+				if err != nil {
+					return 0, err
+				}
+			}
+
+			break
+		}
+
+		if size < 4 {
+			size = 4
+		}
+
+		if len(c.skipped) < size {
+			break
+		}
+
+		c.skipped = c.skipped[size:]
+	}
+
+	return len(b), nil
+}
+
+// endAdvertisement stops skipping the advertisement, for the proxy to answer
+// the client in place of the upstream.
+func (c *httpClient) endAdvertisement() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.skipAdvertisement = false
+	c.skipped = nil
+}
+
+// respond sends what the session writes as the response, starting it only
+// once there is something to send so a failed session can still be reported
+// with an error status.
+func (c *httpClient) respond(r *io.PipeReader) {
+	defer close(c.done)
+
+	b := make([]byte, 32*1024)
+
+	for {
+		n, err := r.Read(b)
+		if n > 0 {
+			if !c.wrote {
+				c.start(http.StatusOK, c.contentType)
+				c.w.Write(c.preamble.Bytes())
+			}
+
+			_, werr := c.w.Write(b[:n])
+			if werr != nil {
+				r.CloseWithError(werr)
+				return
+			}
+
+			if f, ok := c.w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *httpClient) start(status int, contentType string) {
+	c.wrote = true
+
+	h := c.w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("Cache-Control", "no-cache, max-age=0, must-revalidate")
+	h.Set("Expires", "Fri, 01 Jan 1980 00:00:00 GMT")
+	h.Set("Pragma", "no-cache")
+
+	c.w.WriteHeader(status)
+}
+
+// finish waits for the response to be sent. A session that failed before
+// sending anything is answered with an error status instead, and what it
+// would have written to stderr, which clients show the user.
+func (c *httpClient) finish() {
+	c.out.Close()
+	<-c.done
+
+	if c.wrote {
+		return
+	}
+
+	if c.status == 0 {
+		c.start(http.StatusOK, c.contentType)
+		return
+	}
+
+	c.start(http.StatusInternalServerError, "text/plain; charset=utf-8")
+	c.w.Write(c.stderr.Bytes())
+}
+
+// httpStderr collects what a session has for the user's terminal.
+type httpStderr struct {
+	b    bytes.Buffer
+	lock sync.Mutex
+}
+
+func (e *httpStderr) Write(b []byte) (int, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return e.b.Write(b)
+}
+
+func (e *httpStderr) Bytes() []byte {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return append([]byte(nil), e.b.Bytes()...)
+}
@@ -0,0 +1,254 @@
+package gitspy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testServeHTTP(s *Server, method, url, contentType string, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, bytes.NewReader(body))
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestServeHTTPInfoRefs(t *testing.T) {
+	buf := &bytes.Buffer{}
+	tr := NewTranscript(nopWriteCloser{buf}, &Request{ID: "abc", Service: UploadPack, Repo: "/test.git"})
+
+	adv := &bytes.Buffer{}
+	WritePktLine(adv, []byte(oldID+" refs/heads/master\n"))
+	WritePktLineFlush(adv)
+	tr.Tap(ServerToClient).Write(adv.Bytes())
+	tr.Tap(ClientToServer).Write([]byte("0000"))
+	tr.Exit(0)
+
+	records, err := ReadTranscript(buf)
+	if err != nil {
+		t.Fatalf("Error from ReadTranscript: %v", err)
+	}
+
+	u := NewReplayUpstream(records)
+	w := testServeHTTP(NewServer(nil, u), "GET", "/test.git/info/refs?service=git-upload-pack", "", nil)
+
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-git-upload-pack-advertisement" {
+		t.Errorf("Bad response: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	if want := "001e# service=git-upload-pack\n0000" + adv.String(); w.Body.String() != want {
+		t.Errorf("Bad body: %q", w.Body.String())
+	}
+
+	if len(u.Divergences()) > 0 {
+		t.Errorf("Client should have hung up: %v", u.Divergences())
+	}
+}
+
+func TestServeHTTPUploadPack(t *testing.T) {
+	u := NewReplayUpstream(testRecording(t))
+
+	body := &bytes.Buffer{}
+	WritePktLine(body, []byte("want "+oldID+"\n"))
+	WritePktLineFlush(body)
+	WritePktLine(body, []byte("done\n"))
+
+	w := testServeHTTP(NewServer(nil, u), "POST", "/test.git/git-upload-pack", "application/x-git-upload-pack-request", body.Bytes())
+
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-git-upload-pack-result" {
+		t.Errorf("Bad response: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	// The advertisement is left out
+	if w.Body.String() != "0008NAK\nPACK" {
+		t.Errorf("Bad body: %q", w.Body.String())
+	}
+}
+
+func TestServeHTTPFailure(t *testing.T) {
+	s := NewServer(nil, NewReplayUpstream())
+
+	w := testServeHTTP(s, "GET", "/test.git/info/refs?service=git-upload-pack", "", nil)
+	if w.Code != http.StatusInternalServerError || !strings.HasPrefix(w.Body.String(), "fatal: Failed to start git-upload-pack") {
+		t.Errorf("Bad response to failed session: %d %q", w.Code, w.Body.String())
+	}
+
+	w = testServeHTTP(s, "GET", "/test.git/info/refs", "", nil)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Bad response to dumb request: %d", w.Code)
+	}
+
+	w = testServeHTTP(s, "POST", "/test.git/git-upload-pack", "text/plain", nil)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Bad response to wrong Content-Type: %d", w.Code)
+	}
+
+	w = testServeHTTP(s, "GET", "/test.git/objects/info/packs", "", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Bad response to unknown path: %d", w.Code)
+	}
+}
+
+// testStarts counts the sessions started on it, none of which succeed.
+type testStarts int
+
+func (n *testStarts) Start(r *Request) (UpstreamSession, error) {
+	*n++
+	return nil, fmt.Errorf("No upstream for %s", r)
+}
+
+func TestServeHTTPPushRefused(t *testing.T) {
+	var starts testStarts
+	s := NewServer(nil, testRouter{&starts})
+
+	w := testServeHTTP(s, "GET", "/test.git/info/refs?service=git-receive-pack", "", nil)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Bad response to push advertisement: %d", w.Code)
+	}
+
+	body := &bytes.Buffer{}
+	WritePktLine(body, []byte(oldID+" "+newID+" refs/heads/master\x00report-status\n"))
+	WritePktLineFlush(body)
+
+	w = testServeHTTP(s, "POST", "/test.git/git-receive-pack", "application/x-git-receive-pack-request", body.Bytes())
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "Pushing is not allowed") {
+		t.Errorf("Bad response to push: %d %q", w.Code, w.Body.String())
+	}
+
+	if starts != 0 {
+		t.Errorf("Push reached the upstream %d times", starts)
+	}
+}
+
+func TestServeHTTPPush(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "smart-http")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	users := filepath.Join(dir, "http_users")
+	err = ioutil.WriteFile(users, []byte("alice:a11ce\nbob:b0b\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := filepath.Join(dir, "upstream", "test.git")
+	client := filepath.Join(dir, "client")
+	testGit(t, "init", "-q", "--bare", repo)
+	testGit(t, "init", "-q", client)
+	testGit(t, "-C", client, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "test")
+	testGit(t, "-C", client, "tag", "v1")
+
+	pp := NewPushPolicy()
+	pp.TagCreators = []string{"alice"}
+
+	s := NewServer(nil, testRouter{&LocalUpstream{Dir: filepath.Join(dir, "upstream")}})
+	s.Filter = Chain{LogFilter, pp}
+	s.HTTPUsers, err = LoadHTTPUsers(users)
+	if err != nil {
+		t.Fatalf("Error from LoadHTTPUsers: %v", err)
+	}
+
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+
+	w := testServeHTTP(s, "GET", "/test.git/info/refs?service=git-receive-pack", "", nil)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("Bad response to unauthenticated push: %d", w.Code)
+	}
+
+	push := func(user string, args ...string) error {
+		url := strings.Replace(hs.URL, "http://", "http://"+user+"@", 1) + "/test.git"
+
+		cmd := exec.Command("git", append([]string{"-C", client, "push", "-q", url}, args...)...)
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, out)
+		}
+
+		return nil
+	}
+
+	err = push("bob:wrong", "master")
+	if err == nil {
+		t.Errorf("Push with a wrong token should fail")
+	}
+
+	err = push("bob:b0b", "master")
+	if err != nil {
+		t.Errorf("Push failed: %v", err)
+	}
+
+	err = push("bob:b0b", "v1")
+	if err == nil || !strings.Contains(err.Error(), "tag creation prohibited") {
+		t.Errorf("Push of a tag by bob should be refused by the policy: %v", err)
+	}
+
+	err = push("alice:a11ce", "v1")
+	if err != nil {
+		t.Errorf("Push of a tag by alice failed: %v", err)
+	}
+
+	for _, ref := range []string{"refs/heads/master", "refs/tags/v1"} {
+		testGit(t, "-C", repo, "rev-parse", "--verify", "-q", ref)
+	}
+}
+
+func TestHTTPClientSkipAdvertisement(t *testing.T) {
+	adv := &bytes.Buffer{}
+	WritePktLine(adv, []byte(oldID+" refs/heads/master\n"))
+	WritePktLineFlush(adv)
+
+	w := httptest.NewRecorder()
+	c := newHTTPClient(nil, w, "application/x-git-receive-pack-result", true)
+
+	// Written in pieces, as it may arrive from the upstream
+	b := append(adv.Bytes(), "0008NAK\n"...)
+	for len(b) > 0 {
+		n := 3
+		if n > len(b) {
+			n = len(b)
+		}
+
+		c.Write(b[:n])
+		b = b[n:]
+	}
+
+	c.finish()
+
+	if w.Body.String() != "0008NAK\n" {
+		t.Errorf("Bad body: %q", w.Body.String())
+	}
+
+	// A rejection before the upstream finishes advertising is sent whole
+	w = httptest.NewRecorder()
+	c = newHTTPClient(nil, w, "application/x-git-receive-pack-result", true)
+	c.Write(adv.Bytes()[:10])
+	c.endAdvertisement()
+	c.Write([]byte("0000"))
+	c.finish()
+
+	if w.Body.String() != "0000" {
+		t.Errorf("Bad body after endAdvertisement: %q", w.Body.String())
+	}
+}
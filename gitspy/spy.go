@@ -1,21 +1,325 @@
 package gitspy
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"log"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	UploadPack    = "git-upload-pack"
+	ReceivePack   = "git-receive-pack"
+	UploadArchive = "git-upload-archive"
 )
 
 type GitSpy struct {
-	c io.WriteCloser
-	s io.WriteCloser
+	req    *Request
+	c      io.WriteCloser
+	s      io.WriteCloser
+	filter Filter
+
+	// upstream is what the session runs against, if known
+	upstream Upstream
+
+	server sync.WaitGroup
+
+	// version is the protocol version the server answered with, readable
+	// once versionKnown is closed.
+	version      int
+	versionKnown chan struct{}
+	versionOnce  sync.Once
+
+	negotiation *Negotiation
+
+	// state is kept by filters across the session
+	state sync.Map
+
+	// commands holds v2 commands sent by the client and not yet answered,
+	// updates the refs a push asked to update and caps the capabilities it
+	// asked for with them
+	commands []string
+	updates  []RefUpdate
+	caps     Capabilities
+	cmdLock  sync.Mutex
+
+	// bytes counts what each side sent, by Direction
+	bytes [2]int64
+
+	// transcript records what both sides send, if the session is recorded
+	transcript *Transcript
+
+	// err is the first error a filter aborted the session with
+	err       error
+	abortOnce sync.Once
+	aborted   chan struct{}
 }
 
-func (gs *GitSpy) ClientPipe() io.WriteCloser {
+func (gs *GitSpy) setVersion(v int) {
+	gs.versionOnce.Do(func() {
+		gs.version = v
+		close(gs.versionKnown)
+	})
+}
+
+func (gs *GitSpy) pushCommand(cmd *V2Command) {
+	gs.cmdLock.Lock()
+	defer gs.cmdLock.Unlock()
+
+	gs.commands = append(gs.commands, cmd.Name)
+}
+
+func (gs *GitSpy) nextCommand() string {
+	gs.cmdLock.Lock()
+	defer gs.cmdLock.Unlock()
+
+	if len(gs.commands) == 0 {
+		return ""
+	}
+
+	name := gs.commands[0]
+	gs.commands = gs.commands[1:]
+
+	return name
+}
+
+func (gs *GitSpy) setUpdates(updates []RefUpdate, caps Capabilities) {
+	gs.cmdLock.Lock()
+	defer gs.cmdLock.Unlock()
+
+	gs.updates = updates
+	gs.caps = caps
+}
+
+// Updates returns the ref updates a push asked for, as the client sent them.
+func (gs *GitSpy) Updates() []RefUpdate {
+	gs.cmdLock.Lock()
+	defer gs.cmdLock.Unlock()
+
+	return gs.updates
+}
+
+// Bytes returns how many bytes were sent in direction dir.
+func (gs *GitSpy) Bytes(dir Direction) int64 {
+	return atomic.LoadInt64(&gs.bytes[dir])
+}
+
+// Negotiation follows the want/have exchange of a fetch.
+func (gs *GitSpy) Negotiation() *Negotiation {
+	return gs.negotiation
+}
+
+func (gs *GitSpy) abort(err error) error {
+	gs.abortOnce.Do(func() {
+		log.Printf("Aborting %s: %v", gs.req, err)
+		gs.err = err
+		close(gs.aborted)
+	})
+
+	return err
+}
+
+// Aborted is closed when a filter aborts the session.
+func (gs *GitSpy) Aborted() <-chan struct{} {
+	return gs.aborted
+}
+
+// Err returns the error a filter aborted the session with, if any.
+func (gs *GitSpy) Err() error {
+	select {
+	case <-gs.aborted:
+		return gs.err
+	default:
+		return nil
+	}
+}
+
+// readPacket reads a packet using b as scratch space. The returned packet
+// has its own copy of the data.
+func readPacket(src io.Reader, b []byte) (Packet, error) {
+	t, n, err := ReadPkt(src, b)
+	if err != nil {
+		return Packet{}, err
+	}
+
+	p := Packet{Type: t}
+	if t == DataPkt {
+		p.Data = append([]byte(nil), b[0:n]...)
+	}
+
+	return p, nil
+}
+
+func writePacket(dst io.Writer, p Packet) (err error) {
+	if p.Type == DataPkt {
+		_, err = WritePktLine(dst, p.Data)
+	} else {
+		_, err = WriteSpecialPkt(dst, p.Type)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed writing pkt: %v", err)
+	}
+
+	return nil
+}
+
+// send passes a packet through the filters and writes out whatever they
+// return.
+func (gs *GitSpy) send(dst io.Writer, ctx *FilterContext, p Packet) error {
+	pkts := []Packet{p}
+
+	if gs.filter != nil {
+		var err error
+
+		pkts, err = gs.filter.Filter(ctx, p)
+		if err != nil {
+			return gs.abort(err)
+		}
+	}
+
+	for _, p := range pkts {
+		err := writePacket(dst, p)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (gs *GitSpy) context(dir Direction, phase Phase) *FilterContext {
+	gs.cmdLock.Lock()
+	defer gs.cmdLock.Unlock()
+
+	return &FilterContext{
+		Request:          gs.req,
+		Direction:        dir,
+		Phase:            phase,
+		Updates:          gs.updates,
+		PushCapabilities: gs.caps,
+		State:            &gs.state,
+		Upstream:         gs.upstream,
+	}
+}
+
+// proxyPkts sends packets until a flush, or until EOF if untilEOF is set.
+func (gs *GitSpy) proxyPkts(dst io.Writer, src io.Reader, dir Direction, phase Phase, untilEOF bool) error {
+	b := make([]byte, 65516)
+
+	for {
+		p, err := readPacket(src, b)
+		if err == io.EOF && untilEOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Failed parsing pkt: %v", err)
+		}
+
+		err = gs.send(dst, gs.context(dir, phase), p)
+		if err != nil {
+			return err
+		}
+
+		if p.Type == FlushPkt && !untilEOF {
+			return nil
+		}
+	}
+}
+
+// proxyNegotiation forwards the client half of a v0 fetch.
+func (gs *GitSpy) proxyNegotiation(dst io.Writer, src io.Reader) error {
+	b := make([]byte, 65516)
+
+	for {
+		p, err := readPacket(src, b)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Failed parsing pkt: %v", err)
+		}
+
+		if p.Type == FlushPkt {
+			gs.negotiation.ClientFlush()
+		} else {
+			gs.negotiation.ClientLine(string(p.Data))
+		}
+
+		err = gs.send(dst, gs.context(ClientToServer, PhaseNegotiation), p)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Record has everything written to the pipes recorded in t. It must be
+// called before the pipes are created.
+func (gs *GitSpy) Record(t *Transcript) {
+	gs.transcript = t
+}
+
+// A pipeWriter counts what is written to a pipe, copying it to tap first
+// if there is one.
+type pipeWriter struct {
+	io.WriteCloser
+	n    *int64
+	from string
+	tap  io.Writer
+}
+
+func (w *pipeWriter) Write(b []byte) (int, error) {
+	if w.tap != nil {
+		w.tap.Write(b)
+	}
+
+	n, err := w.WriteCloser.Write(b)
+	atomic.AddInt64(w.n, int64(n))
+	metricBytes.Add(float64(n), w.from)
+
+	return n, err
+}
+
+// pipe returns the writing end of a pipe for what is sent in direction dir.
+func (gs *GitSpy) pipe(dir Direction) (*io.PipeReader, io.WriteCloser) {
 	r, w := io.Pipe()
 
+	from := "client"
+	if dir == ServerToClient {
+		from = "upstream"
+	}
+
+	pw := &pipeWriter{WriteCloser: w, n: &gs.bytes[dir], from: from}
+	if gs.transcript != nil {
+		pw.tap = gs.transcript.Tap(dir)
+	}
+
+	return r, pw
+}
+
+func (gs *GitSpy) ClientPipe() io.WriteCloser {
+	r, w := gs.pipe(ClientToServer)
+
 	go func() {
-		_, err := io.Copy(gs.s, r)
+		var err error
+
+		switch gs.req.Service {
+		case ReceivePack:
+			err = gs.proxyReceivePackRequest(gs.s, r)
+		case UploadArchive:
+			err = gs.proxyUploadArchiveRequest(gs.s, r)
+		default:
+			// The client speaks only after the server's advertisement
+			<-gs.versionKnown
+
+			if gs.version == 2 {
+				err = gs.proxyV2Requests(gs.s, r)
+			} else {
+				err = gs.proxyNegotiation(gs.s, r)
+			}
+		}
+
 		if err != nil && err != io.EOF {
 			r.CloseWithError(fmt.Errorf("Failed writing to server: %v", err))
 			return
@@ -30,70 +334,175 @@ func (gs *GitSpy) ClientPipe() io.WriteCloser {
 	return w
 }
 
-type filterfunc func([]byte) ([]byte, error)
+// proxyAdvertisement forwards the server's advertisement, noting the
+// protocol version it answers with. The advertisement is read in full so
+// an AdvertisementFilter can work on it as a whole.
+func (gs *GitSpy) proxyAdvertisement(dst io.Writer, src io.Reader) error {
+	defer gs.setVersion(0)
+
+	b := make([]byte, 65516)
+
+	var pkts []Packet
+
+	for {
+		p, err := readPacket(src, b)
+		if err != nil {
+			return fmt.Errorf("Failed parsing pkt: %v", err)
+		}
+
+		if p.Type == DataPkt && bytes.Equal(p.Data, []byte("version 2\n")) {
+			gs.setVersion(2)
+		} else {
+			gs.setVersion(0)
+		}
+
+		if p.Type == FlushPkt {
+			break
+		}
+
+		pkts = append(pkts, p)
+	}
+
+	ctx := gs.context(ServerToClient, PhaseAdvertisement)
+
+	if af, ok := gs.filter.(AdvertisementFilter); ok {
+		a, err := ParseAdvertisement(pkts)
+		if err != nil {
+			log.Printf("Failed to parse advertisement: %v", err)
+		} else {
+			err = af.FilterAdvertisement(ctx, a)
+			if err != nil {
+				return gs.abort(err)
+			}
+
+			pkts = a.Packets()
+		}
+	}
+
+	for _, p := range append(pkts, Packet{Type: FlushPkt}) {
+		err := gs.send(dst, ctx, p)
+		if err != nil {
+			return err
+		}
+	}
 
-func logServer(b []byte) ([]byte, error) {
-	log.Printf("S: %s", b)
-	return b, nil
+	return nil
 }
 
-func proxyPktLine(dst io.Writer, src io.Reader, f filterfunc) (done bool, err error) {
-	// TODO: pool this?
+// proxyUploadPackResponse forwards the ACK/NAK replies of a v0 fetch and
+// the pack that follows. Without side-band the pack is sent raw, after the
+// last pkt-line.
+func (gs *GitSpy) proxyUploadPackResponse(dst io.Writer, src io.Reader) error {
+	br := bufio.NewReader(src)
 	b := make([]byte, 65516)
 
-	n, err := ParsePktLine(src, b)
-	if err != nil {
-		if err == ErrFlushPkt {
-			log.Printf("S: FLUSH")
-			_, err = WritePktLineFlush(dst)
-			if err != nil {
-				return true, nil
+	// The pack sent over side-band, once it starts
+	var pi *packInspector
+
+	for {
+		h, err := br.Peek(4)
+		if err == io.EOF {
+			if pi != nil {
+				return pi.Close()
 			}
 
-			return true, nil
-		} else if err == io.EOF {
-			log.Printf("EOF from server")
-		} else {
-			log.Printf("Error parsing from server: %v", err)
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Failed parsing pkt: %v", err)
+		}
+
+		if bytes.Equal(h, []byte("PACK")) {
+			gs.negotiation.PackStarted()
+			return gs.proxyPack(dst, br, ServerToClient)
+		}
+
+		p, err := readPacket(br, b)
+		if err != nil {
+			return fmt.Errorf("Failed parsing pkt: %v", err)
+		}
+
+		ctx := gs.context(ServerToClient, PhaseNegotiation)
+		if isSideband(p) {
+			ctx.Phase = PhaseSideband
+
+			if pi == nil {
+				gs.negotiation.PackStarted()
+				pi = gs.newPackInspector(ctx)
+			}
+
+			err = pi.sideband(p)
+			if err != nil {
+				return err
+			}
+		} else if p.Type == DataPkt {
+			gs.negotiation.ServerLine(string(p.Data))
 		}
 
-		return true, fmt.Errorf("Failed parsing pkt: %v", err)
+		err = gs.send(dst, ctx, p)
+		if err != nil {
+			return err
+		}
 	}
+}
 
-	ob, err := f(b[0:n])
+// proxyReceivePackResponse forwards report-status, which may be side-band
+// multiplexed.
+func (gs *GitSpy) proxyReceivePackResponse(dst io.Writer, src io.Reader) error {
+	b := make([]byte, 65516)
+
+	for {
+		p, err := readPacket(src, b)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Failed parsing pkt: %v", err)
+		}
 
-	_, err = WritePktLine(dst, ob)
+		phase := PhaseResponse
+		if isSideband(p) {
+			phase = PhaseSideband
+		}
+
+		err = gs.send(dst, gs.context(ServerToClient, phase), p)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (gs *GitSpy) proxyServerResponse(dst io.Writer, src io.Reader) error {
+	err := gs.proxyAdvertisement(dst, src)
 	if err != nil {
-		return true, fmt.Errorf("Failed writing pkt: %v", err)
+		return err
+	}
+
+	if gs.version == 2 {
+		return gs.proxyV2Responses(dst, src)
+	} else if gs.req.Service == ReceivePack {
+		return gs.proxyReceivePackResponse(dst, src)
 	}
 
-	return false, nil
+	return gs.proxyUploadPackResponse(dst, src)
 }
 
 func (gs *GitSpy) ServerPipe() io.WriteCloser {
-	r, w := io.Pipe()
+	r, w := gs.pipe(ServerToClient)
 
+	gs.server.Add(1)
 	go func() {
+		defer gs.server.Done()
+
 		var err error
 
-		done := false
-		for !done {
-			done, err = proxyPktLine(gs.c, r, logServer)
-			if err != nil {
-				r.CloseWithError(fmt.Errorf("Failed proxying to client: %v", err))
-				break
-			}
+		if gs.req.Service == UploadArchive {
+			err = gs.proxyUploadArchiveResponse(gs.c, r)
+		} else {
+			err = gs.proxyServerResponse(gs.c, r)
 		}
 
 		if err != nil {
 			r.CloseWithError(fmt.Errorf("Failed writing from server to client: %v", err))
 			return
-		} else {
-			_, err = io.Copy(gs.c, r)
-			if err != nil {
-				r.CloseWithError(fmt.Errorf("Failed direct writing to client: %v", err))
-				return
-			}
 		}
 
 		log.Printf("ServerPipe exited normally")
@@ -103,13 +512,37 @@ func (gs *GitSpy) ServerPipe() io.WriteCloser {
 	return w
 }
 
+// Wait blocks until everything written to the ServerPipe has been passed on
+// to the client.
+func (gs *GitSpy) Wait() {
+	gs.server.Wait()
+}
+
 func (gs *GitSpy) Close() {
 	gs.c.Close()
 	gs.s.Close()
+
+	gs.state.Range(func(k, v interface{}) bool {
+		if c, ok := v.(io.Closer); ok {
+			c.Close()
+		}
+
+		return true
+	})
 }
 
-func NewGitSpy(client io.WriteCloser, server io.WriteCloser) *GitSpy {
-	gs := GitSpy{client, server}
+// NewGitSpy creates a spy passing every packet between client and server
+// through filter, which may be nil.
+func NewGitSpy(req *Request, client io.WriteCloser, server io.WriteCloser, filter Filter) *GitSpy {
+	gs := GitSpy{
+		req:          req,
+		c:            client,
+		s:            server,
+		filter:       filter,
+		negotiation:  NewNegotiation(),
+		versionKnown: make(chan struct{}),
+		aborted:      make(chan struct{}),
+	}
 
 	return &gs
 }
@@ -1,39 +1,17 @@
 package gitspy
 
 import (
-	"io/ioutil"
-	"log"
-
 	"golang.org/x/crypto/ssh"
 )
 
-func passwordCallback(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-	//log.Printf("Checking password for %v", c)
-	return nil, nil
-}
-
-func publicKeyCallback(c ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
-	//log.Printf("Checking public key %v for %v", pubKey, c)
-	return nil, nil
-}
-
-func NewSSHServerConfig() *ssh.ServerConfig {
+func NewSSHServerConfig(keys *AuthorizedKeys, hostKeys []ssh.Signer) *ssh.ServerConfig {
 	config := &ssh.ServerConfig{
-		PasswordCallback:  passwordCallback,
-		PublicKeyCallback: publicKeyCallback,
-	}
-
-	privateBytes, err := ioutil.ReadFile("id_rsa")
-	if err != nil {
-		log.Fatal("Failed to load private key: ", err)
+		PublicKeyCallback: keys.PublicKeyCallback,
 	}
 
-	private, err := ssh.ParsePrivateKey(privateBytes)
-	if err != nil {
-		log.Fatal("Failed to parse private key: ", err)
+	for _, k := range hostKeys {
+		config.AddHostKey(k)
 	}
 
-	config.AddHostKey(private)
-
 	return config
 }
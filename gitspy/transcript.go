@@ -0,0 +1,260 @@
+package gitspy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Record types in a transcript
+const (
+	// The first record, describing the request
+	RecordSession = "session"
+
+	// Pkt-lines, with the text or data of data packets
+	RecordData        = "data"
+	RecordFlush       = "flush"
+	RecordDelim       = "delim"
+	RecordResponseEnd = "response-end"
+
+	// Bytes that are not pkt-lines, such as a pack sent without side-band
+	RecordRaw = "raw"
+
+	// What the upstream wrote to stderr
+	RecordStderr = "stderr"
+
+	// The last record, with the exit status sent to the client
+	RecordExit = "exit"
+)
+
+// A TranscriptRecord is one line of a transcript.
+//
+// A transcript is a file of JSON records, one per line, in the order the
+// proxy received them. Dir is "C" for what the client sent and "S" for what
+// the upstream sent. Payloads that are valid UTF-8 are kept as Text, others
+// base64 encoded as Data. The stream in each direction is split into
+// pkt-lines until something that is not one is seen, after which the rest
+// of that direction is raw records of the chunks as they arrived.
+type TranscriptRecord struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	Dir  string    `json:"dir,omitempty"`
+
+	Text string `json:"text,omitempty"`
+	Data []byte `json:"data,omitempty"`
+
+	// For the session record
+	Session  string `json:"session,omitempty"`
+	Service  string `json:"service,omitempty"`
+	Repo     string `json:"repo,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	User     string `json:"user,omitempty"`
+
+	// For the exit record
+	Status uint32 `json:"status,omitempty"`
+}
+
+// Payload returns the record's text or data.
+func (r *TranscriptRecord) Payload() []byte {
+	if r.Data != nil {
+		return r.Data
+	}
+
+	return []byte(r.Text)
+}
+
+// A Transcript records the traffic of a session. All its methods do
+// nothing on a nil Transcript, so sessions that are not recorded can use
+// one all the same.
+type Transcript struct {
+	w    io.WriteCloser
+	enc  *json.Encoder
+	err  error
+	taps []*transcriptTap
+	lock sync.Mutex
+}
+
+func NewTranscript(w io.WriteCloser, req *Request) *Transcript {
+	t := &Transcript{w: w, enc: json.NewEncoder(w)}
+
+	t.write(&TranscriptRecord{
+		Type:     RecordSession,
+		Session:  req.ID,
+		Service:  req.Service,
+		Repo:     req.Repo,
+		Protocol: req.Protocol,
+		User:     req.User,
+	})
+
+	return t
+}
+
+func (t *Transcript) write(r *TranscriptRecord) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.err != nil {
+		return
+	}
+
+	r.Time = time.Now().UTC()
+
+	t.err = t.enc.Encode(r)
+	if t.err != nil {
+		log.Printf("Failed to write transcript: %v", t.err)
+	}
+}
+
+// payload fills in r's text or data from b.
+func (r *TranscriptRecord) payload(b []byte) *TranscriptRecord {
+	if utf8.Valid(b) {
+		r.Text = string(b)
+	} else {
+		r.Data = append([]byte(nil), b...)
+	}
+
+	return r
+}
+
+// Tap returns a writer recording a stream sent in direction dir.
+func (t *Transcript) Tap(dir Direction) io.Writer {
+	tt := &transcriptTap{t: t, dir: dir.String()}
+
+	if t != nil {
+		t.lock.Lock()
+		t.taps = append(t.taps, tt)
+		t.lock.Unlock()
+	}
+
+	return tt
+}
+
+// Stderr returns a writer recording the upstream's stderr.
+func (t *Transcript) Stderr() io.Writer {
+	return &transcriptTap{t: t, dir: ServerToClient.String(), raw: true, typ: RecordStderr}
+}
+
+// Exit records the exit status sent to the client.
+func (t *Transcript) Exit(status uint32) {
+	t.write(&TranscriptRecord{Type: RecordExit, Status: status})
+}
+
+// Close records what is left of any pkt-line cut short and closes the
+// transcript.
+func (t *Transcript) Close() error {
+	if t == nil {
+		return nil
+	}
+
+	t.lock.Lock()
+	taps := t.taps
+	t.lock.Unlock()
+
+	for _, tt := range taps {
+		if len(tt.buf) > 0 {
+			t.write((&TranscriptRecord{Type: RecordRaw, Dir: tt.dir}).payload(tt.buf))
+		}
+	}
+
+	return t.w.Close()
+}
+
+// A transcriptTap splits a stream into pkt-lines as it is written, until it
+// sees something else.
+type transcriptTap struct {
+	t   *Transcript
+	dir string
+	buf []byte
+
+	// raw is set once the stream is no longer pkt-lines, and records are
+	// then of typ
+	raw bool
+	typ string
+}
+
+func (tt *transcriptTap) Write(b []byte) (int, error) {
+	if tt.t == nil {
+		return len(b), nil
+	}
+
+	if tt.raw {
+		tt.t.write((&TranscriptRecord{Type: tt.typ, Dir: tt.dir}).payload(b))
+		return len(b), nil
+	}
+
+	tt.buf = append(tt.buf, b...)
+
+	for len(tt.buf) >= 4 {
+		n, err := strconv.ParseUint(string(tt.buf[:4]), 16, 16)
+		if err != nil || n == 3 {
+			tt.raw = true
+			tt.typ = RecordRaw
+			tt.t.write((&TranscriptRecord{Type: RecordRaw, Dir: tt.dir}).payload(tt.buf))
+			tt.buf = nil
+			break
+		}
+
+		if n < 4 {
+			typ := []string{RecordFlush, RecordDelim, RecordResponseEnd}[n]
+			tt.t.write(&TranscriptRecord{Type: typ, Dir: tt.dir})
+			tt.buf = tt.buf[4:]
+			continue
+		}
+
+		if len(tt.buf) < int(n) {
+			break
+		}
+
+		tt.t.write((&TranscriptRecord{Type: RecordData, Dir: tt.dir}).payload(tt.buf[4:n]))
+		tt.buf = tt.buf[n:]
+	}
+
+	return len(b), nil
+}
+
+// A Recorder writes a transcript of every session to a file in Dir.
+type Recorder struct {
+	Dir string
+}
+
+// Start creates the transcript for a session, named for when it started.
+func (r *Recorder) Start(req *Request) (*Transcript, error) {
+	name := fmt.Sprintf("%s-%s-%s.jsonl", time.Now().UTC().Format("20060102T150405Z"), req.Service, req.ID)
+
+	f, err := os.OpenFile(filepath.Join(r.Dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create transcript: %v", err)
+	}
+
+	return NewTranscript(f, req), nil
+}
+
+// ReadTranscript reads the records of a transcript.
+func ReadTranscript(r io.Reader) ([]*TranscriptRecord, error) {
+	var records []*TranscriptRecord
+
+	dec := json.NewDecoder(r)
+	for {
+		rec := &TranscriptRecord{}
+
+		err := dec.Decode(rec)
+		if err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("Failed to read transcript: %v", err)
+		}
+
+		records = append(records, rec)
+	}
+}
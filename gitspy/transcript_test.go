@@ -0,0 +1,72 @@
+package gitspy
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTranscript(t *testing.T) {
+	buf := &bytes.Buffer{}
+	tr := NewTranscript(nopWriteCloser{buf}, &Request{ID: "abc", Service: UploadPack, Repo: "/test.git", User: "alice"})
+
+	stream := &bytes.Buffer{}
+	WritePktLine(stream, []byte("want "+oldID+"\n"))
+	WriteSpecialPkt(stream, DelimPkt)
+	WritePktLineFlush(stream)
+	stream.WriteString("PACK\x00\x00\x00\x02\xff")
+
+	// Written in pieces that split pkt-lines
+	tap := tr.Tap(ClientToServer)
+	b := stream.Bytes()
+	tap.Write(b[:3])
+	tap.Write(b[3:20])
+	tap.Write(b[20:])
+	tap.Write([]byte("more"))
+
+	tr.Stderr().Write([]byte("warning\n"))
+	tr.Exit(1)
+	tr.Close()
+
+	records, err := ReadTranscript(buf)
+	if err != nil {
+		t.Fatalf("Error from ReadTranscript: %v", err)
+	}
+
+	types := []string{RecordSession, RecordData, RecordDelim, RecordFlush, RecordRaw, RecordRaw, RecordStderr, RecordExit}
+	if len(records) != len(types) {
+		t.Fatalf("Wrong records: %v", records)
+	}
+
+	for i, r := range records {
+		if r.Type != types[i] {
+			t.Errorf("Record %d should be %s: %v", i, types[i], r)
+		}
+	}
+
+	if r := records[0]; r.Session != "abc" || r.Repo != "/test.git" || r.User != "alice" {
+		t.Errorf("Bad session: %v", r)
+	}
+
+	if r := records[1]; r.Dir != "C" || r.Text != "want "+oldID+"\n" {
+		t.Errorf("Bad data: %v", r)
+	}
+
+	if r := records[4]; r.Data == nil || string(r.Payload()) != "PACK\x00\x00\x00\x02\xff" {
+		t.Errorf("Bad raw: %q", r.Payload())
+	}
+
+	if r := records[7]; r.Status != 1 {
+		t.Errorf("Bad exit: %v", r)
+	}
+}
+
+func TestTranscriptNil(t *testing.T) {
+	var tr *Transcript
+
+	tr.Tap(ServerToClient).Write([]byte("0000"))
+	tr.Exit(0)
+
+	if tr.Close() != nil {
+		t.Errorf("Nil transcript should do nothing")
+	}
+}
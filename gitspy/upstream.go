@@ -0,0 +1,342 @@
+package gitspy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// An Upstream is a git server the proxy forwards requests to.
+type Upstream interface {
+	Start(r *Request) (UpstreamSession, error)
+}
+
+// An UpstreamSession is a git service running on an upstream. Stdout and
+// Stderr reach EOF once the service exits.
+type UpstreamSession interface {
+	Stdin() io.WriteCloser
+	Stdout() io.Reader
+	Stderr() io.Reader
+	Wait() error
+	Close() error
+}
+
+// exitStatus extracts the exit code of a service from the error returned by
+// UpstreamSession.Wait.
+func exitStatus(err error) uint32 {
+	switch e := err.(type) {
+	case nil:
+		return 0
+	case *ssh.ExitError:
+		return uint32(e.ExitStatus())
+	case *exec.ExitError:
+		if code := e.ExitCode(); code > 0 {
+			return uint32(code)
+		}
+	case *replayExitError:
+		return e.status
+	}
+
+	return 1
+}
+
+// DefaultSSHTimeout is how long connecting to an ssh upstream may take
+// unless configured otherwise.
+const DefaultSSHTimeout = 30 * time.Second
+
+// sshAgentAuth authenticates with the local ssh agent, returning the
+// connection to it to be closed once the handshake is over.
+func sshAgentAuth() (ssh.AuthMethod, io.Closer, error) {
+	sshAgent, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to open ssh agent: %v", err)
+	}
+
+	return ssh.PublicKeysCallback(agent.NewClient(sshAgent).Signers), sshAgent, nil
+}
+
+// SSHUpstream runs git services on a remote ssh server, authenticating with
+// KeyFile or, when that is empty, the local ssh agent. Host keys are checked
+// by HostKeyCallback, or against the user's known_hosts when it is nil.
+type SSHUpstream struct {
+	Host    string
+	Port    int
+	User    string
+	KeyFile string
+
+	HostKeyCallback ssh.HostKeyCallback
+
+	// Timeout limits how long connecting, including the ssh handshake, may
+	// take. DefaultSSHTimeout is used if it is zero.
+	Timeout time.Duration
+}
+
+var defaultKnownHosts struct {
+	sync.Once
+	kh  *KnownHosts
+	err error
+}
+
+func defaultHostKeyCallback(addr string, remote net.Addr, key ssh.PublicKey) error {
+	defaultKnownHosts.Do(func() {
+		defaultKnownHosts.kh, defaultKnownHosts.err = LoadKnownHosts(DefaultKnownHostsFile())
+	})
+
+	if defaultKnownHosts.err != nil {
+		return defaultKnownHosts.err
+	}
+
+	return defaultKnownHosts.kh.HostKeyCallback(addr, remote, key)
+}
+
+// auth returns how to authenticate, and what to close once the handshake
+// is over, if anything.
+func (u *SSHUpstream) auth() (ssh.AuthMethod, io.Closer, error) {
+	if u.KeyFile == "" {
+		return sshAgentAuth()
+	}
+
+	b, err := ioutil.ReadFile(u.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to load key: %v", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse key %s: %v", u.KeyFile, err)
+	}
+
+	return ssh.PublicKeys(signer), nil, nil
+}
+
+// dial connects to the upstream, giving up if connecting or the handshake
+// takes longer than the timeout.
+func (u *SSHUpstream) dial(config *ssh.ClientConfig) (*ssh.Client, error) {
+	timeout := u.Timeout
+	if timeout == 0 {
+		timeout = DefaultSSHTimeout
+	}
+
+	addr := net.JoinHostPort(u.Host, strconv.Itoa(u.Port))
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+func (u *SSHUpstream) location(r *Request) string {
+	host := u.Host
+	if u.Port != 0 && u.Port != 22 {
+		host = fmt.Sprintf("%s:%d", u.Host, u.Port)
+	}
+
+	return host + path.Clean("/"+r.Repo)
+}
+
+func (u *SSHUpstream) Start(r *Request) (UpstreamSession, error) {
+	auth, closer, err := u.auth()
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyCallback := u.HostKeyCallback
+	if hostKeyCallback == nil {
+		hostKeyCallback = defaultHostKeyCallback
+	}
+
+	config := &ssh.ClientConfig{
+		User:            u.User,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: hostKeyCallback,
+	}
+
+	client, err := u.dial(config)
+
+	if closer != nil {
+		// The agent is only needed to sign during the handshake
+		closer.Close()
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect: %v", err)
+	}
+
+	s := &sshSession{client: client}
+
+	s.session, err = client.NewSession()
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("Failed to create new session: %v", err)
+	}
+
+	if r.Protocol != "" {
+		// Servers that don't accept the variable fall back to v0
+		err = s.session.Setenv("GIT_PROTOCOL", r.Protocol)
+		if err != nil {
+			log.Printf("Upstream refused GIT_PROTOCOL: %v", err)
+		}
+	}
+
+	err = s.open(r.Command())
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+type sshSession struct {
+	client  *ssh.Client
+	session *ssh.Session
+
+	stdin  io.WriteCloser
+	stdout io.Reader
+	stderr io.Reader
+}
+
+func (s *sshSession) open(cmd string) (err error) {
+	s.stdin, err = s.session.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("Failed to open stdin: %v", err)
+	}
+
+	s.stdout, err = s.session.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("Failed to open stdout: %v", err)
+	}
+
+	s.stderr, err = s.session.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("Failed to open stderr: %v", err)
+	}
+
+	err = s.session.Start(cmd)
+	if err != nil {
+		return fmt.Errorf("Failed to start command: %v", err)
+	}
+
+	return nil
+}
+
+func (s *sshSession) Stdin() io.WriteCloser { return s.stdin }
+func (s *sshSession) Stdout() io.Reader     { return s.stdout }
+func (s *sshSession) Stderr() io.Reader     { return s.stderr }
+func (s *sshSession) Wait() error           { return s.session.Wait() }
+
+func (s *sshSession) Close() error {
+	s.session.Close()
+	return s.client.Close()
+}
+
+// LocalUpstream runs git services against repositories under Dir on this
+// machine. It is a stand-in for a real upstream when testing.
+type LocalUpstream struct {
+	Dir string
+}
+
+func (u *LocalUpstream) Start(r *Request) (UpstreamSession, error) {
+	return startLocal(u.path(r), r)
+}
+
+func (u *LocalUpstream) path(r *Request) string {
+	return filepath.Join(u.Dir, filepath.Clean("/"+r.Repo))
+}
+
+func (u *LocalUpstream) location(r *Request) string {
+	return "localhost" + filepath.ToSlash(u.path(r))
+}
+
+// startLocal runs the service r asks for on the repository at path.
+func startLocal(path string, r *Request) (UpstreamSession, error) {
+	cmd := exec.Command("git", strings.TrimPrefix(r.Service, "git-"), path)
+	if r.Protocol != "" {
+		cmd.Env = append(os.Environ(), "GIT_PROTOCOL="+r.Protocol)
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open stdin: %v", err)
+	}
+
+	s := &localSession{cmd: cmd, stdin: stdin, done: make(chan struct{})}
+
+	var stdout, stderr *io.PipeWriter
+	s.stdout, stdout = io.Pipe()
+	s.stderr, stderr = io.Pipe()
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to start command: %v", err)
+	}
+
+	go func() {
+		s.err = cmd.Wait()
+		stdout.Close()
+		stderr.Close()
+		close(s.done)
+	}()
+
+	return s, nil
+}
+
+type localSession struct {
+	cmd *exec.Cmd
+
+	stdin  io.WriteCloser
+	stdout *io.PipeReader
+	stderr *io.PipeReader
+
+	done chan struct{}
+	err  error
+}
+
+func (s *localSession) Stdin() io.WriteCloser { return s.stdin }
+func (s *localSession) Stdout() io.Reader     { return s.stdout }
+func (s *localSession) Stderr() io.Reader     { return s.stderr }
+
+func (s *localSession) Wait() error {
+	<-s.done
+	return s.err
+}
+
+func (s *localSession) Close() error {
+	s.stdout.Close()
+	s.stderr.Close()
+
+	select {
+	case <-s.done:
+	default:
+		s.cmd.Process.Kill()
+	}
+
+	return nil
+}
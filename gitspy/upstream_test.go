@@ -0,0 +1,88 @@
+package gitspy
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestSSHUpstreamTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// An agent noting when its connection is closed
+	sock := filepath.Join(dir, "agent.sock")
+
+	al, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer al.Close()
+
+	served := make(chan error, 1)
+	go func() {
+		c, err := al.Accept()
+		if err != nil {
+			served <- err
+			return
+		}
+
+		served <- agent.ServeAgent(agent.NewKeyring(), c)
+	}()
+
+	t.Setenv("SSH_AUTH_SOCK", sock)
+
+	// An upstream that never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			defer c.Close()
+		}
+	}()
+
+	u := &SSHUpstream{
+		Host:            "127.0.0.1",
+		Port:            l.Addr().(*net.TCPAddr).Port,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         50 * time.Millisecond,
+	}
+
+	start := time.Now()
+
+	_, err = u.Start(&Request{Service: UploadPack, Repo: "/test.git"})
+	if err == nil {
+		t.Fatalf("Start should time out")
+	}
+
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Took %v to time out", d)
+	}
+
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Errorf("Agent connection left open")
+	}
+}
@@ -0,0 +1,219 @@
+package gitspy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Protocol v2 commands and fetch response sections
+// https://www.kernel.org/pub/software/scm/git/docs/technical/protocol-v2.html
+const (
+	CommandLsRefs = "ls-refs"
+	CommandFetch  = "fetch"
+
+	SectionAcknowledgments = "acknowledgments"
+	SectionShallowInfo     = "shallow-info"
+	SectionWantedRefs      = "wanted-refs"
+	SectionPackfileURIs    = "packfile-uris"
+	SectionPackfile        = "packfile"
+)
+
+var ErrInvalidRef = errors.New("invalid ref line")
+
+// A V2Command is a command request from a protocol v2 client.
+type V2Command struct {
+	Name         string
+	Capabilities []string
+	Args         []string
+}
+
+// A Ref is a reference as listed by the server.
+type Ref struct {
+	ID           string
+	Name         string
+	SymrefTarget string
+	Peeled       string
+}
+
+// ParseLsRefsLine parses a line of an ls-refs response:
+// "<oid> <refname> [symref-target:<target>] [peeled:<oid>]"
+func ParseLsRefsLine(b []byte) (r Ref, err error) {
+	f := strings.Fields(string(bytes.TrimSuffix(b, []byte("\n"))))
+	if len(f) < 2 {
+		return r, ErrInvalidRef
+	}
+
+	r.ID = f[0]
+	r.Name = f[1]
+
+	for _, a := range f[2:] {
+		if strings.HasPrefix(a, "symref-target:") {
+			r.SymrefTarget = strings.TrimPrefix(a, "symref-target:")
+		} else if strings.HasPrefix(a, "peeled:") {
+			r.Peeled = strings.TrimPrefix(a, "peeled:")
+		}
+	}
+
+	return
+}
+
+// LsRefsLine formats r as a line of an ls-refs response.
+func (r Ref) LsRefsLine() []byte {
+	s := r.ID + " " + r.Name
+
+	if r.SymrefTarget != "" {
+		s += " symref-target:" + r.SymrefTarget
+	}
+
+	if r.Peeled != "" {
+		s += " peeled:" + r.Peeled
+	}
+
+	return []byte(s + "\n")
+}
+
+// proxyV2Command forwards one command request. The command is queued for
+// the response side before its final flush reaches the server. A nil
+// command is returned for a bare flush, which ends the session.
+func (gs *GitSpy) proxyV2Command(dst io.Writer, src io.Reader) (*V2Command, error) {
+	b := make([]byte, 65516)
+
+	var cmd *V2Command
+	args := false
+
+	for {
+		p, err := readPacket(src, b)
+		if err != nil {
+			return cmd, err
+		}
+
+		line := string(bytes.TrimSuffix(p.Data, []byte("\n")))
+
+		switch {
+		case p.Type == FlushPkt:
+			if cmd != nil && cmd.Name == CommandFetch {
+				gs.negotiation.ClientFlush()
+			}
+
+			if cmd != nil {
+				gs.pushCommand(cmd)
+			}
+		case p.Type == DelimPkt:
+			args = true
+		case p.Type != DataPkt:
+			return cmd, fmt.Errorf("Unexpected %v packet in command", p.Type)
+		case cmd == nil:
+			if !strings.HasPrefix(line, "command=") {
+				return cmd, fmt.Errorf("Expected command, got '%s'", line)
+			}
+
+			cmd = &V2Command{Name: strings.TrimPrefix(line, "command=")}
+		case args:
+			cmd.Args = append(cmd.Args, line)
+
+			if cmd.Name == CommandFetch {
+				gs.negotiation.ClientLine(line)
+			}
+		default:
+			cmd.Capabilities = append(cmd.Capabilities, line)
+		}
+
+		ctx := gs.context(ClientToServer, PhaseCommand)
+		if cmd != nil {
+			ctx.Command = cmd.Name
+		}
+
+		err = gs.send(dst, ctx, p)
+		if err != nil {
+			return cmd, err
+		}
+
+		if p.Type == FlushPkt {
+			return cmd, nil
+		}
+	}
+}
+
+// proxyV2Requests forwards command requests until the client hangs up.
+func (gs *GitSpy) proxyV2Requests(dst io.Writer, src io.Reader) error {
+	for {
+		_, err := gs.proxyV2Command(dst, src)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// proxyV2Responses forwards the server's response to each command, in the
+// order the commands were sent.
+func (gs *GitSpy) proxyV2Responses(dst io.Writer, src io.Reader) error {
+	b := make([]byte, 65516)
+
+	for {
+		name := ""
+		started := false
+		phase := PhaseResponse
+
+		var pi *packInspector
+
+		for {
+			p, err := readPacket(src, b)
+			if err == io.EOF && !started {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("Failed parsing pkt: %v", err)
+			}
+
+			if !started {
+				started = true
+				name = gs.nextCommand()
+			}
+
+			ctx := gs.context(ServerToClient, phase)
+			ctx.Command = name
+
+			if pi != nil {
+				err = pi.sideband(p)
+				if err != nil {
+					return err
+				}
+			}
+
+			err = gs.send(dst, ctx, p)
+			if err != nil {
+				return err
+			}
+
+			if p.Type == FlushPkt {
+				if pi != nil {
+					err = pi.Close()
+					if err != nil {
+						return err
+					}
+				}
+
+				break
+			}
+
+			if name != CommandFetch || p.Type != DataPkt || phase == PhaseSideband {
+				continue
+			}
+
+			gs.negotiation.ServerLine(string(p.Data))
+
+			if string(bytes.TrimSuffix(p.Data, []byte("\n"))) == SectionPackfile {
+				gs.negotiation.PackStarted()
+				phase = PhaseSideband
+
+				ctx := gs.context(ServerToClient, phase)
+				ctx.Command = name
+				pi = gs.newPackInspector(ctx)
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package gitspy
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseLsRefsLine(t *testing.T) {
+	l := []byte(oldID + " HEAD symref-target:refs/heads/master\n")
+
+	r, err := ParseLsRefsLine(l)
+	if err != nil {
+		t.Fatalf("Error from parse: %v", err)
+	}
+
+	if r.ID != oldID || r.Name != "HEAD" || r.SymrefTarget != "refs/heads/master" {
+		t.Errorf("Bad decode: %#v", r)
+	}
+
+	if !bytes.Equal(r.LsRefsLine(), l) {
+		t.Errorf("Bad encode: %s", r.LsRefsLine())
+	}
+}
+
+func TestProxyV2Command(t *testing.T) {
+	src := &bytes.Buffer{}
+	WritePktLine(src, []byte("command=ls-refs\n"))
+	WritePktLine(src, []byte("agent=git/2.39.5\n"))
+	WriteSpecialPkt(src, DelimPkt)
+	WritePktLine(src, []byte("peel\n"))
+	WritePktLine(src, []byte("ref-prefix refs/heads/\n"))
+	WritePktLineFlush(src)
+
+	expected := append([]byte(nil), src.Bytes()...)
+
+	gs := testGitSpy(UploadPack, nil)
+	dst := &bytes.Buffer{}
+	cmd, err := gs.proxyV2Command(dst, src)
+	if err != nil {
+		t.Fatalf("Error from proxy: %v", err)
+	}
+
+	if gs.nextCommand() != CommandLsRefs || cmd.Name != CommandLsRefs {
+		t.Errorf("Wrong command: %#v", cmd)
+	}
+
+	if len(cmd.Capabilities) != 1 || len(cmd.Args) != 2 || cmd.Args[1] != "ref-prefix refs/heads/" {
+		t.Errorf("Bad decode: %#v", cmd)
+	}
+
+	if !bytes.Equal(dst.Bytes(), expected) {
+		t.Errorf("Wrong output: %q", dst.Bytes())
+	}
+}
@@ -1,27 +1,232 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/rhettg/git-spy/gitspy"
 )
 
 func main() {
-	config := gitspy.NewSSHServerConfig()
+	configFile := flag.String("config", "", "JSON config file to use instead of the flags below, reloaded on SIGHUP")
+	listen := flag.String("listen", gitspy.DefaultListen, "address to accept ssh connections on")
+	knownHostsFile := flag.String("known-hosts", gitspy.DefaultKnownHostsFile(), "known_hosts file for verifying upstreams")
+	tofu := flag.Bool("trust-on-first-use", false, "accept and remember host keys of unknown upstreams")
+	authorizedKeysFile := flag.String("authorized-keys", "authorized_keys", "authorized_keys file of clients allowed to connect")
+	httpUsersFile := flag.String("http-users", "", "file of user:token lines allowing smart HTTP clients to authenticate, and so to push")
+	stateDir := flag.String("state-dir", ".", "directory holding the server's host keys")
+	upstreamURL := flag.String("upstream-url", "", "smart HTTP server to send every request to instead of GitHub over ssh, such as https://github.com")
+	credentialsFile := flag.String("credentials", "", "git-credential-store file of credentials for the smart HTTP upstream")
+	mirrorDir := flag.String("mirror-dir", "", "directory to keep local mirrors of fetched repositories in, serving fetches from them while they are current")
+	hideRefs := flag.String("hide-refs", "", "comma separated ref patterns to hide from every client, such as refs/pull/*")
+	protectBranches := flag.String("protect-branches", "", "comma separated ref patterns that may not be deleted or force-pushed, such as refs/heads/master")
+	tagCreators := flag.String("tag-creators", "", "comma separated users allowed to create tags, everyone if empty")
+	scanSecrets := flag.Bool("scan-secrets", false, "reject pushes adding files that contain credentials")
+	recordDir := flag.String("record-dir", "", "directory to write a transcript of every session to")
+	replayDir := flag.String("replay", "", "answer every request from the transcripts in this directory instead of an upstream")
+	auditLog := flag.String("audit-log", "", "file to write a JSON audit record of every git operation to, rotated as it grows")
+	httpAddr := flag.String("http-addr", "", "address to serve git's smart HTTP protocol on, such as 127.0.0.1:8080")
+	daemonAddr := flag.String("daemon-addr", "", "address to serve read-only git:// on, such as 127.0.0.1:9418")
+	metricsAddr := flag.String("metrics-addr", "", "address to serve Prometheus metrics on at /metrics, such as 127.0.0.1:9100")
+	shutdownTimeout := flag.Duration("shutdown-timeout", gitspy.DefaultShutdownTimeout, "how long to wait for sessions to finish on SIGTERM before abandoning them")
+	rotate := flag.Bool("rotate-host-keys", false, "replace the generated host keys and exit; send SIGHUP to a running server to load them")
+	flag.Parse()
 
-	listener, err := net.Listen("tcp", "127.0.0.1:2022")
+	// loadConfig reads the config file, or takes the config from the flags
+	loadConfig := func() (*gitspy.Config, error) {
+		if *configFile != "" {
+			return gitspy.LoadConfig(*configFile)
+		}
+
+		c := &gitspy.Config{
+			Listen: gitspy.Listen{
+				SSH:     *listen,
+				HTTP:    *httpAddr,
+				Daemon:  *daemonAddr,
+				Metrics: *metricsAddr,
+			},
+			StateDir:        *stateDir,
+			AuthorizedKeys:  *authorizedKeysFile,
+			KnownHosts:      *knownHostsFile,
+			TrustOnFirstUse: *tofu,
+			HTTPUsers:       *httpUsersFile,
+			MirrorDir:       *mirrorDir,
+			ScanSecrets:     *scanSecrets,
+			RecordDir:       *recordDir,
+			AuditLog:        *auditLog,
+			ShutdownTimeout: gitspy.Duration(*shutdownTimeout),
+		}
+
+		if *upstreamURL != "" {
+			c.Routes = []gitspy.RouteConfig{{URL: *upstreamURL, Credentials: *credentialsFile}}
+		}
+
+		if *hideRefs != "" {
+			for _, p := range strings.Split(*hideRefs, ",") {
+				c.HideRefs = append(c.HideRefs, gitspy.RefRule{Pattern: p})
+			}
+		}
+
+		if *protectBranches != "" || *tagCreators != "" {
+			c.PushPolicy = &gitspy.PushPolicyConfig{}
+			if *protectBranches != "" {
+				for _, p := range strings.Split(*protectBranches, ",") {
+					c.PushPolicy.Branches = append(c.PushPolicy.Branches, gitspy.BranchRule{Pattern: p, DenyNonFastForward: true, DenyDelete: true})
+				}
+			}
+
+			if *tagCreators != "" {
+				c.PushPolicy.TagCreators = strings.Split(*tagCreators, ",")
+			}
+		}
+
+		return c, c.Validate()
+	}
+
+	config, err := loadConfig()
 	if err != nil {
-		log.Fatal("failed to listen for connection: ", err)
+		log.Fatal("bad config: ", err)
+	}
+
+	if *rotate {
+		err := gitspy.RotateHostKeys(config.StateDir)
+		if err != nil {
+			log.Fatal("failed to rotate host keys: ", err)
+		}
+
+		return
 	}
 
-	for {
-		nConn, err := listener.Accept()
+	var replay *gitspy.ReplayUpstream
+	if *replayDir != "" {
+		replay, err = gitspy.LoadReplayUpstream(*replayDir)
 		if err != nil {
-			log.Fatal("failed to accept incoming connection: ", err)
+			log.Fatal("failed to load transcripts: ", err)
+		}
+	}
+
+	settings := func(c *gitspy.Config, old gitspy.Settings) (gitspy.Settings, error) {
+		st, err := c.Reload(old)
+		if err == nil && replay != nil {
+			st.Router = replay
 		}
 
-		log.Printf("Accepted %v", nConn.RemoteAddr())
-		go gitspy.HandleConnection(nConn, config)
+		return st, err
 	}
+
+	st, err := settings(config, gitspy.Settings{})
+	if err != nil {
+		log.Fatal("bad config: ", err)
+	}
+
+	server := gitspy.NewServer(nil, nil)
+	server.Reconfigure(st)
+
+	if config.Listen.Metrics != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", gitspy.DefaultRegistry)
+
+		go func() {
+			log.Printf("Serving metrics on %s", config.Listen.Metrics)
+			log.Fatal("failed to serve metrics: ", http.ListenAndServe(config.Listen.Metrics, mux))
+		}()
+	}
+
+	httpServer := &http.Server{Addr: config.Listen.HTTP, Handler: server}
+	if config.Listen.HTTP != "" {
+		go func() {
+			log.Printf("Serving smart HTTP on %s", config.Listen.HTTP)
+
+			err := httpServer.ListenAndServe()
+			if err != http.ErrServerClosed {
+				log.Fatal("failed to serve smart HTTP: ", err)
+			}
+		}()
+	}
+
+	if config.Listen.Daemon != "" {
+		daemon, err := net.Listen("tcp", config.Listen.Daemon)
+		if err != nil {
+			log.Fatal("failed to listen for git:// connections: ", err)
+		}
+
+		log.Printf("Serving git:// on %s", config.Listen.Daemon)
+
+		go func() {
+			err := server.ServeDaemon(daemon)
+			if err != gitspy.ErrServerClosed {
+				log.Fatal("failed to serve git://: ", err)
+			}
+		}()
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			c, err := loadConfig()
+			if err != nil {
+				log.Printf("Failed to reload config, keeping the old one: %v", err)
+				continue
+			}
+
+			next, err := settings(c, st)
+			if err != nil {
+				log.Printf("Failed to reload config, keeping the old one: %v", err)
+				continue
+			}
+
+			if c.Listen != config.Listen || c.ShutdownTimeout != config.ShutdownTimeout {
+				log.Printf("Listen addresses and the shutdown timeout only change on restart")
+			}
+
+			st = next
+			server.Reconfigure(st)
+			log.Printf("Reloaded config")
+		}
+	}()
+
+	listener, err := net.Listen("tcp", config.Listen.SSH)
+	if err != nil {
+		log.Fatal("failed to listen for connection: ", err)
+	}
+
+	log.Printf("Serving ssh on %s", config.Listen.SSH)
+
+	go func() {
+		err := server.Serve(listener)
+		if err != gitspy.ErrServerClosed {
+			log.Fatal("failed to serve: ", err)
+		}
+	}()
+
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+	<-term
+
+	timeout := time.Duration(config.ShutdownTimeout)
+
+	log.Printf("Shutting down, waiting up to %v for sessions to finish", timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Sessions over HTTP are waited for along with the others
+	go httpServer.Shutdown(ctx)
+
+	err = server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("Abandoned sessions still running: %v", err)
+		return
+	}
+
+	log.Printf("Shut down")
 }